@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+)
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the configuration",
+	Long:  `Inspect the configuration of the OIDC providers.`,
+}
+
+var showConfigCmd = &cobra.Command{
+	Use:   "show",
+	Short: "Print the effective configuration of the provider with the secrets redacted",
+	Long: `Print the configuration of the provider after the project config, the flags and the environment variables
+are applied, and the values resolved from it for the role, e.g. the scope and the region. The secrets are redacted.
+Nothing is requested to the OIDC provider.`,
+	Args: cobra.NoArgs,
+	Run:  showConfig,
+}
+
+func init() {
+	showConfigCmd.Flags().StringP("provider", "p", "", "OIDC provider name")
+	showConfigCmd.Flags().StringP("role", "r", "", "Resolve the per-role config of the role ARN")
+	showConfigCmd.Flags().String("aws-profile", "", "Resolve the role and duration mapped to the AWS profile name in the profiles config")
+	showConfigCmd.Flags().Int64P("max-duration", "d", 0, "Override default max session duration, in seconds, of the role session [900-43200]")
+	addOverrideFlags(showConfigCmd)
+	configCmd.AddCommand(showConfigCmd)
+	rootCmd.AddCommand(configCmd)
+}
+
+func showConfig(cmd *cobra.Command, args []string) {
+	providerName, _ := cmd.Flags().GetString("provider")
+	if providerName == "" {
+		lib.Writeln("The OIDC provider name is required")
+		lib.Exit(nil)
+	}
+	roleArn, _ := cmd.Flags().GetString("role")
+	awsProfile, _ := cmd.Flags().GetString("aws-profile")
+	maxDurationSeconds, _ := cmd.Flags().GetInt64("max-duration")
+
+	effective, err := lib.ResolveEffectiveConfig(providerName, overridesFromFlags(cmd), &lib.EffectiveConfigOptions{
+		RoleArn:                   roleArn,
+		AWSProfile:                awsProfile,
+		MaxSessionDurationSeconds: maxDurationSeconds,
+	})
+	if err != nil {
+		lib.Writeln("Failed to resolve the configuration")
+		lib.Exit(err)
+	}
+
+	out, err := yaml.Marshal(effective)
+	if err != nil {
+		lib.Exit(err)
+	}
+	fmt.Print(string(out))
+}
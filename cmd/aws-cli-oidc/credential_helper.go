@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/natsukagami/go-input"
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var credentialHelperCmd = &cobra.Command{
+	Use:   "credential-helper",
+	Short: "Get AWS credentials as a credential helper configured by environment variables",
+	Long: `Get AWS credentials as a credential helper. It takes no arguments, the OIDC provider and the role are read from
+the environment which the invoking tool passes:
+
+  AWS_CLI_OIDC_PROVIDER                          OIDC provider name (required)
+  AWS_CLI_OIDC_ROLE_ARN                          Role ARN to assume (Default: default_iam_role_arn of the provider)
+  AWS_CLI_OIDC_ROLE_SESSION_DURATION_SECONDS     Session duration of the role (Default: max_session_duration_seconds of the provider)
+
+The credentials are printed to stdout as the credential_process JSON and cached in the secret store.
+Nothing else is printed to stdout, the setup of the provider which isn't configured asks on stderr.`,
+	Args: cobra.NoArgs,
+	Run:  credentialHelper,
+}
+
+func init() {
+	rootCmd.AddCommand(credentialHelperCmd)
+}
+
+func credentialHelper(cmd *cobra.Command, args []string) {
+	if err := runCredentialHelper(os.Getenv, os.Stdin, os.Stdout, os.Stderr); err != nil {
+		lib.Exit(err)
+	}
+}
+
+// runCredentialHelper gets the credentials of the request in the environment and prints them to stdout.
+// The setup of the provider which isn't configured reads stdin and asks on stderr.
+func runCredentialHelper(getenv func(string) string, stdin io.Reader, stdout io.Writer, stderr io.Writer) error {
+	providerName, opts, err := credentialHelperOptions(getenv)
+	if err != nil {
+		return err
+	}
+
+	// stdout is reserved for the credentials
+	client, err := lib.InitializeClient(&input.UI{Reader: stdin, Writer: stderr}, providerName, nil)
+	if err != nil {
+		return errors.Wrap(err, "Failed to login OIDC provider")
+	}
+
+	opts.Output = stdout
+	lib.Authenticate(client, opts)
+	return nil
+}
+
+// credentialHelperOptions parses the environment of the credential helper contract.
+func credentialHelperOptions(getenv func(string) string) (string, *lib.AuthenticateOptions, error) {
+	providerName := getenv("AWS_CLI_OIDC_PROVIDER")
+	if providerName == "" {
+		return "", nil, errors.New("AWS_CLI_OIDC_PROVIDER is required")
+	}
+
+	var maxDurationSeconds int64
+	if s := getenv("AWS_CLI_OIDC_ROLE_SESSION_DURATION_SECONDS"); s != "" {
+		var err error
+		maxDurationSeconds, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", nil, errors.Wrap(err, "AWS_CLI_OIDC_ROLE_SESSION_DURATION_SECONDS must be seconds")
+		}
+	}
+
+	return providerName, &lib.AuthenticateOptions{
+		RoleArn:                   getenv("AWS_CLI_OIDC_ROLE_ARN"),
+		MaxSessionDurationSeconds: maxDurationSeconds,
+		UseSecret:                 true,
+		AsJson:                    true,
+	}, nil
+}
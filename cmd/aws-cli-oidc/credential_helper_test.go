@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func envOf(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestCredentialHelperOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		env          map[string]string
+		wantRoleArn  string
+		wantDuration int64
+		wantErr      bool
+	}{
+		{"provider only", map[string]string{"AWS_CLI_OIDC_PROVIDER": "myop"}, "", 0, false},
+		{"role and duration", map[string]string{
+			"AWS_CLI_OIDC_PROVIDER":                      "myop",
+			"AWS_CLI_OIDC_ROLE_ARN":                      "arn:aws:iam::123456789012:role/dev",
+			"AWS_CLI_OIDC_ROLE_SESSION_DURATION_SECONDS": "900",
+		}, "arn:aws:iam::123456789012:role/dev", 900, false},
+		{"web identity variable of the SDK is ignored", map[string]string{
+			"AWS_CLI_OIDC_PROVIDER": "myop",
+			"AWS_ROLE_ARN":          "arn:aws:iam::123456789012:role/sdk",
+		}, "", 0, false},
+		{"no provider", map[string]string{"AWS_CLI_OIDC_ROLE_ARN": "arn:aws:iam::123456789012:role/dev"}, "", 0, true},
+		{"invalid duration", map[string]string{
+			"AWS_CLI_OIDC_PROVIDER":                      "myop",
+			"AWS_CLI_OIDC_ROLE_SESSION_DURATION_SECONDS": "1h",
+		}, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, opts, err := credentialHelperOptions(envOf(tt.env))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("credentialHelperOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if provider != "myop" || opts.RoleArn != tt.wantRoleArn || opts.MaxSessionDurationSeconds != tt.wantDuration {
+				t.Errorf("credentialHelperOptions() = %s %+v", provider, opts)
+			}
+			if !opts.AsJson || !opts.UseSecret {
+				t.Errorf("The credential helper should print the cached credentials as JSON: %+v", opts)
+			}
+		})
+	}
+}
+
+func TestRunCredentialHelperKeepsStdoutForCredentials(t *testing.T) {
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+
+	// The provider isn't configured, the setup is asked and declined
+	var stdout, stderr bytes.Buffer
+	err := runCredentialHelper(envOf(map[string]string{"AWS_CLI_OIDC_PROVIDER": "myop"}), strings.NewReader("n\n"), &stdout, &stderr)
+	if err == nil {
+		t.Fatal("The declined setup should fail")
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("Nothing but the credentials should be printed to stdout: %q", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Do you want to setup") {
+		t.Errorf("The setup should be asked on stderr: %q", stderr.String())
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+var eksTokenCmd = &cobra.Command{
+	Use:   "eks-token",
+	Short: "Print the token of the EKS cluster for kubectl",
+	Long: `Print the token of the EKS cluster, which is the sts:GetCallerIdentity URL presigned by the credentials of the role,
+as the ExecCredential of the kubectl exec credential plugin. The credentials are cached in the OS secret store.`,
+	Run: eksToken,
+}
+
+func init() {
+	eksTokenCmd.Flags().StringP("provider", "p", "", "OIDC provider name")
+	eksTokenCmd.Flags().StringP("role", "r", "", "Override default assume role ARN")
+	eksTokenCmd.Flags().Int64P("max-duration", "d", 0, "Override default max session duration, in seconds, of the role session [900-43200]")
+	eksTokenCmd.Flags().String("cluster-name", "", "Name of the EKS cluster")
+	eksTokenCmd.Flags().String("region", "", "Region of STS, it takes precedence over AWS_REGION and the AWS profile")
+	eksTokenCmd.Flags().Bool("no-cache", false, "Force login and neither read nor write the OS secret store")
+	rootCmd.AddCommand(eksTokenCmd)
+}
+
+func eksToken(cmd *cobra.Command, args []string) {
+	providerName, _ := cmd.Flags().GetString("provider")
+	if providerName == "" {
+		lib.Writeln("The OIDC provider name is required")
+		lib.Exit(nil)
+	}
+	clusterName, _ := cmd.Flags().GetString("cluster-name")
+	if clusterName == "" {
+		lib.Writeln("The EKS cluster name is required")
+		lib.Exit(nil)
+	}
+	roleArn, _ := cmd.Flags().GetString("role")
+	maxDurationSeconds, _ := cmd.Flags().GetInt64("max-duration")
+	region, _ := cmd.Flags().GetString("region")
+	noCache, _ := cmd.Flags().GetBool("no-cache")
+
+	overrides := map[string]string{}
+	if region != "" {
+		overrides[lib.REGION] = region
+	}
+	client, err := lib.CheckInstalledWithOverrides(providerName, overrides)
+	if err != nil {
+		lib.Writeln("Failed to login OIDC provider")
+		lib.Exit(err)
+	}
+
+	lib.Authenticate(client, &lib.AuthenticateOptions{
+		RoleArn:                   roleArn,
+		MaxSessionDurationSeconds: maxDurationSeconds,
+		UseSecret:                 true,
+		NoCache:                   noCache,
+		EKSClusterName:            clusterName,
+	})
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"time"
+
 	"github.com/openstandia/aws-cli-oidc/lib"
 	"github.com/spf13/cobra"
 )
@@ -14,11 +18,40 @@ var getCredCmd = &cobra.Command{
 
 func init() {
 	getCredCmd.Flags().StringP("provider", "p", "", "OIDC provider name")
+	addOverrideFlags(getCredCmd)
 	getCredCmd.Flags().StringP("role", "r", "", "Override default assume role ARN")
+	getCredCmd.Flags().String("aws-profile", "", "Use the role and duration mapped to the AWS profile name in the profiles config")
 	getCredCmd.Flags().Int64P("max-duration", "d", 0, "Override default max session duration, in seconds, of the role session [900-43200]")
+	getCredCmd.Flags().Bool("duration-from-token", false, "Use the remaining lifetime of the token as the session duration when --max-duration isn't set")
 	getCredCmd.Flags().BoolP("web-console", "w", false, "Open AWS Web Console in browser using the OIDC provider config")
 	getCredCmd.Flags().BoolP("use-secret", "s", false, "Store AWS credentials into OS secret store, then load it without re-authentication")
+	getCredCmd.Flags().Bool("no-cache", false, "Force login and neither read nor write the OS secret store, even with --use-secret")
 	getCredCmd.Flags().BoolP("json", "j", false, "Print the credential as JSON format")
+	getCredCmd.Flags().String("format", "", "Output format: json, export, sso-json or full-json (Default: default_output_format of the provider, or export)")
+	getCredCmd.Flags().Bool("include-scopes", false, "Include the scopes granted by the login in the json and full-json output for auditing")
+	getCredCmd.Flags().Bool("pretty", false, "Indent the JSON output for readability")
+	getCredCmd.Flags().Int("process-version", 1, "Version of the JSON output, for SDKs which support another version of credential_process")
+	getCredCmd.Flags().String("token", "", "Use the ID token which is already issued instead of login (Default: $AWS_CLI_OIDC_TOKEN)")
+	getCredCmd.Flags().String("login-flow", "", "Override the login flow: auto, loopback, manual or device")
+	getCredCmd.Flags().Bool("all-accounts", false, "Assume all the roles of --roles (Default: the roles config) by the single login")
+	getCredCmd.Flags().StringSlice("roles", nil, "Role ARNs to assume with --all-accounts")
+	getCredCmd.Flags().Bool("write-profiles", false, "Write a profile per role into the AWS credentials file with --all-accounts")
+	getCredCmd.Flags().Bool("notify", false, "Notify by the desktop notification or the terminal bell when the login is completed")
+	getCredCmd.Flags().Bool("output-expiration-only", false, "Print the remaining validity of the cached session without login, exit non-zero if there is no valid one")
+	getCredCmd.Flags().String("expiration-format", "seconds", "Format of --output-expiration-only: seconds or rfc3339")
+	getCredCmd.Flags().Bool("clear", false, "Print unset lines for the previous session's AWS_* variables before the exports")
+	getCredCmd.Flags().String("webfinger", "", "Discover the OIDC provider of the email-like identifier by WebFinger, instead of --metadata-url")
+	getCredCmd.Flags().StringSlice("policy-arn", nil, "ARN of the managed policy to downscope the role session (repeatable)")
+	getCredCmd.Flags().String("policy", "", "Inline policy JSON to downscope the role session")
+	getCredCmd.Flags().String("chain-role", "", "Assume the role by the credentials of the role of -r (role chaining)")
+	getCredCmd.Flags().String("chain-external-id", "", "ExternalId of the AssumeRole of --chain-role, for the trust policy which requires it")
+	getCredCmd.Flags().String("display", "", "How the OIDC provider displays the login page: page, popup, touch or wap")
+	getCredCmd.Flags().String("ui-locales", "", "Preferred languages of the login page as space-separated BCP 47 tags, e.g. \"ja en\"")
+	getCredCmd.Flags().StringSlice("transitive-tag-key", nil, "Require the session tag of the token to be transitive for the role chaining (repeatable)")
+	getCredCmd.Flags().String("profile", "", "Also write the credentials as the named profile into the AWS credentials file, in addition to the output")
+	getCredCmd.Flags().String("switch-profile", "", "Write the AWS profile which gets the credentials by credential_process, then export AWS_PROFILE instead of the keys")
+	getCredCmd.Flags().String("token-file", "", "Write the ID token to the file after login for other tools")
+	getCredCmd.Flags().String("token-file-format", "jwt", "Format of --token-file: jwt or json (with expires_at)")
 	rootCmd.AddCommand(getCredCmd)
 }
 
@@ -30,16 +63,144 @@ func getCred(cmd *cobra.Command, args []string) {
 	}
 
 	roleArn, _ := cmd.Flags().GetString("role")
+	if expirationOnly, _ := cmd.Flags().GetBool("output-expiration-only"); expirationOnly {
+		format, _ := cmd.Flags().GetString("expiration-format")
+		maxDurationSeconds, _ := cmd.Flags().GetInt64("max-duration")
+		outputExpiration(providerName, roleArn, maxDurationSeconds, format)
+		return
+	}
+
 	maxDurationSeconds, _ := cmd.Flags().GetInt64("max-duration")
 	useSecret, _ := cmd.Flags().GetBool("use-secret")
 	asJson, _ := cmd.Flags().GetBool("json")
+	outputFormat, _ := cmd.Flags().GetString("format")
+	pretty, _ := cmd.Flags().GetBool("pretty")
+	includeScopes, _ := cmd.Flags().GetBool("include-scopes")
+	processVersion, _ := cmd.Flags().GetInt("process-version")
+	if processVersion <= 0 {
+		lib.Writeln("The --process-version must be a positive integer")
+		lib.Exit(nil)
+	}
 	webConsole, _ := cmd.Flags().GetBool("web-console")
+	clearEnv, _ := cmd.Flags().GetBool("clear")
+	token, _ := cmd.Flags().GetString("token")
+	loginFlow, _ := cmd.Flags().GetString("login-flow")
+	durationFromToken, _ := cmd.Flags().GetBool("duration-from-token")
+	awsProfile, _ := cmd.Flags().GetString("aws-profile")
+	notify, _ := cmd.Flags().GetBool("notify")
+	noCache, _ := cmd.Flags().GetBool("no-cache")
+	switchProfile, _ := cmd.Flags().GetString("switch-profile")
+	writeProfile, _ := cmd.Flags().GetString("profile")
+	if writeProfile != "" && switchProfile != "" {
+		lib.Writeln("--profile can't be combined with --switch-profile")
+		lib.Exit(nil)
+	}
+	transitiveTagKeys, _ := cmd.Flags().GetStringSlice("transitive-tag-key")
+	display, _ := cmd.Flags().GetString("display")
+	uiLocales, _ := cmd.Flags().GetString("ui-locales")
+	chainRoleArn, _ := cmd.Flags().GetString("chain-role")
+	chainExternalID, _ := cmd.Flags().GetString("chain-external-id")
+	if chainExternalID != "" {
+		if chainRoleArn == "" {
+			lib.Writeln("--chain-external-id requires --chain-role")
+			lib.Exit(nil)
+		}
+		if err := lib.ValidateExternalID(chainExternalID); err != nil {
+			lib.Writeln("Invalid --chain-external-id")
+			lib.Exit(err)
+		}
+	}
+	tokenFile, _ := cmd.Flags().GetString("token-file")
+	tokenFileFormat, _ := cmd.Flags().GetString("token-file-format")
+	policyArns, _ := cmd.Flags().GetStringSlice("policy-arn")
+	policy, _ := cmd.Flags().GetString("policy")
+	sessionPolicy := &lib.SessionPolicy{PolicyArns: policyArns, Policy: policy}
+	if err := sessionPolicy.Validate(); err != nil {
+		lib.Writeln("Invalid --policy")
+		lib.Exit(err)
+	}
+	if token == "" {
+		token = os.Getenv("AWS_CLI_OIDC_TOKEN")
+	}
 
-	client, err := lib.CheckInstalled(providerName)
+	overrides := overridesFromFlags(cmd)
+	if webFinger, _ := cmd.Flags().GetString("webfinger"); webFinger != "" && overrides[lib.OIDC_PROVIDER_METADATA_URL] == "" {
+		metadataURL, err := lib.DiscoverMetadataURL(webFinger)
+		if err != nil {
+			lib.Writeln("Failed to discover the OIDC provider by WebFinger")
+			lib.Exit(err)
+		}
+		lib.Writeln("Discovered the OIDC provider: %s", metadataURL)
+		overrides[lib.OIDC_PROVIDER_METADATA_URL] = metadataURL
+	}
+
+	client, err := lib.CheckInstalledWithOverrides(providerName, overrides)
 	if err != nil {
 		lib.Writeln("Failed to login OIDC provider")
 		lib.Exit(err)
 	}
 
-	lib.Authenticate(client, roleArn, maxDurationSeconds, useSecret, asJson, webConsole)
+	if allAccounts, _ := cmd.Flags().GetBool("all-accounts"); allAccounts {
+		if clearEnv {
+			lib.Writeln("--clear can't be combined with --all-accounts, which prints the JSON")
+			lib.Exit(nil)
+		}
+		roleArns, _ := cmd.Flags().GetStringSlice("roles")
+		writeProfiles, _ := cmd.Flags().GetBool("write-profiles")
+		lib.AuthenticateAll(client, &lib.AuthenticateAllOptions{
+			RoleArns:                  roleArns,
+			MaxSessionDurationSeconds: maxDurationSeconds,
+			WriteProfiles:             writeProfiles,
+			Pretty:                    pretty,
+			LoginFlow:                 loginFlow,
+		})
+		return
+	}
+
+	lib.Authenticate(client, &lib.AuthenticateOptions{
+		RoleArn:                   roleArn,
+		MaxSessionDurationSeconds: maxDurationSeconds,
+		UseSecret:                 useSecret,
+		AsJson:                    asJson,
+		Pretty:                    pretty,
+		ProcessVersion:            processVersion,
+		WebConsole:                webConsole,
+		ClearEnv:                  clearEnv,
+		Token:                     token,
+		LoginFlow:                 loginFlow,
+		DurationFromToken:         durationFromToken,
+		AWSProfile:                awsProfile,
+		Notify:                    notify,
+		NoCache:                   noCache,
+		TokenFile:                 tokenFile,
+		TokenFileFormat:           tokenFileFormat,
+		SwitchProfile:             switchProfile,
+		WriteProfile:              writeProfile,
+		TransitiveTagKeys:         transitiveTagKeys,
+		Display:                   display,
+		UILocales:                 uiLocales,
+		ChainRoleArn:              chainRoleArn,
+		ChainExternalID:           chainExternalID,
+		SessionPolicy:             sessionPolicy,
+		OutputFormat:              outputFormat,
+		IncludeScopes:             includeScopes,
+	})
+}
+
+func outputExpiration(providerName, roleArn string, maxDurationSeconds int64, format string) {
+	lib.IsQuiet = true
+
+	expires, err := lib.CachedExpiration(providerName, roleArn, maxDurationSeconds)
+	if err != nil {
+		lib.Exit(err)
+	}
+
+	switch format {
+	case "rfc3339":
+		fmt.Println(expires.Format(time.RFC3339))
+	case "seconds":
+		fmt.Println(int64(time.Until(expires).Seconds()))
+	default:
+		lib.Exit(fmt.Errorf("Unknown expiration format: %s", format))
+	}
 }
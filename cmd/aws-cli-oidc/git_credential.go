@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+var gitCredentialCmd = &cobra.Command{
+	Use:   "git-credential [get|store|erase]",
+	Short: "Git credential helper for AWS CodeCommit over HTTPS",
+	Long: `Git credential helper for AWS CodeCommit over HTTPS. On get, it reads protocol, host and path from stdin
+as git passes them, and prints the CodeCommit Git credential derived from the AWS credentials of the role.
+store and erase are ignored. Configure git with credential.UseHttpPath=true so that the path is passed.`,
+	Args: cobra.ExactArgs(1),
+	Run:  gitCredential,
+}
+
+func init() {
+	gitCredentialCmd.Flags().StringP("provider", "p", "", "OIDC provider name")
+	gitCredentialCmd.Flags().StringP("role", "r", "", "Override default assume role ARN")
+	gitCredentialCmd.Flags().Int64P("max-duration", "d", 0, "Override default max session duration, in seconds, of the role session [900-43200]")
+	rootCmd.AddCommand(gitCredentialCmd)
+}
+
+func gitCredential(cmd *cobra.Command, args []string) {
+	if args[0] != "get" {
+		return
+	}
+
+	providerName, _ := cmd.Flags().GetString("provider")
+	if providerName == "" {
+		lib.Writeln("The OIDC provider name is required")
+		lib.Exit(nil)
+	}
+	roleArn, _ := cmd.Flags().GetString("role")
+	maxDurationSeconds, _ := cmd.Flags().GetInt64("max-duration")
+
+	attrs := map[string]string{}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if kv := strings.SplitN(line, "=", 2); len(kv) == 2 {
+			attrs[kv[0]] = kv[1]
+		}
+	}
+	if attrs["protocol"] != "https" || attrs["host"] == "" {
+		// Not for CodeCommit over HTTPS, let the other helpers answer
+		return
+	}
+	repositoryURL := "https://" + attrs["host"] + "/" + attrs["path"]
+
+	client, err := lib.CheckInstalled(providerName)
+	if err != nil {
+		lib.Writeln("Failed to login OIDC provider")
+		lib.Exit(err)
+	}
+
+	lib.Authenticate(client, &lib.AuthenticateOptions{
+		RoleArn:                   roleArn,
+		MaxSessionDurationSeconds: maxDurationSeconds,
+		UseSecret:                 true,
+		GitCredentialURL:          repositoryURL,
+	})
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+var introspectCmd = &cobra.Command{
+	Use:   "introspect",
+	Short: "Show the state of the access token",
+	Long: `Show active, exp, scope and aud of the access token by the introspection endpoint (RFC 7662) of the OIDC provider.
+Without the endpoint, the JWT access token is decoded locally. Without --token, the access token is issued by the stored refresh token.`,
+	Args: cobra.NoArgs,
+	Run:  introspect,
+}
+
+func init() {
+	introspectCmd.Flags().StringP("provider", "p", "", "OIDC provider name")
+	introspectCmd.Flags().String("token", "", "The access token to introspect (Default: $AWS_CLI_OIDC_ACCESS_TOKEN)")
+	introspectCmd.Flags().Bool("print-access-token-expiry", false, "Print only the expiry of the access token in RFC3339, exit non-zero if it's not active")
+	rootCmd.AddCommand(introspectCmd)
+}
+
+func introspect(cmd *cobra.Command, args []string) {
+	providerName, _ := cmd.Flags().GetString("provider")
+	if providerName == "" {
+		lib.Writeln("The OIDC provider name is required")
+		lib.Exit(nil)
+	}
+	accessToken, _ := cmd.Flags().GetString("token")
+	if accessToken == "" {
+		accessToken = os.Getenv("AWS_CLI_OIDC_ACCESS_TOKEN")
+	}
+	expiryOnly, _ := cmd.Flags().GetBool("print-access-token-expiry")
+
+	client, err := lib.CheckInstalled(providerName)
+	if err != nil {
+		lib.Writeln("Failed to login OIDC provider")
+		lib.Exit(err)
+	}
+
+	if accessToken == "" {
+		accessToken, err = lib.CurrentAccessToken(client)
+		if err != nil {
+			lib.Writeln("Failed to get the access token")
+			lib.Exit(err)
+		}
+	}
+
+	ti, err := lib.IntrospectToken(client, accessToken)
+	if err != nil {
+		lib.Writeln("Failed to introspect the access token")
+		lib.Exit(err)
+	}
+
+	if expiryOnly {
+		if !ti.Active {
+			lib.Writeln("The access token is not active")
+			lib.Exit(nil)
+		}
+		fmt.Println(formatExpiry(ti.Expires))
+		return
+	}
+
+	if ti.Local {
+		lib.Writeln("The OIDC provider has no introspection endpoint, decoded the JWT without verification")
+	}
+	fmt.Printf("active: %t\n", ti.Active)
+	fmt.Printf("exp: %s\n", formatExpiry(ti.Expires))
+	fmt.Printf("scope: %s\n", ti.Scope)
+	fmt.Printf("aud: %s\n", strings.Join(ti.Audiences, " "))
+}
+
+func formatExpiry(exp time.Time) string {
+	if exp.IsZero() {
+		return "-"
+	}
+	return exp.Format(time.RFC3339)
+}
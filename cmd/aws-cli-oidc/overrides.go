@@ -0,0 +1,51 @@
+package main
+
+import (
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+// overrideFlags are the bool flags which turn on the key of the provider config for the run
+var overrideFlags = []struct {
+	name  string
+	key   string
+	usage string
+}{
+	{"insecure", lib.ALLOW_INSECURE_METADATA, "Accept the http metadata URL on a loopback address, only for the local testing"},
+	{"allow-non-loopback-callback", lib.ALLOW_NON_LOOPBACK_CALLBACK, "Allow the callback server to listen on a non-loopback callback_host"},
+	{"retry-browser", lib.RETRY_BROWSER, "Ask whether the browser opened the login page if it hasn't returned in first_contact_timeout, then offer browser_command"},
+	{"assume-role-session-duration-negotiation", lib.SESSION_DURATION_NEGOTIATION, "Retry with the max session duration of the role when it's exceeded, and remember it for the next runs"},
+	{"strict-clock", lib.STRICT_CLOCK, "Fail before the login if the local clock is off from the OIDC provider beyond clock_skew_seconds (Default: 60)"},
+}
+
+// addOverrideFlags adds the flags which override the provider config for the run.
+// get-cred and config show share them, so that config show resolves what get-cred uses.
+func addOverrideFlags(cmd *cobra.Command) {
+	cmd.Flags().String("metadata-url", "", "Override the OIDC provider metadata URL for this run")
+	cmd.Flags().String("client-id", "", "Override the client ID for this run")
+	cmd.Flags().String("scope", "", "Override the requested scope for this run, openid is always included")
+	cmd.Flags().String("region", "", "Region of STS, it takes precedence over AWS_REGION and the AWS profile")
+	for _, flag := range overrideFlags {
+		cmd.Flags().Bool(flag.name, false, flag.usage)
+	}
+}
+
+// overridesFromFlags returns the overrides of the provider config by the flags of addOverrideFlags.
+func overridesFromFlags(cmd *cobra.Command) map[string]string {
+	metadataURL, _ := cmd.Flags().GetString("metadata-url")
+	clientID, _ := cmd.Flags().GetString("client-id")
+	scope, _ := cmd.Flags().GetString("scope")
+	region, _ := cmd.Flags().GetString("region")
+	overrides := map[string]string{
+		lib.OIDC_PROVIDER_METADATA_URL: metadataURL,
+		lib.CLIENT_ID:                  clientID,
+		lib.SCOPE:                      scope,
+		lib.REGION:                     region,
+	}
+	for _, flag := range overrideFlags {
+		if on, _ := cmd.Flags().GetBool(flag.name); on {
+			overrides[flag.key] = "true"
+		}
+	}
+	return overrides
+}
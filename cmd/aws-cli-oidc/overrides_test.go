@@ -0,0 +1,46 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+func TestOverridesFromFlags(t *testing.T) {
+	cmd := &cobra.Command{Use: "test"}
+	addOverrideFlags(cmd)
+	if err := cmd.Flags().Parse([]string{"--region", "us-west-2", "--insecure", "--strict-clock"}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		lib.OIDC_PROVIDER_METADATA_URL: "",
+		lib.CLIENT_ID:                  "",
+		lib.SCOPE:                      "",
+		lib.REGION:                     "us-west-2",
+		lib.ALLOW_INSECURE_METADATA:    "true",
+		lib.STRICT_CLOCK:               "true",
+	}
+	if got := overridesFromFlags(cmd); !reflect.DeepEqual(got, want) {
+		t.Errorf("overridesFromFlags() = %v, want %v", got, want)
+	}
+}
+
+func TestConfigShowTakesFlagsOfGetCred(t *testing.T) {
+	names := []string{"metadata-url", "client-id", "scope", "region", "role", "aws-profile", "max-duration"}
+	for _, flag := range overrideFlags {
+		names = append(names, flag.name)
+	}
+	for _, name := range names {
+		getCred, show := getCredCmd.Flags().Lookup(name), showConfigCmd.Flags().Lookup(name)
+		if getCred == nil || show == nil {
+			t.Errorf("--%s should be taken by both get-cred and config show", name)
+			continue
+		}
+		if getCred.Shorthand != show.Shorthand {
+			t.Errorf("The shorthand of --%s differs: -%s and -%s", name, getCred.Shorthand, show.Shorthand)
+		}
+	}
+}
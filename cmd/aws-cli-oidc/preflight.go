@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+var preflightCmd = &cobra.Command{
+	Use:   "preflight",
+	Short: "Validate the config of all the providers without login and print a JSON report",
+	Long: `Validate the config of all the providers without login, for the rollout of the config to many machines.
+For each provider, it checks the discovery, the endpoints, the reachability of the JWKS, the clock skew from the
+OIDC provider, the callback port and the secret backend, then prints the result of each check as JSON. It exits non-zero if any check fails.`,
+	Args: cobra.NoArgs,
+	Run:  preflight,
+}
+
+func init() {
+	preflightCmd.Flags().StringSliceP("provider", "p", nil, "OIDC provider names to check (Default: all the configured providers)")
+	preflightCmd.Flags().Bool("skip-keyring", false, "Skip the check of the secret backend")
+	preflightCmd.Flags().Bool("pretty", false, "Indent the JSON output for readability")
+	rootCmd.AddCommand(preflightCmd)
+}
+
+func preflight(cmd *cobra.Command, args []string) {
+	providers, _ := cmd.Flags().GetStringSlice("provider")
+	skipKeyring, _ := cmd.Flags().GetBool("skip-keyring")
+	pretty, _ := cmd.Flags().GetBool("pretty")
+
+	report := lib.Preflight(&lib.PreflightOptions{Providers: providers, SkipKeyring: skipKeyring})
+
+	var out []byte
+	var err error
+	if pretty {
+		out, err = json.MarshalIndent(report, "", "  ")
+	} else {
+		out, err = json.Marshal(report)
+	}
+	if err != nil {
+		lib.Exit(err)
+	}
+	fmt.Println(string(out))
+	if !report.OK {
+		os.Exit(1)
+	}
+}
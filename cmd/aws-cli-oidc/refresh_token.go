@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+var refreshTokenCmd = &cobra.Command{
+	Use:   "refresh-token",
+	Short: "Manage the refresh tokens in OS secret store",
+	Long:  `Manage the refresh tokens of the OIDC providers in OS secret store, independently of the AWS credentials.`,
+}
+
+var listRefreshTokenCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the stored refresh tokens",
+	Long:  `List the stored refresh tokens with the provider name, the masked token and the stored time.`,
+	Args:  cobra.NoArgs,
+	Run:   listRefreshToken,
+}
+
+var clearRefreshTokenCmd = &cobra.Command{
+	Use:   "clear",
+	Short: "Delete the stored refresh token of the provider",
+	Long:  `Delete the stored refresh token of the provider, so that the next login asks your consent again. The cached AWS credentials are kept.`,
+	Args:  cobra.NoArgs,
+	Run:   clearRefreshToken,
+}
+
+func init() {
+	clearRefreshTokenCmd.Flags().StringP("provider", "p", "", "OIDC provider name")
+	clearRefreshTokenCmd.Flags().Bool("revoke", false, "Also revoke the token by the revocation endpoint of the OIDC provider")
+	refreshTokenCmd.AddCommand(listRefreshTokenCmd)
+	refreshTokenCmd.AddCommand(clearRefreshTokenCmd)
+	rootCmd.AddCommand(refreshTokenCmd)
+}
+
+func listRefreshToken(cmd *cobra.Command, args []string) {
+	tokens, err := lib.StoredRefreshTokens()
+	if err != nil {
+		lib.Writeln("Failed to list the refresh tokens")
+		lib.Exit(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PROVIDER\tTOKEN\tSTORED AT")
+	for _, t := range tokens {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", t.Provider, t.MaskedToken, t.StoredAt.Format(time.RFC3339))
+	}
+	w.Flush()
+}
+
+func clearRefreshToken(cmd *cobra.Command, args []string) {
+	providerName, _ := cmd.Flags().GetString("provider")
+	if providerName == "" {
+		lib.Writeln("The OIDC provider name is required")
+		lib.Exit(nil)
+	}
+	revoke, _ := cmd.Flags().GetBool("revoke")
+
+	if err := lib.ClearRefreshToken(providerName, revoke); err != nil {
+		lib.Writeln("Failed to clear the refresh token")
+		lib.Exit(err)
+	}
+	lib.Write("The refresh token of %s has been cleared", providerName)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"time"
+
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+var renewCmd = &cobra.Command{
+	Use:   "renew",
+	Short: "Renew the cached AWS credentials which are expiring soon",
+	Long:  `Renew the cached AWS credentials of the OIDC provider which are expiring soon, using the stored refresh token without browser. Intended to be run from cron or systemd timers.`,
+	Run:   renew,
+}
+
+func init() {
+	renewCmd.Flags().StringP("provider", "p", "", "OIDC provider name")
+	renewCmd.Flags().Int64("buffer", 300, "Renew the credentials which expire within the seconds")
+	renewCmd.Flags().BoolP("verbose", "v", false, "Print the progress")
+	renewCmd.Flags().String("token-file", "", "Rewrite the file with the refreshed ID token")
+	renewCmd.Flags().String("token-file-format", "jwt", "Format of --token-file: jwt or json (with expires_at)")
+	rootCmd.AddCommand(renewCmd)
+}
+
+func renew(cmd *cobra.Command, args []string) {
+	providerName, _ := cmd.Flags().GetString("provider")
+	if providerName == "" {
+		lib.Writeln("The OIDC provider name is required")
+		lib.Exit(nil)
+	}
+
+	buffer, _ := cmd.Flags().GetInt64("buffer")
+	verbose, _ := cmd.Flags().GetBool("verbose")
+	tokenFile, _ := cmd.Flags().GetString("token-file")
+	tokenFileFormat, _ := cmd.Flags().GetString("token-file-format")
+	lib.IsQuiet = !verbose
+
+	client, err := lib.CheckInstalled(providerName)
+	if err != nil {
+		lib.Exit(err)
+	}
+
+	opts := &lib.RenewOptions{
+		Buffer:          time.Duration(buffer) * time.Second,
+		TokenFile:       tokenFile,
+		TokenFileFormat: tokenFileFormat,
+	}
+	if err := lib.Renew(client, opts); err != nil {
+		lib.Exit(err)
+	}
+}
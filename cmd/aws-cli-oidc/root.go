@@ -20,6 +20,9 @@ func Execute() {
 
 func init() {
 	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().Bool("debug-http", false, "Log the HTTP requests and responses of the OIDC provider with the secrets redacted")
+	rootCmd.PersistentFlags().Bool("trust-project-config", false, "Merge the .aws-cli-oidc.yaml of the current directory even if it isn't in trusted_project_dirs")
+	rootCmd.PersistentFlags().Duration("timeout", 0, "Bound the whole run, e.g. 2m, then exit with code 124 (Default: no limit)")
 }
 
 func initConfig() {
@@ -28,6 +31,16 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		lib.Writeln("Using config file: %s", viper.ConfigFileUsed())
 	}
+	trustProjectConfig, _ := rootCmd.PersistentFlags().GetBool("trust-project-config")
+	if path, err := lib.MergeProjectConfig(trustProjectConfig); err != nil {
+		lib.Writeln("Failed to load the project config")
+		lib.Exit(err)
+	} else if path != "" {
+		lib.Writeln("Using project config file: %s", path)
+	}
 
 	lib.IsTraceEnabled = false // TODO: configuable
+	lib.IsDebugHTTPEnabled, _ = rootCmd.PersistentFlags().GetBool("debug-http")
+	timeout, _ := rootCmd.PersistentFlags().GetDuration("timeout")
+	lib.SetTimeout(timeout)
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+var selftestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Check the login flow works on this machine against a mock OIDC provider",
+	Long: `Check the login flow works on this machine without a real OIDC provider. It runs the discovery, the login
+by the loopback redirect, the AssumeRoleWithWebIdentity call and the OS secret store against the in-process
+mock OIDC provider and STS. The browser is emulated, so nothing is opened.`,
+	Args: cobra.NoArgs,
+	Run:  selftest,
+}
+
+func init() {
+	selftestCmd.Flags().Bool("skip-keyring", false, "Skip the check of the OS secret store")
+	rootCmd.AddCommand(selftestCmd)
+}
+
+func selftest(cmd *cobra.Command, args []string) {
+	skipKeyring, _ := cmd.Flags().GetBool("skip-keyring")
+
+	if err := lib.Selftest(&lib.SelftestOptions{SkipKeyring: skipKeyring}); err != nil {
+		lib.Writeln("Selftest failed")
+		lib.Exit(err)
+	}
+	lib.Writeln("Selftest passed")
+}
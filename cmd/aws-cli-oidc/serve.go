@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+
+	"github.com/openstandia/aws-cli-oidc/lib"
+	"github.com/spf13/cobra"
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve AWS credentials to local tools and refresh them in the background",
+	Long: `Serve AWS credentials of the role over a Unix domain socket which only the user can connect to.
+Each connection receives the credential_process JSON, or {"Error": "..."}, then it's closed.
+The credentials are refreshed in the background before they expire.
+The socket path is printed to stdout only after the first credentials are obtained, otherwise it exits non-zero.`,
+	Args: cobra.NoArgs,
+	Run:  serve,
+}
+
+func init() {
+	serveCmd.Flags().StringP("provider", "p", "", "OIDC provider name")
+	serveCmd.Flags().StringP("role", "r", "", "Override default assume role ARN")
+	serveCmd.Flags().Int64P("max-duration", "d", 0, "Override default max session duration, in seconds, of the role session [900-43200]")
+	serveCmd.Flags().String("login-flow", "", "Override the login flow: auto, loopback, manual or device")
+	serveCmd.Flags().String("socket", "", "Path of the Unix domain socket to serve the credentials")
+	serveCmd.Flags().Int64("refresh-buffer", 300, "Refresh the credentials the seconds before they expire")
+	serveCmd.Flags().Int("ready-fd", -1, "Write a newline to the file descriptor and close it when the socket is ready")
+	serveCmd.Flags().String("trigger-file", "", "Refresh the credentials immediately when the file is created or written, as well as on SIGHUP")
+	serveCmd.Flags().Bool("relogin-on-trigger", false, "Login again on SIGHUP or --trigger-file instead of using the refresh token")
+	rootCmd.AddCommand(serveCmd)
+}
+
+func serve(cmd *cobra.Command, args []string) {
+	providerName, _ := cmd.Flags().GetString("provider")
+	if providerName == "" {
+		lib.Writeln("The OIDC provider name is required")
+		lib.Exit(nil)
+	}
+	socketPath, _ := cmd.Flags().GetString("socket")
+	if socketPath == "" {
+		lib.Writeln("The socket path is required")
+		lib.Exit(nil)
+	}
+	roleArn, _ := cmd.Flags().GetString("role")
+	maxDurationSeconds, _ := cmd.Flags().GetInt64("max-duration")
+	loginFlow, _ := cmd.Flags().GetString("login-flow")
+	refreshBuffer, _ := cmd.Flags().GetInt64("refresh-buffer")
+	readyFD, _ := cmd.Flags().GetInt("ready-fd")
+	triggerFile, _ := cmd.Flags().GetString("trigger-file")
+	reloginOnTrigger, _ := cmd.Flags().GetBool("relogin-on-trigger")
+
+	client, err := lib.CheckInstalled(providerName)
+	if err != nil {
+		lib.Writeln("Failed to login OIDC provider")
+		lib.Exit(err)
+	}
+
+	err = lib.Serve(client, &lib.ServeOptions{
+		RoleArn:                   roleArn,
+		MaxSessionDurationSeconds: maxDurationSeconds,
+		LoginFlow:                 loginFlow,
+		SocketPath:                socketPath,
+		RefreshBuffer:             time.Duration(refreshBuffer) * time.Second,
+		ReadyFD:                   readyFD,
+		TriggerFile:               triggerFile,
+		ReloginOnTrigger:          reloginOnTrigger,
+	})
+	if err != nil {
+		lib.Writeln("Failed to serve the credentials")
+		lib.Exit(err)
+	}
+}
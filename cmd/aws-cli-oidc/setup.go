@@ -13,9 +13,11 @@ var setupCmd = &cobra.Command{
 }
 
 func init() {
+	setupCmd.Flags().Bool("insecure", false, "Accept the http metadata URL, only for the local testing")
 	rootCmd.AddCommand(setupCmd)
 }
 
 func setup(cmd *cobra.Command, args []string) {
-	lib.RunSetup(nil)
+	insecure, _ := cmd.Flags().GetBool("insecure")
+	lib.RunSetup(nil, &lib.SetupOptions{AllowInsecureMetadata: insecure})
 }
@@ -0,0 +1,33 @@
+package lib
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// CheckAllowedRole refuses the role which doesn't match allowed_role_arns of the provider config, if it's set.
+// The patterns are globs where * matches any characters including / and :, e.g. arn:aws:iam::123456789012:role/*.
+func CheckAllowedRole(client *OIDCClient, roleArn string) error {
+	patterns := client.config.GetStringSlice(ALLOWED_ROLE_ARNS)
+	if len(patterns) == 0 {
+		return nil
+	}
+	for _, pattern := range patterns {
+		if matchARNPattern(pattern, roleArn) {
+			return nil
+		}
+	}
+	return errors.Errorf("The role %s is not allowed for %s, it must match one of %s: %s",
+		roleArn, client.Name(), ALLOWED_ROLE_ARNS, strings.Join(patterns, ", "))
+}
+
+// matchARNPattern matches the ARN by the glob, * is any characters and ? is a character.
+func matchARNPattern(pattern, arn string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	matched, _ := regexp.MatchString("^"+expr+"$", arn)
+	return matched
+}
@@ -1,72 +1,362 @@
 package lib
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
-	pkce "github.com/nirasan/go-oauth-pkce-code-verifier"
 	"github.com/pkg/browser"
 	"github.com/pkg/errors"
 )
 
-func Authenticate(client *OIDCClient, roleArn string, maxSessionDurationSeconds int64, useSecret, asJson bool, webConsole bool) {
+// The environment variables which may be left over from a previous session
+var sessionEnvVars = []string{
+	"AWS_ACCESS_KEY_ID",
+	"AWS_SECRET_ACCESS_KEY",
+	"AWS_SESSION_TOKEN",
+	"AWS_SECURITY_TOKEN",
+	"AWS_CREDENTIAL_EXPIRATION",
+	"AWS_PROFILE",
+}
+
+type AuthenticateOptions struct {
+	RoleArn                   string
+	MaxSessionDurationSeconds int64
+	UseSecret                 bool
+	AsJson                    bool
+	WebConsole                bool
+	ClearEnv                  bool
+	// Pretty indents the JSON output
+	Pretty bool
+	// ProcessVersion is Version of the JSON output, 1 if it's not set
+	ProcessVersion int
+	// Token is an ID token which is already issued by the OIDC provider, it skips the login
+	Token string
+	// LoginFlow overrides login_flow of the provider config: auto, loopback, manual or device
+	LoginFlow string
+	// DurationFromToken requests the session duration equal to the remaining lifetime of the token
+	DurationFromToken bool
+	// AWSProfile selects the role and duration from the profiles config
+	AWSProfile string
+	// Notify notifies the user when the login is completed
+	Notify bool
+	// NoCache neither reads nor writes the secret store, even with UseSecret
+	NoCache bool
+	// TokenFile is the path to write the ID token after login, in TokenFileFormat: jwt or json
+	TokenFile       string
+	TokenFileFormat string
+	// Display is the display parameter of the authorization request: page, popup, touch or wap
+	Display string
+	// UILocales is the ui_locales parameter of the authorization request, ui_locales of the provider config if it's empty
+	UILocales string
+	// TransitiveTagKeys must be marked transitive by the session tags claim of the token
+	TransitiveTagKeys []string
+	// SessionPolicy downscopes the role session, the cached credentials are kept apart by it
+	SessionPolicy *SessionPolicy
+	// ChainRoleArn is assumed by the credentials of the role, with ChainExternalID if the trust policy requires it.
+	// The cache keeps the credentials of the first role, the chained role is assumed on every run.
+	ChainRoleArn    string
+	ChainExternalID string
+	// STSInputHook is the escape hatch for the library users to customize AssumeRoleWithWebIdentity,
+	// see AssumeRoleOptions.InputHook. The secret store isn't used with it, since the cache key can't tell the customized requests apart
+	STSInputHook func(*sts.AssumeRoleWithWebIdentityInput)
+	// GitCredentialURL prints the CodeCommit Git credential of the repository URL in the git credential helper format
+	GitCredentialURL string
+	// EKSClusterName prints the token of the EKS cluster as the ExecCredential of kubectl
+	EKSClusterName string
+	// SwitchProfile writes the AWS profile which gets the credentials by credential_process,
+	// then exports AWS_PROFILE instead of the keys
+	SwitchProfile string
+	// WriteProfile also writes the credentials as the named profile into the AWS credentials file, besides the output
+	WriteProfile string
+	// IncludeScopes adds the scopes granted by the login to the json and full-json output for auditing
+	IncludeScopes bool
+	// OutputFormat is json, export, sso-json or full-json. AsJson takes precedence, default_output_format of the provider config is used if neither is set
+	OutputFormat string
+	// Output receives the JSON formats and the Git credential, os.Stdout if it's nil
+	Output io.Writer
+}
+
+const OUTPUT_FORMAT_JSON = "json"
+const OUTPUT_FORMAT_EXPORT = "export"
+
+// OUTPUT_FORMAT_SSO_JSON is the shape of GetRoleCredentials of AWS SSO
+const OUTPUT_FORMAT_SSO_JSON = "sso-json"
+
+func Authenticate(client *OIDCClient, opts *AuthenticateOptions) {
+	outputFormat, formatErr := resolveOutputFormat(client, opts)
+	if formatErr == nil {
+		formatErr = validateClearEnv(opts, outputFormat)
+	}
+	if formatErr != nil {
+		Writeln("Invalid output format")
+		Exit(formatErr)
+	}
+
+	roleArn := opts.RoleArn
+	maxSessionDurationSeconds := opts.MaxSessionDurationSeconds
+	useSecret := opts.UseSecret && !opts.NoCache
+	if opts.SwitchProfile != "" {
+		// credential_process of the profile reuses the credentials of this login
+		useSecret = !opts.NoCache
+	}
+
+	// Resolve the role and duration mapped to the AWS profile
+	roleArnFromAWSConfig := client.config.GetBool(ROLE_ARN_FROM_AWS_CONFIG)
+	roleArn, maxSessionDurationSeconds, profileErr := resolveAWSProfile(client, opts.AWSProfile, roleArn, maxSessionDurationSeconds)
+	if profileErr != nil {
+		Writeln("Failed to resolve the AWS profile")
+		Exit(profileErr)
+	}
+
 	// Resolve target IAM Role ARN
 	defaultIAMRoleArn := client.config.GetString(DEFAULT_IAM_ROLE_ARN)
 	if roleArn == "" {
 		roleArn = defaultIAMRoleArn
 	}
+	if roleArn == "" && roleArnFromAWSConfig {
+		awsProfile := opts.AWSProfile
+		if awsProfile == "" {
+			awsProfile = os.Getenv("AWS_PROFILE")
+		}
+		var err error
+		roleArn, err = AWSConfigRoleArn(awsProfile)
+		if err != nil {
+			Writeln("Failed to read the role from the AWS config")
+			Exit(err)
+		}
+	}
+
+	// Even the cached credentials of the role aren't given out
+	for _, arn := range []string{roleArn, opts.ChainRoleArn} {
+		if arn == "" {
+			continue
+		}
+		if err := CheckAllowedRole(client, arn); err != nil {
+			Writeln("The role is not allowed")
+			Exit(err)
+		}
+	}
 
 	var awsCreds *AWSCredentials
+	var store CredentialStore
 	var err error
 
+	assumeRoleOpts := &AssumeRoleOptions{Policy: opts.SessionPolicy, InputHook: opts.STSInputHook}
+
+	// The cache is keyed by the requested duration, not the one resolved after login
+	requestedDuration := maxSessionDurationSeconds
+	if requestedDuration <= 0 {
+		requestedDuration = configuredDuration(client)
+	}
+
+	role := ResolveRoleConfig(client.config, roleArn)
+	if useSecret && role.RequireFreshLogin {
+		Writeln("The role requires a fresh login, the secret store isn't used")
+		useSecret = false
+	}
+	if opts.STSInputHook != nil {
+		Traceln("STSInputHook customizes the request, the secret store isn't used")
+		useSecret = false
+	}
+
 	// Try to reuse stored credential in secret
 	if useSecret {
-		awsCreds, err = AWSCredential(roleArn)
+		store, err = NewCredentialStore(client.Name(), client.config)
+		if err != nil {
+			Writeln("Failed to initialize the secret store")
+			Exit(err)
+		}
+		awsCreds, err = AWSCredential(store, roleArn, requestedDuration, opts.SessionPolicy)
+		if err == nil && awsCreds.Scope != "" && !sameScopes(awsCreds.Scope, client.Scope()) {
+			Writeln("The cached credentials were issued for the scope \"%s\", login again for \"%s\"", awsCreds.Scope, client.Scope())
+			awsCreds = nil
+		}
 	}
 
-	if !isValid(awsCreds) || err != nil {
-		tokenResponse, err := doLogin(client)
+	valid := isValid(client, awsCreds) && err == nil
+	if !valid && useSecret {
+		loginLock, waited, err := acquireLoginLock(client.Name())
 		if err != nil {
-			Writeln("Failed to login the OIDC provider")
+			Writeln("Failed to lock the login")
 			Exit(err)
 		}
+		defer locker.Release(loginLock)
 
-		Writeln("Login successful!")
-		Traceln("ID token: %s", tokenResponse.IDToken)
+		// The process which held the lock may have cached the credentials of the role
+		if waited {
+			cached, err := AWSCredential(store, roleArn, requestedDuration, opts.SessionPolicy)
+			if err == nil && (cached.Scope == "" || sameScopes(cached.Scope, client.Scope())) && isValid(client, cached) {
+				Writeln("Using the credentials of the login by another process")
+				awsCreds = cached
+				valid = true
+			}
+		}
+	}
 
-		// Resolve max duration
-		if maxSessionDurationSeconds <= 0 {
-			maxSessionDurationSecondsString := client.config.GetString(MAX_SESSION_DURATION_SECONDS)
-			maxSessionDurationSeconds, err = strconv.ParseInt(maxSessionDurationSecondsString, 10, 64)
-			if err != nil {
-				maxSessionDurationSeconds = 3600
+	if !valid {
+		audiences := role.AudienceCandidates()
+		if opts.Token != "" {
+			if err := validateGivenToken(client, opts.Token, audiences); err != nil {
+				Writeln("The given token can't be used")
+				Exit(err)
 			}
+			// The given token has its own audience, so no retry with the next one
+			audiences = audiences[:1]
 		}
 
-		awsCreds, err = GetCredentialsWithOIDC(client, tokenResponse.IDToken, roleArn, maxSessionDurationSeconds)
-		if err != nil {
+		var tokenResponse *TokenResponse
+		for i, audience := range audiences {
+			role.Audience = audience
+			if len(audiences) > 1 {
+				Writeln("Trying the audience: %s", audience)
+			}
+
+			var idToken string
+			reused := false
+			if opts.Token != "" {
+				idToken = opts.Token
+			} else if useSecret && roleArn != "" {
+				// Switching the role doesn't need the login again while the ID token is valid
+				if idToken = reusableIDToken(client, store, role); idToken != "" {
+					Writeln("Reusing the ID token of the previous login")
+					reused = true
+				}
+			}
+			if idToken == "" {
+				tokenResponse, err = doLogin(client, role, opts)
+				if err != nil {
+					Writeln("Failed to login the OIDC provider")
+					Exit(err)
+				}
+
+				Writeln("Login successful!")
+				idToken = tokenResponse.IDToken
+			}
+			Traceln("ID token: %s", idToken)
+
+			if roleArn == "" {
+				roleArn, err = discoverRole(client, idToken, tokenResponse)
+				if err != nil {
+					Writeln("Failed to discover the role to assume")
+					Exit(err)
+				}
+				if ResolveRoleConfig(client.config, roleArn).RequireFreshLogin {
+					useSecret = false
+				}
+			}
+
+			// Resolve max duration
+			duration := maxSessionDurationSeconds
+			if duration <= 0 {
+				duration = configuredDuration(client)
+				if opts.DurationFromToken || client.config.GetBool(DURATION_FROM_TOKEN) {
+					duration = durationFromToken(idToken, duration)
+				}
+			}
+			duration = clampToRoleMaxDuration(client, roleArn, duration)
+			warnDurationBeyondToken(idToken, duration)
+
+			if len(opts.TransitiveTagKeys) > 0 {
+				if err := validateTransitiveTags(idToken, opts.TransitiveTagKeys); err != nil {
+					Writeln("The session tags of the token don't meet --transitive-tag-key")
+					Exit(err)
+				}
+			}
+
+			awsCreds, err = GetCredentialsWithOIDCOptions(client, idToken, roleArn, duration, assumeRoleOpts)
+			if err != nil && reused {
+				Writeln("STS rejected the reused ID token, login again")
+				Traceln("%v", err)
+				tokenResponse, err = doLogin(client, role, opts)
+				if err != nil {
+					Writeln("Failed to login the OIDC provider")
+					Exit(err)
+				}
+				Writeln("Login successful!")
+				idToken = tokenResponse.IDToken
+				awsCreds, err = GetCredentialsWithOIDCOptions(client, idToken, roleArn, duration, assumeRoleOpts)
+			}
+			if err != nil && tokenResponse != nil && isTokenExpired(err) {
+				// The short-lived token can expire before STS checks it on slow machines
+				Traceln("The ID token has expired before assuming the role, getting a new one: %v", err)
+				tokenResponse, err = renewLoginToken(client, role, opts, tokenResponse)
+				if err != nil {
+					Writeln("Failed to login the OIDC provider")
+					Exit(err)
+				}
+				idToken = tokenResponse.IDToken
+				awsCreds, err = GetCredentialsWithOIDCOptions(client, idToken, roleArn, duration, assumeRoleOpts)
+			}
+			if err == nil {
+				maxSessionDurationSeconds = duration
+				if opts.TokenFile != "" {
+					if err := WriteTokenFile(opts.TokenFile, opts.TokenFileFormat, idToken); err != nil {
+						Writeln("Failed to write the token file")
+						Exit(err)
+					}
+				}
+				break
+			}
+			if i < len(audiences)-1 && isAudienceMismatch(err) {
+				Writeln("STS rejected the audience %s, trying the next one", audience)
+				continue
+			}
+			if client.config.GetBool(CHECK_THUMBPRINT) {
+				// The stale thumbprint of the IAM OIDC provider is a cause of InvalidIdentityToken
+				checkThumbprint(client)
+			}
 			Writeln("Failed to get aws credentials with OIDC")
 			Exit(err)
 		}
 
+		if tokenResponse != nil && client.config.GetBool(CHECK_THUMBPRINT) {
+			checkThumbprint(client)
+		}
+		awsCreds.GrantedScope = grantedScope(client, tokenResponse)
+
 		if useSecret {
 			// Store into secret
-			SaveAWSCredential(roleArn, awsCreds)
-			Write("The AWS credentials has been saved in OS secret store")
+			awsCreds.Scope = client.Scope()
+			SaveAWSCredential(store, roleArn, requestedDuration, opts.SessionPolicy, awsCreds)
+			saveLoginSession(client, store, CachedRole{
+				RoleArn:         roleArn,
+				DurationSeconds: requestedDuration,
+				Policy:          opts.SessionPolicy,
+			}, tokenResponse)
 		}
 	}
-	if webConsole {
+	if opts.ChainRoleArn != "" && opts.SwitchProfile == "" {
+		awsCreds, err = AssumeChainedRole(client, awsCreds, opts.ChainRoleArn, opts.ChainExternalID)
+		if err != nil {
+			Writeln("Failed to assume the chained role")
+			Exit(err)
+		}
+	}
+	if opts.WriteProfile != "" {
+		// Only stderr is written here, stdout is left to the output below
+		if err := WriteProfiles(map[string]*AWSCredentials{opts.WriteProfile: awsCreds}); err != nil {
+			Writeln("Failed to write the AWS profile")
+			Exit(err)
+		}
+		Writeln("The credentials have been written as the profile %s", opts.WriteProfile)
+	}
+	output := opts.Output
+	if output == nil {
+		output = os.Stdout
+	}
+	if opts.WebConsole {
 		sessionCredentials := getSessionCreds(awsCreds)
 
 		jsonBytes, _ := json.Marshal(sessionCredentials)
@@ -93,33 +383,121 @@ func Authenticate(client *OIDCClient, roleArn string, maxSessionDurationSeconds
 			url.QueryEscape("https://eu-west-1.console.aws.amazon.com/"), signingToken.SigningToken)
 
 		browser.OpenURL(signinUrl)
-	} else if asJson {
-		awsCreds.Version = 1
+	} else if outputFormat == OUTPUT_FORMAT_JSON {
+		out := *awsCreds
+		out.Version = opts.ProcessVersion
+		if out.Version <= 0 {
+			out.Version = 1
+		}
+		out.Scope = ""
+		out.GrantedScope = ""
 
-		jsonBytes, err := json.Marshal(awsCreds)
+		var v interface{} = &out
+		if opts.IncludeScopes {
+			v = &scopedCredentials{AWSCredentials: &out, Scopes: awsCreds.Scopes()}
+		}
+		jsonBytes, err := marshalOutput(v, opts.Pretty)
+		if err != nil {
+			Writeln("Unexpected AWS credential response")
+			Exit(err)
+		}
+		fmt.Fprintln(output, string(jsonBytes))
+	} else if outputFormat == OUTPUT_FORMAT_FULL_JSON {
+		outputRoleArn := roleArn
+		if opts.ChainRoleArn != "" {
+			outputRoleArn = opts.ChainRoleArn
+		}
+		full, err := NewFullCredentials(client, awsCreds, outputRoleArn)
+		if err != nil {
+			Writeln("Failed to resolve the identity of the credentials")
+			Exit(err)
+		}
+		if opts.IncludeScopes {
+			full.Scopes = awsCreds.Scopes()
+		}
+		jsonBytes, err := marshalOutput(full, opts.Pretty)
+		if err != nil {
+			Writeln("Unexpected AWS credential response")
+			Exit(err)
+		}
+		fmt.Fprintln(output, string(jsonBytes))
+	} else if outputFormat == OUTPUT_FORMAT_SSO_JSON {
+		jsonBytes, err := marshalOutput(NewSSORoleCredentials(awsCreds), opts.Pretty)
 		if err != nil {
 			Writeln("Unexpected AWS credential response")
 			Exit(err)
 		}
-		fmt.Println(string(jsonBytes))
+		fmt.Fprintln(output, string(jsonBytes))
+	} else if opts.GitCredentialURL != "" {
+		username, password, err := CodeCommitGitCredential(awsCreds, opts.GitCredentialURL, time.Now())
+		if err != nil {
+			Writeln("Failed to derive the CodeCommit Git credential")
+			Exit(err)
+		}
+		fmt.Fprintf(output, "username=%s\npassword=%s\n", username, password)
+	} else if opts.EKSClusterName != "" {
+		execCredential, err := EKSToken(client, awsCreds, opts.EKSClusterName)
+		if err != nil {
+			Writeln("Failed to get the EKS token")
+			Exit(err)
+		}
+		jsonBytes, err := marshalOutput(execCredential, opts.Pretty)
+		if err != nil {
+			Writeln("Unexpected EKS token")
+			Exit(err)
+		}
+		fmt.Fprintln(output, string(jsonBytes))
+	} else if opts.SwitchProfile != "" {
+		command, err := credentialProcessCommand(client, roleArn, opts)
+		if err != nil {
+			Writeln("Failed to resolve the command for credential_process")
+			Exit(err)
+		}
+		if err := WriteCredentialProcessProfile(opts.SwitchProfile, command); err != nil {
+			Writeln("Failed to write the AWS profile")
+			Exit(err)
+		}
+		Writeln("The AWS profile %s has been written", opts.SwitchProfile)
+		Writeln("")
+
+		// The keys take precedence over the profile
+		for _, key := range sessionEnvVars {
+			if key != "AWS_PROFILE" {
+				Unset(key)
+			}
+		}
+		Export("AWS_PROFILE", opts.SwitchProfile)
 	} else {
 		Writeln("")
 
+		if opts.ClearEnv {
+			// Drop the previous session so that its variables can't shadow the new ones
+			for _, key := range sessionEnvVars {
+				Unset(key)
+			}
+		}
 		Export("AWS_ACCESS_KEY_ID", awsCreds.AWSAccessKey)
 		Export("AWS_SECRET_ACCESS_KEY", awsCreds.AWSSecretKey)
 		Export("AWS_SESSION_TOKEN", awsCreds.AWSSessionToken)
 	}
 }
 
-func isValid(cred *AWSCredentials) bool {
+// The cached credentials which expire within the buffer are treated as invalid
+const expirationBuffer = 5 * time.Minute
+
+func isValid(client *OIDCClient, cred *AWSCredentials) bool {
 	if cred == nil {
 		return false
 	}
 
-	sess, err := session.NewSession()
-	if err != nil {
-		Writeln("Failed to create aws client session")
-		Exit(err)
+	if !cred.Expires.IsZero() && time.Until(cred.Expires) < expirationBuffer {
+		Writeln("The previous credential has expired")
+		return false
+	}
+
+	// GetCallerIdentity costs an STS call on every run, it can be disabled when the expiration check suffices
+	if client.config.IsSet(VALIDATE_CACHED_CREDENTIALS) && !client.config.GetBool(VALIDATE_CACHED_CREDENTIALS) {
+		return !cred.Expires.IsZero()
 	}
 
 	creds := credentials.NewStaticCredentialsFromCreds(credentials.Value{
@@ -128,11 +506,15 @@ func isValid(cred *AWSCredentials) bool {
 		SessionToken:    cred.AWSSessionToken,
 	})
 
-	svc := sts.New(sess, aws.NewConfig().WithCredentials(creds))
+	svc, err := newSTSClient(client, aws.NewConfig().WithCredentials(creds))
+	if err != nil {
+		Writeln("Failed to create aws client session")
+		Exit(err)
+	}
 
 	input := &sts.GetCallerIdentityInput{}
 
-	_, err = svc.GetCallerIdentity(input)
+	_, err = svc.GetCallerIdentityWithContext(runContext(), input)
 
 	if err != nil {
 		Writeln("The previous credential isn't valid")
@@ -141,20 +523,77 @@ func isValid(cred *AWSCredentials) bool {
 	return err == nil
 }
 
-func doLogin(client *OIDCClient) (*TokenResponse, error) {
-	listener, err := net.Listen("tcp", "127.0.0.1:8118")
+// displayValues are defined by OpenID Connect Core 1.0
+var displayValues = []string{"page", "popup", "touch", "wap"}
+
+// doLogin gets the token by the login, retried on the transient failures. The refresh token is discarded if use_refresh_token is false.
+func doLogin(client *OIDCClient, role *RoleConfig, opts *AuthenticateOptions) (*TokenResponse, error) {
+	if err := preloginClockCheck(client); err != nil {
+		return nil, err
+	}
+	tokenResponse, err := loginWithRetry(client, role, opts)
+	if err == nil && !client.UseRefreshToken() {
+		tokenResponse.RefreshToken = ""
+	}
+	return tokenResponse, err
+}
+
+func login(client *OIDCClient, role *RoleConfig, opts *AuthenticateOptions) (*TokenResponse, error) {
+	if client.config.GetString(GRANT_TYPE) == GRANT_TYPE_CLIENT_CREDENTIALS {
+		return clientCredentialsToken(client, role)
+	}
+	if opts.Display != "" && !containsString(displayValues, opts.Display) {
+		return nil, errors.Errorf("Unknown display: %s, it must be one of %v", opts.Display, displayValues)
+	}
+	uiLocales := opts.UILocales
+	if uiLocales == "" {
+		uiLocales = client.config.GetString(UI_LOCALES)
+	}
+	if err := validateUILocales(uiLocales); err != nil {
+		return nil, err
+	}
+	flow := opts.LoginFlow
+	if flow == "" {
+		flow = client.config.GetString(LOGIN_FLOW)
+	}
+	receiver, err := NewCodeReceiver(client, flow, role)
 	if err != nil {
-		return nil, errors.Wrap(err, "Cannot start local http server to handle login redirect")
+		return nil, err
+	}
+	defer receiver.Close()
+
+	if r, ok := receiver.(tokenReceiver); ok {
+		tokenResponse, err := r.ReceiveToken()
+		if err != nil {
+			return nil, err
+		}
+		if opts.Notify {
+			NotifyLoginCompleted("Login completed")
+		}
+		if err := validateSigningAlg(client, tokenResponse.IDToken); err != nil {
+			return nil, err
+		}
+		if err := validateTokenAudience(client, tokenResponse, role); err != nil {
+			return nil, err
+		}
+		if err := validateAuthorizedParty(client, tokenResponse.IDToken); err != nil {
+			return nil, err
+		}
+		return tokenResponse, nil
 	}
 
 	clientId := client.config.GetString(CLIENT_ID)
-	redirect := "http://localhost:8118"
-	v, err := pkce.CreateCodeVerifierWithLength(pkce.MaxLength)
+	redirect := receiver.RedirectURI()
+	v, err := newCodeVerifier()
 	if err != nil {
 		return nil, errors.Wrap(err, "Cannot generate OAuth2 PKCE code_challenge")
 	}
 	challenge := v.CodeChallengeS256()
 	verifier := v.String()
+	state, err := newState()
+	if err != nil {
+		return nil, err
+	}
 
 	authReq := client.Authorization().
 		QueryParam("response_type", "code").
@@ -162,105 +601,622 @@ func doLogin(client *OIDCClient) (*TokenResponse, error) {
 		QueryParam("redirect_uri", redirect).
 		QueryParam("code_challenge", challenge).
 		QueryParam("code_challenge_method", "S256").
-		QueryParam("scope", "openid")
+		QueryParam("state", state).
+		QueryParam("scope", client.Scope())
+	if role.Audience != "" {
+		authReq = authReq.QueryParam("audience", role.Audience)
+	}
+	if role.Resource != "" {
+		authReq = authReq.QueryParam("resource", role.Resource)
+	}
+	if opts.Display != "" {
+		authReq = authReq.QueryParam("display", opts.Display)
+	}
+	if uiLocales != "" {
+		authReq = authReq.QueryParam("ui_locales", uiLocales)
+	}
 
+	prompt := client.config.GetString(PROMPT)
 	url := authReq.Url()
+	if prompt != "" {
+		url = authReq.QueryParam("prompt", prompt).Url()
+	}
 
-	code := launch(client, url.String(), listener)
-	if code != "" {
-		return codeToToken(client, verifier, code, redirect)
-	} else {
+	authRes, err := receiver.Receive(url.String())
+	var authErr *AuthorizationError
+	if prompt == "none" {
+		// The loopback and the manual flows have the user on the browser, so the stale session of the OIDC provider
+		// escalates to the login page by the same receiver and PKCE instead of failing
+		if errors.As(err, &authErr) && isInteractionRequired(authErr.Code) {
+			Writeln("The silent login failed with %s, continuing to the interactive login", authErr.Code)
+			url = authReq.Url()
+			authRes, err = receiver.Receive(url.String())
+			if err == nil {
+				Writeln("Logged in by the interactive login")
+			}
+		} else if err == nil {
+			Writeln("Logged in by prompt=none")
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if authRes.Code == "" {
 		return nil, errors.New("Login failed, can't retrieve authorization code")
 	}
-}
-
-func launch(client *OIDCClient, url string, listener net.Listener) string {
-	c := make(chan string)
+	if authRes.State != state {
+		return nil, errors.New("Login failed, the state of the authorization response doesn't match the request")
+	}
+	if err := validateResponseIssuer(client, authRes); err != nil {
+		return nil, err
+	}
+	code := authRes.Code
+	if opts.Notify {
+		NotifyLoginCompleted("Login completed")
+	}
 
-	http.HandleFunc("/", func(res http.ResponseWriter, req *http.Request) {
-		url := req.URL
-		q := url.Query()
-		code := q.Get("code")
+	tokenResponse, err := codeToToken(client, verifier, code, redirect, role.Resource)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSigningAlg(client, tokenResponse.IDToken); err != nil {
+		return nil, err
+	}
+	if err := validateTokenAudience(client, tokenResponse, role); err != nil {
+		return nil, err
+	}
+	return tokenResponse, nil
+}
 
-		res.Header().Set("Content-Type", "text/html")
+var languageTagPattern = regexp.MustCompile(`^[A-Za-z]{1,8}(-[A-Za-z0-9]{1,8})*$`)
 
-		// Response result page
-		message := "Login "
-		if code != "" {
-			message += "successful"
-		} else {
-			message += "failed"
+// validateUILocales checks ui_locales is a space-separated list of BCP 47 language tags, e.g. "ja en-US".
+func validateUILocales(uiLocales string) error {
+	for _, tag := range strings.Fields(uiLocales) {
+		if !languageTagPattern.MatchString(tag) {
+			return errors.Errorf("Invalid ui_locales: %s is not a BCP 47 language tag", tag)
 		}
-		res.Header().Set("Cache-Control", "no-store")
-		res.Header().Set("Pragma", "no-cache")
-		res.WriteHeader(200)
-		res.Write([]byte(fmt.Sprintf(`<!DOCTYPE html>
-<script>
-window.close()
-</script>
-<body>
-%s
-</body>
-</html>
-`, message)))
+	}
+	return nil
+}
 
-		if f, ok := res.(http.Flusher); ok {
-			f.Flush()
+// validateTransitiveTags checks the keys are the session tags of the token and marked transitive.
+// AssumeRoleWithWebIdentity takes them only from the https://aws.amazon.com/tags claim, not from the request.
+func validateTransitiveTags(idToken string, keys []string) error {
+	claims, err := ParseJWTClaims(idToken)
+	if err != nil {
+		return err
+	}
+	tags, transitive := claims.AWSSessionTags()
+	for _, key := range keys {
+		if _, ok := tags[key]; !ok {
+			return errors.Errorf("%s is not a session tag of the token, the OIDC provider needs to issue it in principal_tags of the https://aws.amazon.com/tags claim", key)
+		}
+		found := false
+		for _, t := range transitive {
+			if strings.EqualFold(t, key) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.Errorf("The session tag %s is not transitive, the OIDC provider needs to list it in transitive_tag_keys of the https://aws.amazon.com/tags claim", key)
 		}
+	}
+	return nil
+}
 
-		time.Sleep(100 * time.Millisecond)
+// validateResponseIssuer defends against the mix-up attack by the iss parameter of the authorization response (RFC 9207).
+// The response without it is accepted unless the OIDC provider advertises it or the config requires it.
+func validateResponseIssuer(client *OIDCClient, authRes *AuthorizationResponse) error {
+	if authRes.Issuer == "" {
+		if client.metadata.AuthorizationResponseIssParameterSupported || client.config.GetBool(REQUIRE_AUTHORIZATION_RESPONSE_ISS) {
+			return errors.New("The authorization response has no iss parameter")
+		}
+		return nil
+	}
+	if authRes.Issuer != client.metadata.Issuer {
+		return errors.Errorf("The authorization response is issued by %s, not %s", authRes.Issuer, client.metadata.Issuer)
+	}
+	return nil
+}
 
-		c <- code
-	})
+var defaultTokenSigningAlgs = []string{"RS256", "ES256", "PS256"}
 
-	srv := &http.Server{}
-	ctx, _ := context.WithTimeout(context.Background(), 5*time.Second)
-	defer srv.Shutdown(ctx)
+// validateSigningAlg rejects the ID token signed with an algorithm which isn't in token_signing_algs.
+// An unsigned token is never accepted.
+func validateSigningAlg(client *OIDCClient, token string) error {
+	alg, err := JWTAlgorithm(token)
+	if err != nil {
+		return errors.Wrap(err, "Failed to validate the signing algorithm of the ID token")
+	}
+	if alg == "" || strings.EqualFold(alg, "none") {
+		return errors.New("The ID token is not signed")
+	}
 
-	go func() {
-		if err := srv.Serve(listener); err != nil {
-			// cannot panic, because this probably is an intentional close
+	algs := client.config.GetStringSlice(TOKEN_SIGNING_ALGS)
+	if len(algs) == 0 {
+		algs = defaultTokenSigningAlgs
+	}
+	for _, a := range algs {
+		if a == alg {
+			return nil
 		}
-	}()
-
-	var code string
-	if err := browser.OpenURL(url); err == nil {
-		code = <-c
 	}
+	return errors.Errorf("The ID token is signed with %s which is not in %s %v", alg, TOKEN_SIGNING_ALGS, algs)
+}
 
-	return code
+// validateTokenAudience checks the issued tokens are scoped to the requested audience and resource. By OpenID
+// Connect Core, the aud of the ID token is the client_id and the audience parameter scopes the access token, so the
+// ID token without the audience is accepted for the client_id while the access token, if it's a JWT, has it.
+func validateTokenAudience(client *OIDCClient, tokenResponse *TokenResponse, role *RoleConfig) error {
+	if role.Audience != "" {
+		claims, err := ParseJWTClaims(tokenResponse.IDToken)
+		if err != nil {
+			return errors.Wrap(err, "Failed to validate the audience of the ID token")
+		}
+		if !claims.HasAudience(role.Audience) {
+			clientID := client.config.GetString(CLIENT_ID)
+			if !claims.HasAudience(clientID) {
+				return errors.Errorf("The ID token audience %v has neither the requested audience %s nor the client ID %s", claims.Audiences(), role.Audience, clientID)
+			}
+			accessClaims, err := ParseJWTClaims(tokenResponse.AccessToken)
+			if err != nil {
+				Traceln("Skipped the audience validation of the access token: %v", err)
+			} else if !accessClaims.HasAudience(role.Audience) {
+				return errors.Errorf("The access token audience %v doesn't match the requested audience %s", accessClaims.Audiences(), role.Audience)
+			}
+		}
+	}
+	if role.Resource != "" {
+		// An opaque access token can't be validated locally
+		claims, err := ParseJWTClaims(tokenResponse.AccessToken)
+		if err != nil {
+			Traceln("Skipped the resource validation of the access token: %v", err)
+			return nil
+		}
+		if !claims.HasAudience(role.Resource) {
+			return errors.Errorf("The access token audience %v doesn't match the requested resource %s", claims.Audiences(), role.Resource)
+		}
+	}
+	return nil
 }
 
-func codeToToken(client *OIDCClient, verifier string, code string, redirect string) (*TokenResponse, error) {
+func codeToToken(client *OIDCClient, verifier string, code string, redirect string, resource string) (*TokenResponse, error) {
 	form := client.ClientForm()
 	form.Set("grant_type", "authorization_code")
 	form.Set("code", code)
 	form.Set("code_verifier", verifier)
 	form.Set("redirect_uri", redirect)
+	if resource != "" {
+		form.Set("resource", resource)
+	}
 
-	Traceln("code2token params:", form)
-
-	res, err := client.Token().Request().Form(form).Post()
+	Traceln("code2token params: %s", redactValues(form).Encode())
 
+	tokenResponse, err := requestToken(client, form)
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to turn code into token")
 	}
+	if err := validateAuthorizedParty(client, tokenResponse.IDToken); err != nil {
+		return nil, err
+	}
+	return tokenResponse, nil
+}
 
-	if res.Status() != 200 {
-		if res.MediaType() != "" {
-			var json map[string]interface{}
-			err := res.ReadJson(&json)
-			if err == nil {
-				return nil, errors.Errorf("Failed to turn code into token, error: %s error_description: %s",
-					json["error"], json["error_description"])
+// validateAuthContext checks the amr and acr claims of the token meet required_amr and allowed_acr of the role,
+// e.g. only the login with MFA can assume the production role.
+func validateAuthContext(role *RoleConfig, idToken string) error {
+	if len(role.RequiredAMR) == 0 && len(role.AllowedACR) == 0 {
+		return nil
+	}
+	claims, err := ParseJWTClaims(idToken)
+	if err != nil {
+		return errors.Wrap(err, "Failed to validate the authentication context of the token")
+	}
+	amr := claims.AMR()
+	for _, method := range role.RequiredAMR {
+		if !containsString(amr, method) {
+			return errors.Errorf("The role %s requires the authentication method %s, but the login was by %v", role.RoleArn, method, amr)
+		}
+	}
+	if len(role.AllowedACR) > 0 {
+		acr, _ := claims["acr"].(string)
+		if !containsString(role.AllowedACR, acr) {
+			return errors.Errorf("The role %s requires the authentication context %v, but the login was by %q", role.RoleArn, role.AllowedACR, acr)
+		}
+	}
+	return nil
+}
+
+// validateAuthorizedParty checks the azp claim of the ID token is authorized_party of the config, to reject the token
+// which is valid for the audience but issued to another client. It's skipped when the claim is absent.
+func validateAuthorizedParty(client *OIDCClient, idToken string) error {
+	expected := client.config.GetString(AUTHORIZED_PARTY)
+	if expected == "" {
+		return nil
+	}
+	claims, err := ParseJWTClaims(idToken)
+	if err != nil {
+		return errors.Wrap(err, "Failed to validate the authorized party of the ID token")
+	}
+	azp, ok := claims["azp"].(string)
+	if !ok {
+		Traceln("Skipped the authorized party validation, the ID token has no azp claim")
+		return nil
+	}
+	if azp != expected {
+		return errors.Errorf("The ID token was issued to the authorized party %s, not %s", azp, expected)
+	}
+	return nil
+}
+
+// validateExpectedAudiences checks the aud claim of the token has one of expected_audiences, the client ID list of
+// the IAM OIDC identity provider, so that the mismatch is explained before STS rejects it by an opaque error.
+func validateExpectedAudiences(client *OIDCClient, idToken string) error {
+	expected := client.config.GetStringSlice(EXPECTED_AUDIENCES)
+	if len(expected) == 0 {
+		return nil
+	}
+	claims, err := ParseJWTClaims(idToken)
+	if err != nil {
+		return errors.Wrap(err, "Failed to validate the audience of the ID token")
+	}
+	for _, aud := range expected {
+		if claims.HasAudience(aud) {
+			return nil
+		}
+	}
+	return errors.Wrapf(errUnexpectedAudience, "The token aud %s is not in the expected audiences [%s]",
+		strings.Join(claims.Audiences(), ", "), strings.Join(expected, ", "))
+}
+
+var errUnexpectedAudience = errors.New("add it to the client ID list of the IAM OIDC identity provider and to " + EXPECTED_AUDIENCES)
+
+// requestToken posts the form to the token endpoint, retrying on the server errors.
+func requestToken(client *OIDCClient, form url.Values) (*TokenResponse, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := client.Token().Request().Form(form).Post()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if res.Status() == 200 {
+			var tokenResponse TokenResponse
+			res.ReadJson(&tokenResponse)
+			return &tokenResponse, nil
+		}
+
+		body, _ := res.ReadBytes()
+		if res.Status() >= 500 && attempt < tokenExchangeMaxAttempts {
+			wait := time.Duration(1<<(attempt-1)) * time.Second
+			Writeln("The token endpoint returned statusCode: %d, retrying in %s", res.Status(), wait)
+			time.Sleep(wait)
+			continue
+		}
+		if res.Status() >= 500 {
+			return nil, &serverError{tokenExchangeError(client.Name(), res.Status(), body)}
+		}
+		return nil, tokenExchangeError(client.Name(), res.Status(), body)
+	}
+}
+
+const tokenExchangeMaxAttempts = 3
+
+// tokenExchangeError explains the likely cause of the failed token request by the error code or the status code.
+func tokenExchangeError(provider string, status int, body []byte) error {
+	var detail string
+	var errorBody map[string]interface{}
+	if err := json.Unmarshal(body, &errorBody); err == nil && errorBody["error"] != nil {
+		if errorBody["error"] == "invalid_client" {
+			return invalidClientError(provider, errorBody["error_description"])
+		}
+		detail = fmt.Sprintf("error: %s error_description: %s", errorBody["error"], errorBody["error_description"])
+	} else {
+		snippet := string(body)
+		if len(snippet) > 200 {
+			snippet = snippet[:200] + "..."
+		}
+		detail = fmt.Sprintf("body: %s", snippet)
+	}
+
+	var cause string
+	switch {
+	case status == 400:
+		cause = "bad request, the PKCE code_verifier or redirect_uri likely doesn't match the authorization request"
+	case status == 401:
+		cause = "client authentication failed, check client_id and client_secret"
+	case status >= 500:
+		cause = "server error of the OIDC provider, retry later"
+	default:
+		cause = "unexpected response"
+	}
+
+	return errors.Errorf("Failed to turn code into token, statusCode: %d (%s), %s", status, cause, detail)
+}
+
+// invalidClientError suggests the client secret, which some OIDC providers rotate with expiry, needs to be updated.
+func invalidClientError(provider string, description interface{}) error {
+	msg := fmt.Sprintf("The OIDC provider rejected the client (invalid_client). The client_secret of %s may be wrong or expired, update it in %s/config.yaml or by aws-cli-oidc setup", provider, ConfigPath())
+	if description != nil && description != "" {
+		msg += fmt.Sprintf(", error_description: %s", description)
+	}
+	return errors.New(msg)
+}
+
+// resolveOutputFormat returns the output format of the options, or default_output_format of the provider config.
+func resolveOutputFormat(client *OIDCClient, opts *AuthenticateOptions) (string, error) {
+	if opts.GitCredentialURL != "" || opts.EKSClusterName != "" || opts.SwitchProfile != "" || opts.WebConsole {
+		// They print their own format, default_output_format must not take it over
+		return OUTPUT_FORMAT_EXPORT, nil
+	}
+	if opts.AsJson {
+		return OUTPUT_FORMAT_JSON, nil
+	}
+	format := opts.OutputFormat
+	if format == "" {
+		format = client.config.GetString(DEFAULT_OUTPUT_FORMAT)
+	}
+	switch format {
+	case "":
+		return OUTPUT_FORMAT_EXPORT, nil
+	case OUTPUT_FORMAT_JSON, OUTPUT_FORMAT_EXPORT, OUTPUT_FORMAT_SSO_JSON, OUTPUT_FORMAT_FULL_JSON:
+		return format, nil
+	}
+	return "", errors.Errorf("Unknown output format: %s, it must be %s, %s, %s or %s", format, OUTPUT_FORMAT_JSON, OUTPUT_FORMAT_EXPORT, OUTPUT_FORMAT_SSO_JSON, OUTPUT_FORMAT_FULL_JSON)
+}
+
+// validateClearEnv rejects ClearEnv unless the export lines are printed, the other outputs can't unset the variables.
+// SwitchProfile unsets the keys by itself.
+func validateClearEnv(opts *AuthenticateOptions, outputFormat string) error {
+	if !opts.ClearEnv || opts.SwitchProfile != "" {
+		return nil
+	}
+	if outputFormat != OUTPUT_FORMAT_EXPORT || opts.GitCredentialURL != "" || opts.EKSClusterName != "" || opts.WebConsole {
+		return errors.New("--clear can be used with the export output only")
+	}
+	return nil
+}
+
+// resolveAWSProfile fills the role and the duration which aren't given by the ones mapped to the AWS profile.
+// The profile which isn't mapped is left to role_arn_from_aws_config if it's enabled.
+func resolveAWSProfile(client *OIDCClient, awsProfile string, roleArn string, durationSeconds int64) (string, int64, error) {
+	if awsProfile == "" {
+		return roleArn, durationSeconds, nil
+	}
+	profile, err := ResolveProfileConfig(client.config, awsProfile)
+	if err != nil {
+		if client.config.GetBool(ROLE_ARN_FROM_AWS_CONFIG) && errors.Cause(err) == ErrProfileNotMapped {
+			return roleArn, durationSeconds, nil
+		}
+		return "", 0, err
+	}
+	if roleArn == "" {
+		roleArn = profile.RoleArn
+	}
+	if durationSeconds <= 0 {
+		durationSeconds = profile.Duration
+	}
+	return roleArn, durationSeconds, nil
+}
+
+// configuredDuration returns max_session_duration_seconds of the provider config.
+func configuredDuration(client *OIDCClient) int64 {
+	duration, err := strconv.ParseInt(client.config.GetString(MAX_SESSION_DURATION_SECONDS), 10, 64)
+	if err != nil {
+		return 3600
+	}
+	return duration
+}
+
+// durationFromToken returns the remaining lifetime of the token, capped by the max duration.
+func durationFromToken(idToken string, maxDurationSeconds int64) int64 {
+	claims, err := ParseJWTClaims(idToken)
+	if err != nil {
+		Writeln("Can't resolve the session duration from the token: %v", err)
+		return maxDurationSeconds
+	}
+	exp, ok := claims.Expiry()
+	if !ok {
+		Writeln("Can't resolve the session duration from the token without exp claim")
+		return maxDurationSeconds
+	}
+
+	duration := int64(time.Until(exp).Seconds())
+	if duration > maxDurationSeconds {
+		duration = maxDurationSeconds
+	}
+	if duration > 43200 {
+		duration = 43200
+	}
+	if duration < 900 {
+		duration = 900
+	}
+	Writeln("Requesting the session duration %d seconds from the token lifetime", duration)
+	return duration
+}
+
+// durationBeyondTokenGap is how much longer than the token the session must be for the hint, the usual
+// token TTL of minutes isn't worth mentioning.
+const durationBeyondTokenGap = 5 * time.Minute
+
+// warnDurationBeyondToken hints that the session outlives the token by more than durationBeyondTokenGap.
+// STS doesn't end the session at the expiry of the token, so it's only for those who expect the session to end with the login.
+func warnDurationBeyondToken(idToken string, durationSeconds int64) {
+	if hint := durationBeyondTokenHint(idToken, durationSeconds); hint != "" {
+		Writeln("%s", hint)
+	}
+}
+
+func durationBeyondTokenHint(idToken string, durationSeconds int64) string {
+	claims, err := ParseJWTClaims(idToken)
+	if err != nil {
+		return ""
+	}
+	exp, ok := claims.Expiry()
+	if !ok {
+		return ""
+	}
+	remaining := int64(time.Until(exp).Seconds())
+	if remaining < 0 || durationSeconds-remaining <= int64(durationBeyondTokenGap.Seconds()) {
+		return ""
+	}
+	return fmt.Sprintf("Hint: the session of %d seconds outlives the ID token which expires in %d seconds. "+
+		"STS doesn't end the session with the token, use --duration-from-token if it should", durationSeconds, remaining)
+}
+
+// validateGivenToken checks the token is an unexpired JWT issued for this client before the STS call.
+func validateGivenToken(client *OIDCClient, token string, audiences []string) error {
+	claims, err := ParseJWTClaims(token)
+	if err != nil {
+		return err
+	}
+	if err := validateSigningAlg(client, token); err != nil {
+		return err
+	}
+
+	var accepted []string
+	for _, audience := range audiences {
+		if audience == "" {
+			audience = client.config.GetString(CLIENT_ID)
+		}
+		if claims.HasAudience(audience) {
+			accepted = nil
+			break
+		}
+		accepted = append(accepted, audience)
+	}
+	if len(accepted) > 0 {
+		return errors.Errorf("The token audience %v doesn't match %v", claims.Audiences(), accepted)
+	}
+
+	if exp, ok := claims.Expiry(); ok && time.Now().After(exp) {
+		return errors.Errorf("The token has expired at %s", exp.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func marshalOutput(v interface{}, pretty bool) ([]byte, error) {
+	if pretty {
+		return json.MarshalIndent(v, "", "  ")
+	}
+	return json.Marshal(v)
+}
+
+// credentialProcessCommand returns the command line of this tool which prints the cached credentials of the role.
+func credentialProcessCommand(client *OIDCClient, roleArn string, opts *AuthenticateOptions) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	args := []string{exe, "get-cred", "-p", client.Name(), "-r", roleArn, "-j", "-s"}
+	if opts.MaxSessionDurationSeconds > 0 {
+		args = append(args, "-d", strconv.FormatInt(opts.MaxSessionDurationSeconds, 10))
+	}
+	if policy := opts.SessionPolicy; !policy.IsEmpty() {
+		for _, policyArn := range policy.PolicyArns {
+			args = append(args, "--policy-arn", policyArn)
+		}
+		if policy.Policy != "" {
+			args = append(args, "--policy", policy.Policy)
+		}
+	}
+	if opts.ChainRoleArn != "" {
+		args = append(args, "--chain-role", opts.ChainRoleArn)
+		if opts.ChainExternalID != "" {
+			args = append(args, "--chain-external-id", opts.ChainExternalID)
+		}
+	}
+	for i, arg := range args {
+		if strings.ContainsAny(arg, " \t\"") {
+			args[i] = strconv.Quote(arg)
+		}
+	}
+	return strings.Join(args, " "), nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// grantedScope returns the scope granted by the login: the scope of the token response, or the scope claim of the
+// access token. Without both, the requested scope is granted (RFC 6749 5.1). It's empty without the login.
+func grantedScope(client *OIDCClient, tokenResponse *TokenResponse) string {
+	if tokenResponse == nil {
+		return ""
+	}
+	if tokenResponse.Scope != "" {
+		return tokenResponse.Scope
+	}
+	if claims, err := ParseJWTClaims(tokenResponse.AccessToken); err == nil {
+		if scopes := claims.Scopes(); len(scopes) > 0 {
+			return strings.Join(scopes, " ")
+		}
+	}
+	return client.Scope()
+}
+
+// sameScopes compares the space-delimited scopes regardless of the order.
+func sameScopes(a, b string) bool {
+	as, bs := strings.Fields(a), strings.Fields(b)
+	if len(as) != len(bs) {
+		return false
+	}
+	set := make(map[string]bool, len(as))
+	for _, s := range as {
+		set[s] = true
+	}
+	for _, s := range bs {
+		if !set[s] {
+			return false
+		}
+	}
+	return true
+}
+
+// isTokenExpired tells STS rejected the token because it has expired.
+func isTokenExpired(err error) bool {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		switch aerr.Code() {
+		case sts.ErrCodeExpiredTokenException:
+			return true
+		case sts.ErrCodeInvalidIdentityTokenException:
+			return strings.Contains(strings.ToLower(aerr.Message()), "expired")
+		}
+	}
+	return false
+}
+
+// renewLoginToken gets a new token silently by the refresh token if it's issued, otherwise by the login again.
+func renewLoginToken(client *OIDCClient, role *RoleConfig, opts *AuthenticateOptions, prev *TokenResponse) (*TokenResponse, error) {
+	if prev.RefreshToken != "" {
+		tokenResponse, err := refreshToken(client, prev.RefreshToken)
+		if err == nil {
+			if tokenResponse.RefreshToken == "" {
+				tokenResponse.RefreshToken = prev.RefreshToken
 			}
+			return tokenResponse, nil
 		}
-		return nil, errors.Errorf("Failed to turn code into token")
+		Traceln("Failed to refresh the token, login again: %v", err)
 	}
+	return doLogin(client, role, opts)
+}
 
-	var tokenResponse TokenResponse
-	res.ReadJson(&tokenResponse)
-	return &tokenResponse, nil
+// isAudienceMismatch tells STS rejected the token because of its aud claim, or expected_audiences did before STS.
+func isAudienceMismatch(err error) bool {
+	if errors.Cause(err) == errUnexpectedAudience {
+		return true
+	}
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		return aerr.Code() == sts.ErrCodeInvalidIdentityTokenException && strings.Contains(strings.ToLower(aerr.Message()), "audience")
+	}
+	return false
 }
 
 func getSessionCreds(cred *AWSCredentials) *SessionCredentials {
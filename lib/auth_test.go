@@ -0,0 +1,239 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+
+	"github.com/spf13/viper"
+)
+
+func newTestClient(settings map[string]interface{}) *OIDCClient {
+	config := viper.New()
+	for key, value := range settings {
+		config.Set(key, value)
+	}
+	return &OIDCClient{config: config}
+}
+
+func TestValidateTokenAudience(t *testing.T) {
+	client := newTestClient(map[string]interface{}{CLIENT_ID: "my-client"})
+	role := &RoleConfig{Audience: "sts.amazonaws.com"}
+
+	tests := []struct {
+		name        string
+		idToken     string
+		accessToken string
+		wantErr     bool
+	}{
+		{"ID token for the audience", mockJWT(map[string]interface{}{"aud": "sts.amazonaws.com"}), "opaque", false},
+		{"ID token for the client and opaque access token", mockJWT(map[string]interface{}{"aud": "my-client"}), "opaque", false},
+		{"ID token for the client and access token for the audience", mockJWT(map[string]interface{}{"aud": "my-client"}),
+			mockJWT(map[string]interface{}{"aud": []interface{}{"sts.amazonaws.com", "other"}}), false},
+		{"access token for another audience", mockJWT(map[string]interface{}{"aud": "my-client"}),
+			mockJWT(map[string]interface{}{"aud": "other"}), true},
+		{"ID token for another client", mockJWT(map[string]interface{}{"aud": "other-client"}), "opaque", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateTokenAudience(client, &TokenResponse{IDToken: tt.idToken, AccessToken: tt.accessToken}, role)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateTokenAudience() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDurationBeyondTokenHint(t *testing.T) {
+	expiresIn := func(d time.Duration) string {
+		return mockJWT(map[string]interface{}{"exp": time.Now().Add(d).Unix()})
+	}
+	tests := []struct {
+		name     string
+		idToken  string
+		duration int64
+		wantHint bool
+	}{
+		{"session within the token", expiresIn(time.Hour), 900, false},
+		{"session slightly beyond the token", expiresIn(5 * time.Minute), 540, false},
+		{"session far beyond the token", expiresIn(5 * time.Minute), 3600, true},
+		{"expired token", expiresIn(-time.Minute), 3600, false},
+		{"token without exp", mockJWT(map[string]interface{}{}), 3600, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if hint := durationBeyondTokenHint(tt.idToken, tt.duration); (hint != "") != tt.wantHint {
+				t.Errorf("durationBeyondTokenHint() = %q, wantHint %v", hint, tt.wantHint)
+			}
+		})
+	}
+}
+
+func TestAuthenticateJSONToOutput(t *testing.T) {
+	f := newSelftestFixture(t)
+
+	var output bytes.Buffer
+	stdout := captureStdout(t, func() {
+		Authenticate(f.client(t, nil), &AuthenticateOptions{
+			RoleArn:   selftestRoleArn,
+			LoginFlow: LOGIN_FLOW_LOOPBACK,
+			AsJson:    true,
+			Output:    &output,
+		})
+	})
+	if stdout != "" {
+		t.Errorf("Nothing should be printed to stdout with Output: %q", stdout)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &got); err != nil {
+		t.Fatalf("The output should be the credential_process JSON only: %q %v", output.String(), err)
+	}
+	var keys []string
+	for key := range got {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if want := []string{"AccessKeyId", "Expiration", "SecretAccessKey", "SessionToken", "Version"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("The keys of the output = %v, want %v", keys, want)
+	}
+	if got["Version"] != float64(1) || got["AccessKeyId"] != selftestAccessKeyID {
+		t.Errorf("Unexpected output: %v", got)
+	}
+}
+
+// authenticateJSON runs Authenticate of the role with the secret store and returns the printed credentials.
+func authenticateJSON(t *testing.T, client *OIDCClient, opts *AuthenticateOptions) *AWSCredentials {
+	t.Helper()
+	opts.RoleArn = selftestRoleArn
+	opts.UseSecret = true
+	opts.LoginFlow = LOGIN_FLOW_LOOPBACK
+	opts.AsJson = true
+	var output bytes.Buffer
+	opts.Output = &output
+	Authenticate(client, opts)
+
+	var cred AWSCredentials
+	if err := json.Unmarshal(output.Bytes(), &cred); err != nil {
+		t.Fatalf("The output should be the JSON of the credentials: %q %v", output.String(), err)
+	}
+	return &cred
+}
+
+func TestCachedCredentialOfAnotherScopeIsBypassed(t *testing.T) {
+	tests := []struct {
+		name        string
+		cachedScope string
+		hit         bool
+	}{
+		{"same scope", "openid email", true},
+		{"reordered scope", "email openid", true},
+		{"another scope", "openid", false},
+		{"legacy entry without scope", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempLockDir(t)
+			f := newSelftestFixture(t)
+			fake := &fakeSTS{}
+			useFakeSTS(t, fake)
+			useCredentialStore(t, "test-memory", memoryStore{})
+			client := f.client(t, map[string]string{SECRET_BACKEND: "test-memory", SCOPE: "openid email"})
+
+			store, err := NewCredentialStore(client.Name(), client.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cached := testCredential()
+			cached.Scope = tt.cachedScope
+			SaveAWSCredential(store, selftestRoleArn, configuredDuration(client), nil, cached)
+
+			cred := authenticateJSON(t, client, &AuthenticateOptions{})
+			if hit := cred.AWSAccessKey == cached.AWSAccessKey; hit != tt.hit {
+				t.Errorf("The cached credential hit = %v, want %v", hit, tt.hit)
+			}
+			if assumed := len(fake.requestedDurations()) > 0; assumed == tt.hit {
+				t.Errorf("The role should be assumed only on the miss, assumed = %v", assumed)
+			}
+		})
+	}
+}
+
+func TestStoredSessionOfAnotherScopeIsBypassed(t *testing.T) {
+	tests := []struct {
+		name        string
+		storedScope string
+		reused      bool
+	}{
+		{"same scope", "openid email", true},
+		{"reordered scope", "email openid", true},
+		{"another scope", "openid profile", false},
+		{"legacy session without scope", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempLockDir(t)
+			f := newSelftestFixture(t)
+			fake := &fakeSTS{}
+			useFakeSTS(t, fake)
+			useCredentialStore(t, "test-memory", memoryStore{})
+			client := f.client(t, map[string]string{SECRET_BACKEND: "test-memory", SCOPE: "openid email"})
+
+			store, err := NewCredentialStore(client.Name(), client.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			storedIDToken := mockJWT(map[string]interface{}{
+				"iss": f.idp.server.URL,
+				"aud": selftestClientID,
+				"exp": time.Now().Add(time.Hour).Unix(),
+			})
+			if err := SaveProviderSession(store, client.Name(), &ProviderSession{IDToken: storedIDToken, Scope: tt.storedScope}); err != nil {
+				t.Fatal(err)
+			}
+
+			authenticateJSON(t, client, &AuthenticateOptions{})
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+			if len(fake.assumeInputs) == 0 {
+				t.Fatal("The role should be assumed")
+			}
+			sent := aws.StringValue(fake.assumeInputs[0].WebIdentityToken)
+			if reused := sent == storedIDToken; reused != tt.reused {
+				t.Errorf("The stored ID token reused = %v, want %v", reused, tt.reused)
+			}
+			if !tt.reused && sent != f.idp.issuedIDToken() {
+				t.Errorf("The ID token of the new login should be sent: %s", sent)
+			}
+		})
+	}
+}
+
+func TestValidateClearEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    *AuthenticateOptions
+		format  string
+		wantErr bool
+	}{
+		{"export", &AuthenticateOptions{ClearEnv: true}, OUTPUT_FORMAT_EXPORT, false},
+		{"json", &AuthenticateOptions{ClearEnv: true}, OUTPUT_FORMAT_JSON, true},
+		{"full-json", &AuthenticateOptions{ClearEnv: true}, OUTPUT_FORMAT_FULL_JSON, true},
+		{"web console", &AuthenticateOptions{ClearEnv: true, WebConsole: true}, OUTPUT_FORMAT_EXPORT, true},
+		{"git credential", &AuthenticateOptions{ClearEnv: true, GitCredentialURL: "https://git-codecommit.us-east-1.amazonaws.com/v1/repos/r"}, OUTPUT_FORMAT_EXPORT, true},
+		{"switch profile", &AuthenticateOptions{ClearEnv: true, SwitchProfile: "dev"}, OUTPUT_FORMAT_EXPORT, false},
+		{"json without clear", &AuthenticateOptions{}, OUTPUT_FORMAT_JSON, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateClearEnv(tt.opts, tt.format); (err != nil) != tt.wantErr {
+				t.Errorf("validateClearEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// newAWSClientConfig returns the session and the config of the AWS service client with the endpoint override
+// and the retry config of the provider. The service is the key of the endpoints config, e.g. sts.
+// Every AWS client of this tool is constructed by it.
+func newAWSClientConfig(client *OIDCClient, service string, cfgs ...*aws.Config) (*session.Session, []*aws.Config, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to create session")
+	}
+
+	var configs []*aws.Config
+	region := ResolveRegion(client)
+	if endpoint := awsEndpoint(client, service); endpoint != "" {
+		// e.g. LocalStack or the VPC endpoint
+		configs = append(configs, aws.NewConfig().WithEndpoint(endpoint))
+		if region == "" && aws.StringValue(sess.Config.Region) == "" {
+			region = "us-east-1"
+		}
+	}
+	if region != "" {
+		configs = append(configs, aws.NewConfig().WithRegion(region))
+	}
+	if proxy := client.config.GetString(AWS_HTTP_PROXY); proxy != "" {
+		proxyFunc, err := proxyFunc(proxy)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Invalid %s", AWS_HTTP_PROXY)
+		}
+		tr := http.DefaultTransport.(*http.Transport).Clone()
+		tr.Proxy = proxyFunc
+		configs = append(configs, aws.NewConfig().WithHTTPClient(&http.Client{Transport: tr}))
+	}
+	retryConfig, err := awsRetryConfig(client)
+	if err != nil {
+		return nil, nil, err
+	}
+	if retryConfig != nil {
+		configs = append(configs, retryConfig)
+	}
+	return sess, append(configs, cfgs...), nil
+}
+
+// ResolveRegion resolves the region of the AWS clients in the order of the AWS CLI: --region, AWS_REGION,
+// AWS_DEFAULT_REGION, region of the active profile, then fallback_region.
+func ResolveRegion(client *OIDCClient) string {
+	if region := client.config.GetString(REGION); region != "" {
+		return region
+	}
+	for _, key := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(key); region != "" {
+			return region
+		}
+	}
+	if region := AWSConfigRegion(os.Getenv("AWS_PROFILE")); region != "" {
+		return region
+	}
+	return client.config.GetString(FALLBACK_REGION)
+}
+
+// useProviderRegionAsFallback reads region of the provider config as fallback_region, so that only --region
+// takes precedence over the environment like the AWS CLI. It's called before the overrides are applied.
+func useProviderRegionAsFallback(config *viper.Viper) {
+	if !config.InConfig(REGION) {
+		return
+	}
+	if !config.IsSet(FALLBACK_REGION) {
+		config.Set(FALLBACK_REGION, config.GetString(REGION))
+	}
+	config.Set(REGION, "")
+}
+
+// awsEndpoint returns the endpoints config of the service. sts_endpoint is kept for STS.
+func awsEndpoint(client *OIDCClient, service string) string {
+	if endpoint := client.config.GetStringMapString(ENDPOINTS)[service]; endpoint != "" {
+		return endpoint
+	}
+	if service == "sts" {
+		return client.config.GetString(STS_ENDPOINT)
+	}
+	return ""
+}
+
+// stsAPI is the subset of stsiface.STSAPI which this tool calls, a fake can be injected by newSTSClient.
+type stsAPI interface {
+	GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (*sts.GetCallerIdentityOutput, error)
+	AssumeRoleWithWebIdentityWithContext(aws.Context, *sts.AssumeRoleWithWebIdentityInput, ...request.Option) (*sts.AssumeRoleWithWebIdentityOutput, error)
+	AssumeRoleWithContext(aws.Context, *sts.AssumeRoleInput, ...request.Option) (*sts.AssumeRoleOutput, error)
+}
+
+// newSTSClient returns the STS client of the provider. It's replaced to call a fake STS without AWS.
+var newSTSClient = func(client *OIDCClient, cfgs ...*aws.Config) (stsAPI, error) {
+	sess, configs, err := newAWSClientConfig(client, "sts", cfgs...)
+	if err != nil {
+		return nil, err
+	}
+	return sts.New(sess, configs...), nil
+}
+
+// awsRetryConfig maps aws_retry_mode and aws_max_attempts like retry_mode and max_attempts of the AWS CLI.
+// It returns nil to keep the SDK default when neither is set.
+func awsRetryConfig(client *OIDCClient) (*aws.Config, error) {
+	mode := client.config.GetString(AWS_RETRY_MODE)
+	maxAttempts := client.config.GetInt(AWS_MAX_ATTEMPTS)
+	if mode == "" && maxAttempts <= 0 {
+		return nil, nil
+	}
+
+	retryer := awsclient.DefaultRetryer{NumMaxRetries: awsclient.DefaultRetryerMaxNumRetries}
+	switch mode {
+	case "", "legacy":
+	case "standard":
+		// 3 attempts and the backoff up to 20 seconds
+		retryer.NumMaxRetries = 2
+		retryer.MaxRetryDelay = 20 * time.Second
+		retryer.MaxThrottleDelay = 20 * time.Second
+	case "adaptive":
+		return nil, errors.Errorf("%s adaptive is not supported by AWS SDK for Go v1, use standard", AWS_RETRY_MODE)
+	default:
+		return nil, errors.Errorf("Unknown %s: %s", AWS_RETRY_MODE, mode)
+	}
+	if maxAttempts > 0 {
+		retryer.NumMaxRetries = maxAttempts - 1
+	}
+	return request.WithRetryer(aws.NewConfig(), retryer), nil
+}
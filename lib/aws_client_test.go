@@ -0,0 +1,257 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/spf13/viper"
+)
+
+// fakeSTS answers AssumeRoleWithWebIdentity by the errors in order, then by the credentials.
+type fakeSTS struct {
+	mu           sync.Mutex
+	assumeErrs   []error
+	assumeInputs []*sts.AssumeRoleWithWebIdentityInput
+	callerErr    error
+	callerCalls  int
+}
+
+// useFakeSTS makes newSTSClient return the fake during the test.
+func useFakeSTS(t *testing.T, fake *fakeSTS) {
+	t.Helper()
+	origNewSTSClient := newSTSClient
+	t.Cleanup(func() { newSTSClient = origNewSTSClient })
+	newSTSClient = func(client *OIDCClient, cfgs ...*aws.Config) (stsAPI, error) {
+		return fake, nil
+	}
+}
+
+func (f *fakeSTS) GetCallerIdentityWithContext(aws.Context, *sts.GetCallerIdentityInput, ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.callerCalls++
+	if f.callerErr != nil {
+		return nil, f.callerErr
+	}
+	return &sts.GetCallerIdentityOutput{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/test/session")}, nil
+}
+
+func (f *fakeSTS) AssumeRoleWithWebIdentityWithContext(_ aws.Context, input *sts.AssumeRoleWithWebIdentityInput, _ ...request.Option) (*sts.AssumeRoleWithWebIdentityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// The retry reuses the input with the other fields
+	sent := *input
+	f.assumeInputs = append(f.assumeInputs, &sent)
+	if len(f.assumeErrs) > 0 {
+		err := f.assumeErrs[0]
+		f.assumeErrs = f.assumeErrs[1:]
+		return nil, err
+	}
+	return &sts.AssumeRoleWithWebIdentityOutput{
+		Credentials: &sts.Credentials{
+			AccessKeyId:     aws.String("ASIAFAKE"),
+			SecretAccessKey: aws.String("fake-secret"),
+			SessionToken:    aws.String("fake-token"),
+			Expiration:      aws.Time(time.Now().Add(time.Duration(aws.Int64Value(input.DurationSeconds)) * time.Second)),
+		},
+		AssumedRoleUser: &sts.AssumedRoleUser{Arn: aws.String("arn:aws:sts::123456789012:assumed-role/test/session")},
+	}, nil
+}
+
+func (f *fakeSTS) AssumeRoleWithContext(aws.Context, *sts.AssumeRoleInput, ...request.Option) (*sts.AssumeRoleOutput, error) {
+	return nil, awserr.New("AccessDenied", "The fake STS doesn't chain the roles", nil)
+}
+
+func (f *fakeSTS) requestedDurations() []int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var durations []int64
+	for _, input := range f.assumeInputs {
+		durations = append(durations, aws.Int64Value(input.DurationSeconds))
+	}
+	return durations
+}
+
+func TestAssumeRoleNegotiatesMaxDuration(t *testing.T) {
+	t.Setenv("AWS_CLI_OIDC_CACHE", t.TempDir())
+	fake := &fakeSTS{assumeErrs: []error{
+		awserr.New("ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role: 7200", nil),
+	}}
+	useFakeSTS(t, fake)
+	client := newTestClient(map[string]interface{}{SESSION_DURATION_NEGOTIATION: true})
+	idToken := mockJWT(map[string]interface{}{"aud": "sts.amazonaws.com"})
+
+	cred, err := GetCredentialsWithOIDC(client, idToken, testRoleArn, 43200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.AWSAccessKey != "ASIAFAKE" {
+		t.Errorf("The credentials differ from the fake: %+v", cred)
+	}
+	if got := fake.requestedDurations(); len(got) != 2 || got[0] != 43200 || got[1] != 7200 {
+		t.Errorf("The request should be retried by the max of the role, got %v", got)
+	}
+
+	// The next request is clamped by the negotiated max without the rejection
+	if _, err := GetCredentialsWithOIDC(client, idToken, testRoleArn, 43200); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.requestedDurations(); len(got) != 3 || got[2] != 7200 {
+		t.Errorf("The negotiated max should be requested, got %v", got)
+	}
+}
+
+func TestAssumeRoleWithoutNegotiationIsNotRetried(t *testing.T) {
+	t.Setenv("AWS_CLI_OIDC_CACHE", t.TempDir())
+	fake := &fakeSTS{assumeErrs: []error{
+		awserr.New("ValidationError", "The requested DurationSeconds exceeds the MaxSessionDuration set for this role: 7200", nil),
+	}}
+	useFakeSTS(t, fake)
+	client := newTestClient(nil)
+
+	_, err := GetCredentialsWithOIDC(client, mockJWT(map[string]interface{}{}), testRoleArn, 43200)
+	if err == nil || !isDurationExceeded(err) {
+		t.Errorf("The rejected duration should be returned, got %v", err)
+	}
+	if got := fake.requestedDurations(); len(got) != 1 {
+		t.Errorf("The request shouldn't be retried, got %v", got)
+	}
+}
+
+func TestAssumeRoleErrorMapping(t *testing.T) {
+	tests := []struct {
+		name             string
+		err              error
+		expired          bool
+		audienceMismatch bool
+	}{
+		{"expired token", awserr.New(sts.ErrCodeExpiredTokenException, "Token expired", nil), true, false},
+		{"invalid expired token", awserr.New(sts.ErrCodeInvalidIdentityTokenException, "Token Expired: 1700000000", nil), true, false},
+		{"incorrect audience", awserr.New(sts.ErrCodeInvalidIdentityTokenException, "Incorrect token audience", nil), false, true},
+		{"untrusted provider", awserr.New(sts.ErrCodeInvalidIdentityTokenException, "No OpenIDConnect provider found in your account", nil), false, false},
+		{"access denied", awserr.New("AccessDenied", "Not authorized to perform sts:AssumeRoleWithWebIdentity", nil), false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useFakeSTS(t, &fakeSTS{assumeErrs: []error{tt.err}})
+
+			_, err := GetCredentialsWithOIDC(newTestClient(nil), mockJWT(map[string]interface{}{}), testRoleArn, 900)
+			if err == nil || !strings.HasPrefix(err.Error(), "Error retrieving STS credentials using ID Token") {
+				t.Fatalf("The STS error should be wrapped, got %v", err)
+			}
+			if got := isTokenExpired(err); got != tt.expired {
+				t.Errorf("isTokenExpired() = %v, want %v", got, tt.expired)
+			}
+			if got := isAudienceMismatch(err); got != tt.audienceMismatch {
+				t.Errorf("isAudienceMismatch() = %v, want %v", got, tt.audienceMismatch)
+			}
+		})
+	}
+}
+
+func TestAuthenticateRetriesExpiredToken(t *testing.T) {
+	f := newSelftestFixture(t)
+	fake := &fakeSTS{assumeErrs: []error{awserr.New(sts.ErrCodeExpiredTokenException, "Token expired", nil)}}
+	useFakeSTS(t, fake)
+	client := f.client(t, nil)
+
+	out := captureStdout(t, func() {
+		Authenticate(client, &AuthenticateOptions{
+			RoleArn:      selftestRoleArn,
+			LoginFlow:    LOGIN_FLOW_LOOPBACK,
+			OutputFormat: OUTPUT_FORMAT_JSON,
+		})
+	})
+	var cred AWSCredentials
+	if err := json.Unmarshal([]byte(out), &cred); err != nil || cred.AWSAccessKey != "ASIAFAKE" {
+		t.Fatalf("The retry should get the credentials, got %q %v", out, err)
+	}
+	if got := fake.requestedDurations(); len(got) != 2 {
+		t.Errorf("The expired token should be retried once by a new token, got %d requests", len(got))
+	}
+}
+
+func TestIsValidByCallerIdentity(t *testing.T) {
+	cred := &AWSCredentials{AWSAccessKey: "ASIAFAKE", AWSSecretKey: "fake-secret", AWSSessionToken: "fake-token", Expires: time.Now().Add(time.Hour)}
+	tests := []struct {
+		name      string
+		settings  map[string]interface{}
+		callerErr error
+		want      bool
+		wantCalls int
+	}{
+		{"valid", nil, nil, true, 1},
+		{"revoked", nil, awserr.New("ExpiredToken", "The security token included in the request is expired", nil), false, 1},
+		{"validation disabled", map[string]interface{}{VALIDATE_CACHED_CREDENTIALS: false}, nil, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeSTS{callerErr: tt.callerErr}
+			useFakeSTS(t, fake)
+
+			if got := isValid(newTestClient(tt.settings), cred); got != tt.want {
+				t.Errorf("isValid() = %v, want %v", got, tt.want)
+			}
+			if fake.callerCalls != tt.wantCalls {
+				t.Errorf("GetCallerIdentity is called %d times, want %d", fake.callerCalls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestResolveRegion(t *testing.T) {
+	awsConfig := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(awsConfig, []byte("[profile dev]\nregion = ap-northeast-1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", awsConfig)
+
+	tests := []struct {
+		name     string
+		provider string
+		flag     string
+		env      map[string]string
+		want     string
+	}{
+		{"flag over env", "", "us-west-2", map[string]string{"AWS_REGION": "eu-west-1"}, "us-west-2"},
+		{"AWS_REGION over AWS_DEFAULT_REGION", "", "", map[string]string{"AWS_REGION": "eu-west-1", "AWS_DEFAULT_REGION": "eu-central-1"}, "eu-west-1"},
+		{"AWS_DEFAULT_REGION", "", "", map[string]string{"AWS_DEFAULT_REGION": "eu-central-1"}, "eu-central-1"},
+		{"env over profile", "", "", map[string]string{"AWS_REGION": "eu-west-1", "AWS_PROFILE": "dev"}, "eu-west-1"},
+		{"profile over fallback", "  fallback_region: sa-east-1\n", "", map[string]string{"AWS_PROFILE": "dev"}, "ap-northeast-1"},
+		{"fallback", "  fallback_region: sa-east-1\n", "", nil, "sa-east-1"},
+		{"region of the provider config doesn't outrank env", "  region: sa-east-1\n", "", map[string]string{"AWS_REGION": "eu-west-1"}, "eu-west-1"},
+		{"region of the provider config is the fallback", "  region: sa-east-1\n", "", nil, "sa-east-1"},
+		{"flag over region of the provider config", "  region: sa-east-1\n", "us-west-2", nil, "us-west-2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE"} {
+				t.Setenv(key, tt.env[key])
+			}
+			v := viper.New()
+			v.SetConfigType("yaml")
+			if err := v.ReadConfig(bytes.NewBufferString("myop:\n  client_id: test\n" + tt.provider)); err != nil {
+				t.Fatal(err)
+			}
+			config := v.Sub("myop")
+			useProviderRegionAsFallback(config)
+			if tt.flag != "" {
+				config.Set(REGION, tt.flag)
+			}
+
+			if got := ResolveRegion(&OIDCClient{config: config}); got != tt.want {
+				t.Errorf("ResolveRegion() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
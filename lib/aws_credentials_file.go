@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/werf/lockgate"
+	"gopkg.in/ini.v1"
+)
+
+// AWSCredentialsFilePath returns the shared credentials file of the AWS CLI.
+func AWSCredentialsFilePath() (string, error) {
+	if path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); path != "" {
+		return path, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".aws", "credentials"), nil
+}
+
+// AWSConfigFilePath returns the shared config file of the AWS CLI.
+func AWSConfigFilePath() (string, error) {
+	if path := os.Getenv("AWS_CONFIG_FILE"); path != "" {
+		return path, nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".aws", "config"), nil
+}
+
+// AWSConfigRoleArn reads role_arn of the profile in the shared config file.
+func AWSConfigRoleArn(profile string) (string, error) {
+	if profile == "" {
+		profile = "default"
+	}
+	path, err := AWSConfigFilePath()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to resolve the AWS config file")
+	}
+	file, err := ini.Load(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to load %s", path)
+	}
+
+	section, err := file.GetSection("profile " + profile)
+	if err != nil {
+		section, err = file.GetSection(profile)
+	}
+	if err != nil {
+		return "", errors.Errorf("The AWS profile %s is not found in %s", profile, path)
+	}
+	roleArn := section.Key("role_arn").String()
+	if roleArn == "" {
+		return "", errors.Errorf("The AWS profile %s has no role_arn in %s", profile, path)
+	}
+	if err := ValidateRoleArn(roleArn); err != nil {
+		return "", errors.Wrapf(err, "Invalid role_arn of the AWS profile %s in %s", profile, path)
+	}
+	return roleArn, nil
+}
+
+// WriteCredentialProcessProfile saves the named profile which gets the credentials by the command
+// into the shared config file. The other profiles are kept.
+func WriteCredentialProcessProfile(name, command string) error {
+	path, err := AWSConfigFilePath()
+	if err != nil {
+		return errors.Wrap(err, "Failed to resolve the AWS config file")
+	}
+
+	return updateIniFile(path, func(file *ini.File) {
+		section := file.Section("profile " + name)
+		section.Key("credential_process").SetValue(command)
+	})
+}
+
+// WriteProfiles saves the credentials as the named profiles into the shared credentials file.
+// The other profiles are kept, and the file is replaced atomically.
+func WriteProfiles(profiles map[string]*AWSCredentials) error {
+	path, err := AWSCredentialsFilePath()
+	if err != nil {
+		return errors.Wrap(err, "Failed to resolve the AWS credentials file")
+	}
+
+	return updateIniFile(path, func(file *ini.File) {
+		for name, cred := range profiles {
+			section := file.Section(name)
+			section.Key("aws_access_key_id").SetValue(cred.AWSAccessKey)
+			section.Key("aws_secret_access_key").SetValue(cred.AWSSecretKey)
+			section.Key("aws_session_token").SetValue(cred.AWSSessionToken)
+		}
+	})
+}
+
+// updateIniFile modifies the file under the lock of the file, so that the processes writing the other profiles
+// at once, e.g. get-cred --profile and --all-accounts, don't lose each other's.
+func updateIniFile(path string, modify func(file *ini.File)) error {
+	_, lock, err := locker.Acquire(lockResource+"-"+filepath.Base(path), lockgate.AcquireOptions{Timeout: lockTimeout})
+	if err != nil {
+		return errors.Wrapf(err, "Timed out after %s waiting for the lock of %s", lockTimeout, path)
+	}
+	defer locker.Release(lock)
+
+	file, err := ini.LooseLoad(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to load %s", path)
+	}
+	modify(file)
+	return writeIniFile(file, path)
+}
+
+// writeIniFile replaces the file atomically.
+func writeIniFile(file *ini.File, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return errors.Wrapf(err, "Failed to create the directory of %s", path)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	if _, err := file.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	return nil
+}
+
+// AWSConfigRegion reads region of the profile in the shared config file, empty if either doesn't exist.
+func AWSConfigRegion(profile string) string {
+	if profile == "" {
+		profile = "default"
+	}
+	path, err := AWSConfigFilePath()
+	if err != nil {
+		return ""
+	}
+	file, err := ini.Load(path)
+	if err != nil {
+		return ""
+	}
+	section, err := file.GetSection("profile " + profile)
+	if err != nil {
+		section, err = file.GetSection(profile)
+	}
+	if err != nil {
+		return ""
+	}
+	return section.Key("region").String()
+}
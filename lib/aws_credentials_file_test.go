@@ -0,0 +1,103 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func TestAuthenticateWritesProfileAndPrintsOutput(t *testing.T) {
+	tests := []struct {
+		format string
+		check  func(t *testing.T, out string)
+	}{
+		{OUTPUT_FORMAT_EXPORT, func(t *testing.T, out string) {
+			for _, line := range []string{
+				"export AWS_ACCESS_KEY_ID=" + selftestAccessKeyID,
+				"export AWS_SECRET_ACCESS_KEY=" + selftestSecretAccessKey,
+				"export AWS_SESSION_TOKEN=" + selftestSessionToken,
+			} {
+				if !strings.Contains(out, line+"\n") {
+					t.Errorf("The output should have %s: %q", line, out)
+				}
+			}
+		}},
+		{OUTPUT_FORMAT_JSON, func(t *testing.T, out string) {
+			var cred AWSCredentials
+			if err := json.Unmarshal([]byte(out), &cred); err != nil || cred.AWSAccessKey != selftestAccessKeyID {
+				t.Errorf("The output should be the JSON of the credentials only: %q %v", out, err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			f := newSelftestFixture(t)
+			credentialsFile := filepath.Join(t.TempDir(), "credentials")
+			if err := os.WriteFile(credentialsFile, []byte("[other]\naws_access_key_id = AKIAOTHER\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+
+			out := captureStdout(t, func() {
+				Authenticate(f.client(t, nil), &AuthenticateOptions{
+					RoleArn:      selftestRoleArn,
+					LoginFlow:    LOGIN_FLOW_LOOPBACK,
+					OutputFormat: tt.format,
+					WriteProfile: "dev",
+				})
+			})
+			tt.check(t, out)
+
+			file, err := ini.Load(credentialsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev := file.Section("dev")
+			if dev.Key("aws_access_key_id").String() != selftestAccessKeyID ||
+				dev.Key("aws_secret_access_key").String() != selftestSecretAccessKey ||
+				dev.Key("aws_session_token").String() != selftestSessionToken {
+				t.Errorf("The profile should have the credentials: %v", dev.KeysHash())
+			}
+			if got := file.Section("other").Key("aws_access_key_id").String(); got != "AKIAOTHER" {
+				t.Errorf("The other profile should be kept, got %s", got)
+			}
+		})
+	}
+}
+
+func TestWriteProfilesConcurrently(t *testing.T) {
+	useTempLockDir(t)
+	lockTimeout = 10 * time.Second
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := WriteProfiles(map[string]*AWSCredentials{fmt.Sprintf("profile-%d", i): testCredential()}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	file, err := ini.Load(credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < writers; i++ {
+		if _, err := file.GetSection(fmt.Sprintf("profile-%d", i)); err != nil {
+			t.Errorf("The profile-%d written at once with the others is lost", i)
+		}
+	}
+}
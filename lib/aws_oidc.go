@@ -2,24 +2,54 @@ package lib
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/pkg/errors"
 )
 
 func GetCredentialsWithOIDC(client *OIDCClient, idToken, iamRoleArn string, durationInSeconds int64) (*AWSCredentials, error) {
-	return loginToStsUsingIDToken(client, idToken, iamRoleArn, durationInSeconds)
+	return loginToStsUsingIDToken(client, idToken, iamRoleArn, durationInSeconds, &AssumeRoleOptions{})
 }
 
-func loginToStsUsingIDToken(client *OIDCClient, idToken, iamRoleArn string, durationInSeconds int64) (*AWSCredentials, error) {
+// AssumeRoleOptions customizes the AssumeRoleWithWebIdentity request.
+type AssumeRoleOptions struct {
+	Policy *SessionPolicy
+	// InputHook is called with the input after the fields of this tool are populated, just before it's sent.
+	// It can set the fields which have no option yet, and override the populated ones. The overridden RoleArn
+	// must still be in allowed_role_arns.
+	InputHook func(*sts.AssumeRoleWithWebIdentityInput)
+}
+
+// GetCredentialsWithOIDCOptions is GetCredentialsWithOIDC with the options of the request.
+func GetCredentialsWithOIDCOptions(client *OIDCClient, idToken, iamRoleArn string, durationInSeconds int64, opts *AssumeRoleOptions) (*AWSCredentials, error) {
+	return loginToStsUsingIDToken(client, idToken, iamRoleArn, durationInSeconds, opts)
+}
+
+func loginToStsUsingIDToken(client *OIDCClient, idToken, iamRoleArn string, durationInSeconds int64, opts *AssumeRoleOptions) (*AWSCredentials, error) {
 	roleSessionName := client.config.GetString(AWS_FEDERATION_ROLE_SESSION_NAME)
 
-	sess, err := session.NewSession()
+	if err := CheckAllowedRole(client, iamRoleArn); err != nil {
+		return nil, err
+	}
+	if err := validateExpectedAudiences(client, idToken); err != nil {
+		return nil, err
+	}
+	// Defense in depth, the trust policy of the role can't see amr nor acr
+	if err := validateAuthContext(ResolveRoleConfig(client.config, iamRoleArn), idToken); err != nil {
+		return nil, err
+	}
+
+	svc, err := newSTSClient(client)
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to create session")
+		return nil, err
 	}
 
-	svc := sts.New(sess)
+	negotiate := client.config.GetBool(SESSION_DURATION_NEGOTIATION)
+	if negotiate {
+		if max, ok := cachedMaxDuration(iamRoleArn); ok && durationInSeconds > max {
+			Traceln("Requesting the session duration %d seconds, the max of the role negotiated before", max)
+			durationInSeconds = max
+		}
+	}
 
 	params := &sts.AssumeRoleWithWebIdentityInput{
 		RoleArn:          &iamRoleArn,
@@ -27,10 +57,32 @@ func loginToStsUsingIDToken(client *OIDCClient, idToken, iamRoleArn string, dura
 		WebIdentityToken: &idToken,
 		DurationSeconds:  aws.Int64(durationInSeconds),
 	}
+	if policy := opts.Policy; !policy.IsEmpty() {
+		for _, policyArn := range policy.PolicyArns {
+			params.PolicyArns = append(params.PolicyArns, &sts.PolicyDescriptorType{Arn: aws.String(policyArn)})
+		}
+		if policy.Policy != "" {
+			params.Policy = aws.String(policy.Policy)
+		}
+	}
+	if opts.InputHook != nil {
+		opts.InputHook(params)
+		if err := CheckAllowedRole(client, aws.StringValue(params.RoleArn)); err != nil {
+			return nil, err
+		}
+	}
 
 	Writeln("Requesting AWS credentials using ID Token")
 
-	resp, err := svc.AssumeRoleWithWebIdentity(params)
+	resp, err := svc.AssumeRoleWithWebIdentityWithContext(runContext(), params)
+	if err != nil && negotiate && isDurationExceeded(err) {
+		if max := negotiateMaxDuration(client, iamRoleArn, err); max < aws.Int64Value(params.DurationSeconds) {
+			Writeln("Requesting the session duration %d seconds, the max of the role", max)
+			saveMaxDuration(iamRoleArn, max)
+			params.DurationSeconds = aws.Int64(max)
+			resp, err = svc.AssumeRoleWithWebIdentityWithContext(runContext(), params)
+		}
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "Error retrieving STS credentials using ID Token")
 	}
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+func TestInputHookRoleArnIsCheckedByAllowedRoles(t *testing.T) {
+	f := newSelftestFixture(t)
+	client := f.client(t, nil)
+	client.config.Set(ALLOWED_ROLE_ARNS, []string{selftestRoleArn})
+	idToken := f.login(t, client).IDToken
+
+	hook := func(input *sts.AssumeRoleWithWebIdentityInput) {
+		input.RoleArn = aws.String("arn:aws:iam::123456789012:role/admin")
+	}
+	_, err := GetCredentialsWithOIDCOptions(client, idToken, selftestRoleArn, 900, &AssumeRoleOptions{InputHook: hook})
+	if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("The role set by the hook should be refused by %s, got %v", ALLOWED_ROLE_ARNS, err)
+	}
+}
+
+func TestAuthenticateWithSTSInputHookSkipsSecretStore(t *testing.T) {
+	useTempLockDir(t)
+	f := newSelftestFixture(t)
+	store := memoryStore{}
+	useCredentialStore(t, "test-memory", store)
+	client := f.client(t, map[string]string{SECRET_BACKEND: "test-memory"})
+
+	called := false
+	captureStdout(t, func() {
+		Authenticate(client, &AuthenticateOptions{
+			RoleArn:      selftestRoleArn,
+			UseSecret:    true,
+			LoginFlow:    LOGIN_FLOW_LOOPBACK,
+			OutputFormat: OUTPUT_FORMAT_JSON,
+			STSInputHook: func(input *sts.AssumeRoleWithWebIdentityInput) {
+				called = true
+			},
+		})
+	})
+	if !called {
+		t.Error("The hook should be called")
+	}
+	if len(store) != 0 {
+		t.Errorf("The credentials of the customized request must not be cached: %v", store)
+	}
+}
@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DEFAULT_MAX_CONCURRENCY is the number of the roles assumed in parallel when max_concurrency isn't set
+const DEFAULT_MAX_CONCURRENCY = 4
+
+type AuthenticateAllOptions struct {
+	// RoleArns to assume, the role_arn of the roles config are used when empty
+	RoleArns                  []string
+	MaxSessionDurationSeconds int64
+	// WriteProfiles writes a named profile per role into the AWS credentials file instead of the JSON output
+	WriteProfiles bool
+	Pretty        bool
+	LoginFlow     string
+}
+
+// AuthenticateAll assumes all the roles by the single login.
+func AuthenticateAll(client *OIDCClient, opts *AuthenticateAllOptions) {
+	roleArns := opts.RoleArns
+	if len(roleArns) == 0 {
+		var roles []RoleConfig
+		if err := client.config.UnmarshalKey(ROLES, &roles); err != nil {
+			Writeln("Failed to read the %s config", ROLES)
+			Exit(err)
+		}
+		for _, r := range roles {
+			roleArns = append(roleArns, r.RoleArn)
+		}
+	}
+	if len(roleArns) == 0 {
+		Writeln("No role to assume, specify --roles or the %s config", ROLES)
+		Exit(nil)
+	}
+	if err := validateBatchRoles(client, roleArns); err != nil {
+		Exit(err)
+	}
+
+	tokenResponse, err := doLogin(client, ResolveRoleConfig(client.config, ""), &AuthenticateOptions{LoginFlow: opts.LoginFlow})
+	if err != nil {
+		Writeln("Failed to login the OIDC provider")
+		Exit(err)
+	}
+	Writeln("Login successful!")
+
+	duration := opts.MaxSessionDurationSeconds
+	if duration <= 0 {
+		duration = configuredDuration(client)
+	}
+
+	creds, errs := assumeRoles(client, tokenResponse.IDToken, roleArns, duration)
+
+	// Reported in the order of the roles regardless of which call finished first
+	results := map[string]*AWSCredentials{}
+	var succeeded, failed []string
+	for i, roleArn := range roleArns {
+		if errs[i] != nil {
+			Writeln("Failed to assume %s: %v", roleArn, errs[i])
+			failed = append(failed, roleArn)
+			continue
+		}
+		creds[i].Version = 1
+		results[roleArn] = creds[i]
+		succeeded = append(succeeded, roleArn)
+	}
+
+	if opts.WriteProfiles {
+		profiles := map[string]*AWSCredentials{}
+		for roleArn, cred := range results {
+			profiles[profileName(roleArn)] = cred
+		}
+		if err := WriteProfiles(profiles); err != nil {
+			Exit(err)
+		}
+		for _, roleArn := range succeeded {
+			Writeln("Saved the profile: %s", profileName(roleArn))
+		}
+	} else {
+		jsonBytes, err := marshalOutput(results, opts.Pretty)
+		if err != nil {
+			Writeln("Unexpected AWS credential response")
+			Exit(err)
+		}
+		fmt.Println(string(jsonBytes))
+	}
+
+	if len(failed) > 0 {
+		Writeln("Failed to assume %d of %d roles: %s", len(failed), len(roleArns), strings.Join(failed, ", "))
+		Exit(nil)
+	}
+}
+
+// validateBatchRoles checks all the roles before the login, so that the bad one doesn't cost the login.
+func validateBatchRoles(client *OIDCClient, roleArns []string) error {
+	for _, roleArn := range roleArns {
+		if err := ValidateRoleArn(roleArn); err != nil {
+			return errors.Wrapf(err, "Invalid role: %s", roleArn)
+		}
+		if err := CheckAllowedRole(client, roleArn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assumeRoles assumes the roles with the ID token by up to max_concurrency workers.
+// The credentials and the errors are returned at the index of the role.
+// The throttled calls are retried by the SDK as configured by aws_retry_mode and aws_max_attempts.
+func assumeRoles(client *OIDCClient, idToken string, roleArns []string, duration int64) ([]*AWSCredentials, []error) {
+	concurrency := client.config.GetInt(MAX_CONCURRENCY)
+	if concurrency <= 0 {
+		concurrency = DEFAULT_MAX_CONCURRENCY
+	}
+	if concurrency > len(roleArns) {
+		concurrency = len(roleArns)
+	}
+
+	creds := make([]*AWSCredentials, len(roleArns))
+	errs := make([]error, len(roleArns))
+	indexes := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				creds[i], errs[i] = GetCredentialsWithOIDC(client, idToken, roleArns[i], duration)
+			}
+		}()
+	}
+	for i := range roleArns {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return creds, errs
+}
+
+// profileName derives the profile name as <account-id>-<role-name>.
+func profileName(roleArn string) string {
+	arn := strings.Split(roleArn, ":")
+	roleName := arn[5][strings.LastIndex(arn[5], "/")+1:]
+	return arn[4] + "-" + roleName
+}
@@ -0,0 +1,24 @@
+package lib
+
+import "testing"
+
+func TestValidateBatchRoles(t *testing.T) {
+	client := newTestClient(map[string]interface{}{ALLOWED_ROLE_ARNS: []string{"arn:aws:iam::123456789012:role/*"}})
+
+	tests := []struct {
+		name     string
+		roleArns []string
+		wantErr  bool
+	}{
+		{"allowed roles", []string{"arn:aws:iam::123456789012:role/dev", "arn:aws:iam::123456789012:role/ops"}, false},
+		{"disallowed role", []string{"arn:aws:iam::123456789012:role/dev", "arn:aws:iam::999999999999:role/admin"}, true},
+		{"invalid role", []string{"arn:aws:iam::123456789012:user/dev"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateBatchRoles(client, tt.roleArns); (err != nil) != tt.wantErr {
+				t.Errorf("validateBatchRoles() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
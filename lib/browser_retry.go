@@ -0,0 +1,86 @@
+package lib
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	input "github.com/natsukagami/go-input"
+	"github.com/pkg/errors"
+)
+
+// retryBrowser asks the user whether the browser opened the login page, when the default handler of the URL
+// may be misconfigured, e.g. it opens another application. On no, it prints the URL and offers browser_command
+// unless the browser has returned while asking.
+func retryBrowser(authURL string, browserCommand string, returned <-chan struct{}) {
+	ui := &input.UI{
+		Writer: os.Stderr,
+		Reader: os.Stdin,
+	}
+	answer, err := ui.Ask("Did a browser open at the login page? [y/N]", &input.Options{
+		Default:      "N",
+		Loop:         true,
+		ValidateFunc: validateYesNo,
+	})
+	if err == input.ErrInterrupted {
+		Writeln("Login was interrupted")
+		Exit(err)
+	}
+	if err != nil || strings.EqualFold(answer, "y") {
+		return
+	}
+	select {
+	case <-returned:
+		return
+	default:
+	}
+
+	Writeln("Open the following URL manually:\n\n%s\n", authURL)
+	if browserCommand == "" {
+		Writeln("Set %s to open it by another browser next time", BROWSER_COMMAND)
+		return
+	}
+	answer, err = ui.Ask("Try "+browserCommand+"? [Y/n]", &input.Options{
+		Default:      "Y",
+		Loop:         true,
+		ValidateFunc: validateYesNo,
+	})
+	if err == input.ErrInterrupted {
+		Writeln("Login was interrupted")
+		Exit(err)
+	}
+	if err != nil || strings.EqualFold(answer, "n") {
+		return
+	}
+	if err := openBrowserCommand(browserCommand, authURL); err != nil {
+		Writeln("Failed to run %s: %v", browserCommand, err)
+	}
+}
+
+func validateYesNo(s string) error {
+	if !strings.EqualFold(s, "y") && !strings.EqualFold(s, "n") {
+		return errors.New("Input must be y or n")
+	}
+	return nil
+}
+
+// openBrowserCommand runs the command line of browser_command with the URL as the last argument.
+func openBrowserCommand(browserCommand string, authURL string) error {
+	args := strings.Fields(browserCommand)
+	if len(args) == 0 {
+		return errors.Errorf("%s is empty", BROWSER_COMMAND)
+	}
+	cmd := exec.Command(args[0], append(args[1:], authURL)...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	// The browser may keep running after the login
+	go cmd.Wait()
+	return nil
+}
+
+// isInteractive returns true if stdin is a terminal to prompt, unlike credential_process and the pipes.
+func isInteractive() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
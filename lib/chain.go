@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"regexp"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+)
+
+// The constraints of ExternalId of sts:AssumeRole
+var externalIDPattern = regexp.MustCompile(`^[\w+=,.@:/-]+$`)
+
+func ValidateExternalID(externalID string) error {
+	if len(externalID) < 2 || len(externalID) > 1224 || !externalIDPattern.MatchString(externalID) {
+		return errors.New("The external ID must be 2-1224 characters of letters, digits and +=,.@:/-")
+	}
+	return nil
+}
+
+// AssumeChainedRole assumes the role by the credentials of the web identity session, for the roles which trust
+// only another role, e.g. in the other accounts. The external ID is required when the trust policy of the role
+// has the sts:ExternalId condition. The chained session is up to 1 hour by AWS.
+func AssumeChainedRole(client *OIDCClient, cred *AWSCredentials, roleArn, externalID string) (*AWSCredentials, error) {
+	if err := ValidateRoleArn(roleArn); err != nil {
+		return nil, err
+	}
+	if err := CheckAllowedRole(client, roleArn); err != nil {
+		return nil, err
+	}
+	svc, err := newSTSClient(client, aws.NewConfig().WithCredentials(credentials.NewStaticCredentialsFromCreds(credentials.Value{
+		AccessKeyID:     cred.AWSAccessKey,
+		SecretAccessKey: cred.AWSSecretKey,
+		SessionToken:    cred.AWSSessionToken,
+	})))
+	if err != nil {
+		return nil, err
+	}
+
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(roleArn),
+		RoleSessionName: aws.String(client.config.GetString(AWS_FEDERATION_ROLE_SESSION_NAME)),
+	}
+	if externalID != "" {
+		if err := ValidateExternalID(externalID); err != nil {
+			return nil, err
+		}
+		input.ExternalId = aws.String(externalID)
+	}
+
+	Writeln("Assuming the chained role %s", roleArn)
+	resp, err := svc.AssumeRoleWithContext(runContext(), input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error assuming the chained role %s", roleArn)
+	}
+	return &AWSCredentials{
+		AWSAccessKey:    aws.StringValue(resp.Credentials.AccessKeyId),
+		AWSSecretKey:    aws.StringValue(resp.Credentials.SecretAccessKey),
+		AWSSessionToken: aws.StringValue(resp.Credentials.SessionToken),
+		PrincipalARN:    aws.StringValue(resp.AssumedRoleUser.Arn),
+		Expires:         resp.Credentials.Expiration.Local(),
+		// The chained session is authorized by the same login
+		Scope:        cred.Scope,
+		GrantedScope: cred.GrantedScope,
+	}, nil
+}
@@ -3,6 +3,8 @@ package lib
 import (
 	"net/url"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -17,6 +19,7 @@ type OIDCMetadataResponse struct {
 	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
 	TokenEndpoint                              string   `json:"token_endpoint"`
 	TokenIntrospectionEndpoint                 string   `json:"token_introspection_endpoint"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
 	UserinfoEndpoint                           string   `json:"userinfo_endpoint"`
 	EndSessionEndpoint                         string   `json:"end_session_endpoint"`
 	JwksURI                                    string   `json:"jwks_uri"`
@@ -39,27 +42,67 @@ type OIDCMetadataResponse struct {
 	RequestURIParameterSupported               bool     `json:"request_uri_parameter_supported"`
 	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
 	TLSClientCertificateBoundAccessTokens      bool     `json:"tls_client_certificate_bound_access_tokens"`
+	DeviceAuthorizationEndpoint                string   `json:"device_authorization_endpoint"`
+	AuthorizationResponseIssParameterSupported bool     `json:"authorization_response_iss_parameter_supported"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint"`
 }
 
 type OIDCClient struct {
+	name       string
 	restClient *RestClient
 	base       *WebTarget
 	config     *viper.Viper
 	metadata   *OIDCMetadataResponse
+	// userinfo is cached for the session
+	userinfo JWTClaims
 }
 
 func CheckInstalled(name string) (*OIDCClient, error) {
+	return CheckInstalledWithOverrides(name, nil)
+}
+
+// CheckInstalledWithOverrides overrides the provider config for this run only, the config file isn't changed.
+func CheckInstalledWithOverrides(name string, overrides map[string]string) (*OIDCClient, error) {
 	ui := &input.UI{
 		Writer: os.Stdout,
 		Reader: os.Stdin,
 	}
 
-	return InitializeClient(ui, name)
+	return InitializeClient(ui, name, overrides)
 }
 
-func InitializeClient(ui *input.UI, name string) (*OIDCClient, error) {
+// errProviderNotConfigured is returned by prepareProviderConfig when the provider is neither in the config nor ad-hoc
+var errProviderNotConfigured = errors.New("The OIDC provider is not configured")
+
+// prepareProviderConfig returns the config of the provider with the overrides applied, as get-cred uses it.
+// It requests nothing, so that config show resolves the same config.
+func prepareProviderConfig(name string, overrides map[string]string) (*viper.Viper, error) {
 	config := viper.Sub(name)
+	if config == nil && overrides[OIDC_PROVIDER_METADATA_URL] != "" {
+		// Ad-hoc provider which is given by the overrides only
+		config = viper.New()
+	}
 	if config == nil {
+		return nil, errors.Wrap(errProviderNotConfigured, name)
+	}
+	useProviderRegionAsFallback(config)
+	for key, value := range overrides {
+		if value != "" {
+			config.Set(key, value)
+		}
+	}
+	// AssumeRoleWithWebIdentity has no Tags parameter, STS takes the session tags only from
+	// the https://aws.amazon.com/tags claim which the OIDC provider signs into the token.
+	// It's rejected before the login rather than after it.
+	if config.IsSet(SESSION_TAGS_FROM_CLAIMS) {
+		return nil, errors.Errorf("%s is not supported: AssumeRoleWithWebIdentity can't set session tags, configure the OIDC provider to issue the https://aws.amazon.com/tags claim instead", SESSION_TAGS_FROM_CLAIMS)
+	}
+	return config, nil
+}
+
+func InitializeClient(ui *input.UI, name string, overrides map[string]string) (*OIDCClient, error) {
+	config, err := prepareProviderConfig(name, overrides)
+	if errors.Cause(err) == errProviderNotConfigured {
 		answer, _ := ui.Ask("OIDC provider URL is not set. Do you want to setup the configuration? [Y/n]", &input.Options{
 			Default: "Y",
 			Loop:    true,
@@ -73,15 +116,56 @@ func InitializeClient(ui *input.UI, name string) (*OIDCClient, error) {
 		if answer == "n" {
 			return nil, errors.New("Failed to initialize client because of no OIDC provider URL")
 		}
-		RunSetup(ui)
+		RunSetup(ui, nil)
+		config, err = prepareProviderConfig(name, overrides)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := resolveVaultReferences(config); err != nil {
+		return nil, err
 	}
 	providerURL := config.GetString(OIDC_PROVIDER_METADATA_URL)
+	if err := ValidateMetadataURL(providerURL, config.GetBool(ALLOW_INSECURE_METADATA)); err != nil {
+		return nil, err
+	}
 
-	restClient, err := NewRestClient(&RestClientConfig{})
+	restClient, err := NewRestClient(&RestClientConfig{
+		Timeout:             time.Duration(config.GetInt64(HTTP_TIMEOUT)) * time.Second,
+		DialTimeout:         time.Duration(config.GetInt64(DIAL_TIMEOUT)) * time.Second,
+		TLSHandshakeTimeout: time.Duration(config.GetInt64(TLS_HANDSHAKE_TIMEOUT)) * time.Second,
+		Proxy:               config.GetString(OIDC_HTTP_PROXY),
+	})
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to initialize HTTP client for the OIDC provider")
 	}
 	base := restClient.Target(providerURL)
+	metadata := loadCachedDiscovery(providerURL, discoveryCacheTTL(config))
+	if metadata == nil {
+		metadata, err = fetchMetadata(base, providerURL)
+		if err != nil {
+			return nil, err
+		}
+		if discoveryCacheTTL(config) > 0 {
+			saveCachedDiscovery(providerURL, metadata)
+		}
+	}
+
+	client := &OIDCClient{
+		name:       name,
+		restClient: restClient,
+		base:       base,
+		config:     config,
+		metadata:   metadata,
+	}
+
+	if base == nil {
+		return nil, errors.New("Failed to initialize client")
+	}
+	return client, nil
+}
+
+func fetchMetadata(base *WebTarget, providerURL string) (*OIDCMetadataResponse, error) {
 	res, err := base.Request().Get()
 
 	if err != nil {
@@ -105,13 +189,40 @@ func InitializeClient(ui *input.UI, name string) (*OIDCClient, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to parse OIDC metadata response")
 	}
+	if metadata == nil || metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" {
+		return nil, errors.Errorf("%s is not an OIDC discovery document, authorization_endpoint and token_endpoint are required", providerURL)
+	}
+	return metadata, nil
+}
 
-	client := &OIDCClient{restClient, base, config, metadata}
+func (c *OIDCClient) Name() string {
+	return c.name
+}
 
-	if base == nil {
-		return nil, errors.New("Failed to initialize client")
+// Scope returns the requested scope which always includes openid.
+// offline_access is dropped when the refresh token isn't used.
+func (c *OIDCClient) Scope() string {
+	scope := c.config.GetString(SCOPE)
+	if !c.UseRefreshToken() {
+		var scopes []string
+		for _, s := range strings.Fields(scope) {
+			if s != "offline_access" {
+				scopes = append(scopes, s)
+			}
+		}
+		scope = strings.Join(scopes, " ")
 	}
-	return client, nil
+	for _, s := range strings.Fields(scope) {
+		if s == "openid" {
+			return scope
+		}
+	}
+	return strings.TrimSpace("openid " + scope)
+}
+
+// UseRefreshToken tells the refresh token is requested and stored, it's true unless use_refresh_token is false.
+func (c *OIDCClient) UseRefreshToken() bool {
+	return !c.config.IsSet(USE_REFRESH_TOKEN) || c.config.GetBool(USE_REFRESH_TOKEN)
 }
 
 func (c *OIDCClient) ClientForm() url.Values {
@@ -132,3 +243,64 @@ func (c *OIDCClient) Authorization() *WebTarget {
 func (c *OIDCClient) Token() *WebTarget {
 	return c.restClient.Target(c.metadata.TokenEndpoint)
 }
+
+// RevokeRefreshToken invalidates the refresh token by the revocation endpoint (RFC 7009).
+func (c *OIDCClient) RevokeRefreshToken(refreshToken string) error {
+	if c.metadata.RevocationEndpoint == "" {
+		return errors.New("The OIDC provider doesn't support the revocation, no revocation_endpoint in the metadata")
+	}
+	form := c.ClientForm()
+	form.Set("token", refreshToken)
+	form.Set("token_type_hint", "refresh_token")
+
+	res, err := c.restClient.Target(c.metadata.RevocationEndpoint).Request().Form(form).Post()
+	if err != nil {
+		return errors.Wrap(err, "Failed to revoke the refresh token")
+	}
+	if res.Status() != 200 {
+		return errors.Errorf("Failed to revoke the refresh token, statusCode: %d", res.Status())
+	}
+	return nil
+}
+
+// Userinfo fetches the claims from the userinfo endpoint by the access token.
+func (c *OIDCClient) Userinfo(accessToken string) (JWTClaims, error) {
+	if c.userinfo != nil {
+		return c.userinfo, nil
+	}
+	if c.metadata.UserinfoEndpoint == "" {
+		return nil, errors.New("The OIDC provider doesn't have userinfo_endpoint")
+	}
+
+	res, err := c.restClient.Target(c.metadata.UserinfoEndpoint).Request().
+		Header("Authorization", "Bearer "+accessToken).
+		Get()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get userinfo")
+	}
+	if res.Status() != 200 {
+		return nil, errors.Errorf("Failed to get userinfo, statusCode: %d", res.Status())
+	}
+
+	var claims JWTClaims
+	if strings.HasPrefix(res.MediaType(), "application/jwt") {
+		// Signed userinfo response
+		jwt, err := res.ReadText()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read userinfo")
+		}
+		claims, err = ParseJWTClaims(strings.TrimSpace(jwt))
+		if err != nil {
+			return nil, err
+		}
+	} else if err := res.ReadJson(&claims); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse userinfo")
+	}
+
+	c.userinfo = claims
+	return claims, nil
+}
+
+func (c *OIDCClient) DeviceAuthorization() *WebTarget {
+	return c.restClient.Target(c.metadata.DeviceAuthorizationEndpoint)
+}
@@ -0,0 +1,55 @@
+package lib
+
+import (
+	"github.com/pkg/errors"
+)
+
+// GRANT_TYPE_CLIENT_CREDENTIALS gets the token by the client ID and secret without the browser,
+// for the service principals, e.g. on CI
+const GRANT_TYPE_CLIENT_CREDENTIALS = "client_credentials"
+
+// clientCredentialsToken gets the token by the client credentials grant. The provider usually issues no ID token
+// for it, so the access token is used as the web identity token. It must be a JWT which STS can verify.
+func clientCredentialsToken(client *OIDCClient, role *RoleConfig) (*TokenResponse, error) {
+	if !containsString(client.metadata.GrantTypesSupported, GRANT_TYPE_CLIENT_CREDENTIALS) {
+		return nil, errors.Errorf("The OIDC provider doesn't support the client credentials grant, %s isn't in grant_types_supported of the metadata", GRANT_TYPE_CLIENT_CREDENTIALS)
+	}
+	if client.config.GetString(CLIENT_SECRET) == "" {
+		return nil, errors.Errorf("%s is required for the client credentials grant", CLIENT_SECRET)
+	}
+
+	form := client.ClientForm()
+	form.Set("grant_type", GRANT_TYPE_CLIENT_CREDENTIALS)
+	if scope := client.config.GetString(SCOPE); scope != "" {
+		form.Set("scope", scope)
+	}
+	if role.Audience != "" {
+		form.Set("audience", role.Audience)
+	}
+	if role.Resource != "" {
+		form.Set("resource", role.Resource)
+	}
+
+	Traceln("client credentials params: %s", redactValues(form).Encode())
+
+	tokenResponse, err := requestToken(client, form)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get the token by the client credentials grant")
+	}
+	if tokenResponse.IDToken == "" {
+		if _, err := ParseJWTClaims(tokenResponse.AccessToken); err != nil {
+			return nil, errors.Wrap(err, "The access token of the client credentials grant isn't a JWT, STS can't accept it")
+		}
+		tokenResponse.IDToken = tokenResponse.AccessToken
+	}
+	if err := validateSigningAlg(client, tokenResponse.IDToken); err != nil {
+		return nil, err
+	}
+	if err := validateTokenAudience(client, tokenResponse, role); err != nil {
+		return nil, err
+	}
+	if err := validateAuthorizedParty(client, tokenResponse.IDToken); err != nil {
+		return nil, err
+	}
+	return tokenResponse, nil
+}
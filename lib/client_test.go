@@ -0,0 +1,17 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestInitializeClientRejectsSessionTagsFromClaims(t *testing.T) {
+	// It fails before the discovery, so the OIDC provider isn't requested
+	_, err := InitializeClient(nil, "session-tags-test", map[string]string{
+		OIDC_PROVIDER_METADATA_URL: "https://idp.invalid/.well-known/openid-configuration",
+		SESSION_TAGS_FROM_CLAIMS:   "department",
+	})
+	if err == nil || !strings.Contains(err.Error(), SESSION_TAGS_FROM_CLAIMS) {
+		t.Errorf("%s should be rejected, got %v", SESSION_TAGS_FROM_CLAIMS, err)
+	}
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DEFAULT_CLOCK_SKEW_TOLERANCE = 60 * time.Second
+
+// measureClockSkew compares the Date header of the OIDC provider with the local clock at the middle of the
+// request. It's positive when the local clock is behind. The Date header has the resolution of a second.
+func measureClockSkew(client *OIDCClient) (time.Duration, error) {
+	target := client.metadata.JwksURI
+	if target == "" {
+		target = client.config.GetString(OIDC_PROVIDER_METADATA_URL)
+	}
+	sent := time.Now()
+	res, err := client.restClient.Target(target).Request().Get()
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to request the OIDC provider for the clock")
+	}
+	received := time.Now()
+	io.Copy(ioutil.Discard, res.res.Body)
+	res.res.Body.Close()
+
+	date := res.Header("Date")
+	if date == "" {
+		return 0, errors.New("The OIDC provider doesn't return the Date header")
+	}
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to parse the Date header: %s", date)
+	}
+	local := sent.Add(received.Sub(sent) / 2)
+	return serverTime.Sub(local.Truncate(time.Second)), nil
+}
+
+func clockSkewTolerance(client *OIDCClient) time.Duration {
+	if client.config.IsSet(CLOCK_SKEW_SECONDS) {
+		return time.Duration(client.config.GetInt64(CLOCK_SKEW_SECONDS)) * time.Second
+	}
+	return DEFAULT_CLOCK_SKEW_TOLERANCE
+}
+
+// checkClockSkew fails when the local clock is off from the OIDC provider beyond clock_skew_seconds, since STS
+// rejects the token which looks issued in the future or expired by InvalidIdentityToken.
+func checkClockSkew(client *OIDCClient) error {
+	skew, err := measureClockSkew(client)
+	if err != nil {
+		return err
+	}
+	return clockSkewError(client, skew)
+}
+
+func clockSkewError(client *OIDCClient, skew time.Duration) error {
+	Traceln("The clock skew from the OIDC provider: %s", skew)
+	tolerance := clockSkewTolerance(client)
+	if skew <= tolerance && -skew <= tolerance {
+		return nil
+	}
+	direction := "behind"
+	if skew < 0 {
+		direction = "ahead of"
+		skew = -skew
+	}
+	return errors.Errorf("The local clock is %s %s the OIDC provider, beyond %s (%s). STS may reject the token by InvalidIdentityToken, sync the clock, e.g. by NTP",
+		skew, direction, CLOCK_SKEW_SECONDS, tolerance)
+}
+
+// preloginClockCheck checks the clock before the login when clock_skew_seconds or strict_clock is configured.
+// The skew is warned, or fails the login with strict_clock. The failure of the measurement doesn't block the login.
+func preloginClockCheck(client *OIDCClient) error {
+	strict := client.config.GetBool(STRICT_CLOCK)
+	if !strict && !client.config.IsSet(CLOCK_SKEW_SECONDS) {
+		return nil
+	}
+	skew, err := measureClockSkew(client)
+	if err != nil {
+		Writeln("Can't check the clock: %v", err)
+		return nil
+	}
+	if err := clockSkewError(client, skew); err != nil {
+		if strict {
+			return err
+		}
+		Writeln("Warning: %v", err)
+	}
+	return nil
+}
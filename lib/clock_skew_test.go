@@ -0,0 +1,107 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newClockClient returns the client of the OIDC provider whose clock is off by the skew, without the Date header if omitDate.
+func newClockClient(t *testing.T, skew time.Duration, omitDate bool, settings map[string]interface{}) *OIDCClient {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if omitDate {
+			w.Header()["Date"] = nil
+		} else {
+			w.Header().Set("Date", time.Now().Add(skew).UTC().Format(http.TimeFormat))
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(server.Close)
+
+	restClient, err := NewRestClient(&RestClientConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newTestClient(settings)
+	client.config.Set(OIDC_PROVIDER_METADATA_URL, server.URL)
+	client.restClient = restClient
+	client.metadata = &OIDCMetadataResponse{}
+	return client
+}
+
+func TestMeasureClockSkew(t *testing.T) {
+	for _, want := range []time.Duration{0, 5 * time.Minute, -5 * time.Minute} {
+		skew, err := measureClockSkew(newClockClient(t, want, false, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The Date header has the resolution of a second
+		if diff := skew - want; diff < -2*time.Second || diff > 2*time.Second {
+			t.Errorf("measureClockSkew() = %s, want about %s", skew, want)
+		}
+	}
+
+	if _, err := measureClockSkew(newClockClient(t, 0, true, nil)); err == nil || !strings.Contains(err.Error(), "Date header") {
+		t.Errorf("The missing Date header should fail the measurement, got %v", err)
+	}
+}
+
+func TestClockSkewErrorTolerance(t *testing.T) {
+	client := newTestClient(map[string]interface{}{CLOCK_SKEW_SECONDS: 60})
+	tests := []struct {
+		skew    time.Duration
+		wantErr string
+	}{
+		{60 * time.Second, ""},
+		{-60 * time.Second, ""},
+		{61 * time.Second, "behind"},
+		{-61 * time.Second, "ahead of"},
+	}
+	for _, tt := range tests {
+		err := clockSkewError(client, tt.skew)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("clockSkewError(%s) should be within the tolerance, got %v", tt.skew, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("clockSkewError(%s) = %v, want the clock %s", tt.skew, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPreloginClockCheck(t *testing.T) {
+	origQuiet := IsQuiet
+	IsQuiet = false
+	defer func() { IsQuiet = origQuiet }()
+
+	tests := []struct {
+		name       string
+		skew       time.Duration
+		omitDate   bool
+		strict     bool
+		wantErr    bool
+		wantStderr string
+	}{
+		{"within the tolerance", 10 * time.Second, false, true, false, ""},
+		{"warn mode", 5 * time.Minute, false, false, false, "Warning: The local clock is"},
+		{"strict_clock", 5 * time.Minute, false, true, true, ""},
+		{"missing Date header", 0, true, true, false, "Can't check the clock"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newClockClient(t, tt.skew, tt.omitDate, map[string]interface{}{CLOCK_SKEW_SECONDS: 60, STRICT_CLOCK: tt.strict})
+			var err error
+			stderr := captureStderr(t, func() {
+				err = preloginClockCheck(client)
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("preloginClockCheck() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantStderr != "" && !strings.Contains(stderr, tt.wantStderr) {
+				t.Errorf("The stderr should have %q: %q", tt.wantStderr, stderr)
+			}
+		})
+	}
+}
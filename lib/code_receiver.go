@@ -0,0 +1,839 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	input "github.com/natsukagami/go-input"
+	"github.com/pkg/browser"
+	"github.com/pkg/errors"
+	"github.com/skip2/go-qrcode"
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_CALLBACK_PORT = "8118"
+
+// openBrowser is replaced by selftest to follow the redirects without a browser
+var openBrowser = browser.OpenURL
+
+// The hint to open the URL manually is printed when the browser doesn't reach the callback within it
+const DEFAULT_FIRST_CONTACT_TIMEOUT = 30 * time.Second
+
+// DEFAULT_REDIRECT_CAPTURE_TIMEOUT bounds the wait for the authorization response after the browser reached the server
+const DEFAULT_REDIRECT_CAPTURE_TIMEOUT = 10 * time.Second
+
+// Login flows
+const LOGIN_FLOW_LOOPBACK = "loopback"
+const LOGIN_FLOW_MANUAL = "manual"
+const LOGIN_FLOW_DEVICE = "device"
+
+// LOGIN_FLOW_AUTO is the default, it chooses loopback unless the environment is headless
+const LOGIN_FLOW_AUTO = "auto"
+
+// CodeReceiver captures the authorization code which the OIDC provider returns to the redirect URI.
+type CodeReceiver interface {
+	// RedirectURI is sent as redirect_uri in both the authorization request and the token request.
+	RedirectURI() string
+	// Receive leads the user to the authorization URL and waits for the authorization response.
+	Receive(authURL string) (*AuthorizationResponse, error)
+	Close() error
+}
+
+// AuthorizationResponse is the parameters of the redirect from the OIDC provider.
+type AuthorizationResponse struct {
+	Code  string
+	State string
+	// Issuer is the iss parameter of RFC 9207, empty when the OIDC provider doesn't send it
+	Issuer string
+}
+
+// AuthorizationError is the error response of the authorization request.
+type AuthorizationError struct {
+	Code        string
+	Description string
+	// CorrelationID is shown on the callback page too, empty when the response isn't received by the callback server
+	CorrelationID string
+}
+
+func (e *AuthorizationError) Error() string {
+	msg := fmt.Sprintf("Login failed, error: %s error_description: %s", e.Code, e.Description)
+	if e.CorrelationID != "" {
+		msg += fmt.Sprintf(" (correlation ID: %s)", e.CorrelationID)
+	}
+	return msg
+}
+
+// isInteractionRequired tells whether the error of prompt=none needs the user to interact (OpenID Connect Core 3.1.2.6).
+func isInteractionRequired(code string) bool {
+	switch code {
+	case "login_required", "interaction_required", "consent_required", "account_selection_required":
+		return true
+	}
+	return false
+}
+
+func parseAuthorizationResponse(q url.Values) (*AuthorizationResponse, error) {
+	if e := q.Get("error"); e != "" {
+		return nil, &AuthorizationError{Code: e, Description: q.Get("error_description")}
+	}
+	return &AuthorizationResponse{
+		Code:   q.Get("code"),
+		State:  q.Get("state"),
+		Issuer: q.Get("iss"),
+	}, nil
+}
+
+// tokenReceiver is implemented by the receivers which obtain the tokens without the authorization code.
+type tokenReceiver interface {
+	ReceiveToken() (*TokenResponse, error)
+}
+
+func NewCodeReceiver(client *OIDCClient, flow string, role *RoleConfig) (CodeReceiver, error) {
+	if flow == "" || flow == LOGIN_FLOW_AUTO {
+		flow = detectLoginFlow(client)
+	}
+	switch flow {
+	case LOGIN_FLOW_LOOPBACK:
+		return NewLoopbackReceiver(client)
+	case LOGIN_FLOW_MANUAL:
+		return NewManualReceiver(client), nil
+	case LOGIN_FLOW_DEVICE:
+		return NewDeviceReceiver(client, role)
+	}
+	return nil, errors.Errorf("Unknown %s: %s", LOGIN_FLOW, flow)
+}
+
+// detectLoginFlow avoids the browser where it can't be opened for the user: an SSH session,
+// or no display on Linux and BSD. Then the device flow is preferred if the OIDC provider supports it.
+func detectLoginFlow(client *OIDCClient) string {
+	if !isHeadless() {
+		return LOGIN_FLOW_LOOPBACK
+	}
+	if client.metadata.DeviceAuthorizationEndpoint != "" {
+		Writeln("No browser is available, using the device flow")
+		return LOGIN_FLOW_DEVICE
+	}
+	Writeln("No browser is available, using the manual flow")
+	return LOGIN_FLOW_MANUAL
+}
+
+func isHeadless() bool {
+	if os.Getenv("SSH_CONNECTION") != "" || os.Getenv("SSH_TTY") != "" {
+		return true
+	}
+	switch runtime.GOOS {
+	case "windows", "darwin":
+		return false
+	}
+	return os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == ""
+}
+
+// LoopbackReceiver receives the redirect by the local http server.
+// When redirect_uri is configured with an external URL, the user needs to run a reverse tunnel
+// which forwards the URL to the callback port.
+type LoopbackReceiver struct {
+	listener            net.Listener
+	redirectURI         string
+	firstContactTimeout time.Duration
+	// redirectCaptureTimeout starts on the first bytes of a request to the server, unlike the login by the user.
+	// A bare connection doesn't start it, since browsers preconnect to the hosts they expect to visit
+	redirectCaptureTimeout time.Duration
+	successPage            *successPage
+	// basePath is where the handler is mounted behind the reverse proxy which strips its own path prefix
+	basePath string
+	// removeTimeoutCleanup unregisters Close from the cleanups on --timeout
+	removeTimeoutCleanup func()
+	// retryBrowser asks whether the browser opened the login page when it hasn't returned within firstContactTimeout,
+	// then offers browserCommand
+	retryBrowser   bool
+	browserCommand string
+	// reuseTab keeps the success page open to receive the authorization URL of the next login
+	reuseTab bool
+	// closing ends the long-polls of the tab, the shutdown waits for them otherwise
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	// The server is started by the first Receive and serves the following ones until Close
+	startOnce sync.Once
+	srv       *http.Server
+	mu        sync.Mutex
+	attempt   *loopbackAttempt
+}
+
+// loopbackAttempt is the state of a Receive.
+type loopbackAttempt struct {
+	responses   chan *callbackResponse
+	contacted   chan struct{}
+	contactOnce sync.Once
+	// offers hands the authorization URL to the tab of the previous login which polls tabHandoffPath
+	offers chan string
+}
+
+// tabHandoffPath is polled by the success page of reuse_browser_tab, on the same origin as the callback
+const tabHandoffPath = "/aws-cli-oidc/next"
+
+// tabHandoffWait is how long the login waits for the tab of the previous login before opening the browser.
+// The tab polls every second while no login is running.
+const tabHandoffWait = 3 * time.Second
+
+// tabHandoffPoll is the long-poll of the tab
+const tabHandoffPoll = 25 * time.Second
+
+const tabHandoffScript = `<script>
+(function poll() {
+  fetch("` + tabHandoffPath + `", {cache: "no-store"})
+    .then(function (res) { return res.status === 200 ? res.text() : ""; })
+    .then(function (url) { if (url) { location.href = url; } else { poll(); } })
+    .catch(function () { setTimeout(poll, 1000); });
+})();
+</script>
+`
+
+func (a *loopbackAttempt) contact() {
+	a.contactOnce.Do(func() { close(a.contacted) })
+}
+
+// callbackResponse is the redirect to the callback server. The failed one has the correlation ID shown on the page.
+type callbackResponse struct {
+	query         url.Values
+	correlationID string
+}
+
+func (c *callbackResponse) parse() (*AuthorizationResponse, error) {
+	authRes, err := parseAuthorizationResponse(c.query)
+	var authErr *AuthorizationError
+	if errors.As(err, &authErr) {
+		authErr.CorrelationID = c.correlationID
+	} else if err == nil && authRes.Code == "" {
+		return nil, errors.Errorf("Login failed, can't retrieve authorization code (correlation ID: %s)", c.correlationID)
+	}
+	return authRes, err
+}
+
+// successPage is the response to the browser after the successful login.
+type successPage struct {
+	message string
+	status  int
+	// redirect is the Location of the 3xx status
+	redirect string
+}
+
+func newSuccessPage(client *OIDCClient) (*successPage, error) {
+	page := &successPage{
+		message:  "Login successful",
+		status:   http.StatusOK,
+		redirect: client.config.GetString(CALLBACK_SUCCESS_REDIRECT),
+	}
+	if message := client.config.GetString(CALLBACK_SUCCESS_MESSAGE); message != "" {
+		page.message = message
+	}
+	if client.config.IsSet(CALLBACK_SUCCESS_STATUS) {
+		page.status = client.config.GetInt(CALLBACK_SUCCESS_STATUS)
+	} else if page.redirect != "" {
+		page.status = http.StatusFound
+	}
+
+	switch {
+	case page.status >= 300 && page.status < 400:
+		if page.redirect == "" {
+			return nil, errors.Errorf("%s is required for %s %d", CALLBACK_SUCCESS_REDIRECT, CALLBACK_SUCCESS_STATUS, page.status)
+		}
+	case page.status >= 200 && page.status < 300:
+	default:
+		return nil, errors.Errorf("%s must be 2xx or 3xx: %d", CALLBACK_SUCCESS_STATUS, page.status)
+	}
+	return page, nil
+}
+
+// NewLoopbackReceiver binds the first redirect URI candidate which can be served.
+func NewLoopbackReceiver(client *OIDCClient) (*LoopbackReceiver, error) {
+	candidates, port := redirectURICandidates(client.config)
+
+	page, err := newSuccessPage(client)
+	if err != nil {
+		return nil, err
+	}
+
+	callbackHost := client.config.GetString(CALLBACK_HOST)
+	if callbackHost == "" {
+		callbackHost = "127.0.0.1"
+	}
+	allowNonLoopback := client.config.GetBool(ALLOW_NON_LOOPBACK_CALLBACK)
+	basePath := callbackBasePath(client.config)
+
+	var attempts []string
+	for _, redirectURI := range candidates {
+		addr, tunneled, err := callbackAddress(redirectURI, callbackHost, port, basePath)
+		if err != nil {
+			attempts = append(attempts, fmt.Sprintf("  %s: %v", redirectURI, err))
+			continue
+		}
+		if err := checkLoopbackAddress(addr, allowNonLoopback); err != nil {
+			attempts = append(attempts, fmt.Sprintf("  %s: %v", redirectURI, err))
+			continue
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			attempts = append(attempts, fmt.Sprintf("  %s: %v", redirectURI, err))
+			continue
+		}
+
+		if tunneled {
+			Writeln("Waiting for the redirect to %s through your tunnel to %s", redirectURI, addr)
+		}
+		firstContactTimeout := DEFAULT_FIRST_CONTACT_TIMEOUT
+		if client.config.IsSet(FIRST_CONTACT_TIMEOUT) {
+			firstContactTimeout = time.Duration(client.config.GetInt64(FIRST_CONTACT_TIMEOUT)) * time.Second
+		}
+		redirectCaptureTimeout := DEFAULT_REDIRECT_CAPTURE_TIMEOUT
+		if client.config.IsSet(REDIRECT_CAPTURE_TIMEOUT) {
+			redirectCaptureTimeout = time.Duration(client.config.GetInt64(REDIRECT_CAPTURE_TIMEOUT)) * time.Second
+		}
+		r := &LoopbackReceiver{
+			listener:               listener,
+			redirectURI:            redirectURI,
+			firstContactTimeout:    firstContactTimeout,
+			redirectCaptureTimeout: redirectCaptureTimeout,
+			successPage:            page,
+			basePath:               basePath,
+			closing:                make(chan struct{}),
+		}
+		r.removeTimeoutCleanup = onTimeout(func() { r.Close() })
+		// The redirect leaves the page, so there is no tab to reuse
+		r.reuseTab = client.config.GetBool(REUSE_BROWSER_TAB) && page.redirect == ""
+		if r.reuseTab && basePath != "" {
+			// The tab can't know the path prefix of the proxy to poll
+			Traceln("%s is ignored with %s", REUSE_BROWSER_TAB, CALLBACK_BASE_PATH)
+			r.reuseTab = false
+		}
+		r.retryBrowser = client.config.GetBool(RETRY_BROWSER) && isInteractive()
+		r.browserCommand = client.config.GetString(BROWSER_COMMAND)
+		return r, nil
+	}
+
+	return nil, errors.Errorf("Cannot start local http server to handle login redirect, tried:\n%s", strings.Join(attempts, "\n"))
+}
+
+// redirectURICandidates returns the redirect URIs to try in order and the callback port.
+func redirectURICandidates(config *viper.Viper) ([]string, string) {
+	port := config.GetString(CALLBACK_PORT)
+	if port == "" {
+		port = DEFAULT_CALLBACK_PORT
+	}
+
+	candidates := config.GetStringSlice(REDIRECT_URIS)
+	if len(candidates) == 0 {
+		redirectURI := config.GetString(REDIRECT_URI)
+		if redirectURI == "" {
+			redirectURI = "http://localhost:" + port
+		}
+		candidates = []string{redirectURI}
+	}
+	return candidates, port
+}
+
+// callbackBasePath returns callback_base_path of the provider config without the trailing slash.
+func callbackBasePath(config *viper.Viper) string {
+	basePath := strings.TrimRight(config.GetString(CALLBACK_BASE_PATH), "/")
+	if basePath != "" && !strings.HasPrefix(basePath, "/") {
+		basePath = "/" + basePath
+	}
+	return basePath
+}
+
+// callbackAddress resolves the local address to serve the redirect URI.
+// A non-loopback redirect URI is expected to be forwarded to the callback host and port by a tunnel,
+// so is any redirect URI with the base path, which is fronted by a reverse proxy.
+func callbackAddress(redirectURI string, callbackHost string, callbackPort string, basePath string) (string, bool, error) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return "", false, err
+	}
+	if basePath != "" {
+		if !strings.Contains(u.Path, basePath) {
+			return "", false, errors.Errorf("The path of the redirect URI must have %s %s after the prefix of the proxy", CALLBACK_BASE_PATH, basePath)
+		}
+		return net.JoinHostPort(callbackHost, callbackPort), true, nil
+	}
+
+	host := u.Hostname()
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return net.JoinHostPort(callbackHost, callbackPort), true, nil
+	}
+
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	if host == "localhost" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), false, nil
+}
+
+// checkLoopbackAddress refuses to serve the callback on an address reachable from other hosts,
+// which could capture the authorization code, unless it's explicitly allowed.
+func checkLoopbackAddress(addr string, allowNonLoopback bool) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if isLoopbackHost(host) {
+		return nil
+	}
+	if !allowNonLoopback {
+		return errors.Errorf("%s is not a loopback address, the authorization code could be captured by other hosts. Set %s to allow it", host, ALLOW_NON_LOOPBACK_CALLBACK)
+	}
+	Writeln("WARNING: The callback server listens on %s which is not a loopback address. Other hosts on the network may capture the authorization code.", addr)
+	return nil
+}
+
+// isLoopbackHost reports whether the host is a loopback IP, or the name which resolves only to loopback IPs, e.g. localhost.
+func isLoopbackHost(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *LoopbackReceiver) RedirectURI() string {
+	return r.redirectURI
+}
+
+// Receive can be called again on the same server, e.g. when the silent login escalates to the interactive one.
+func (r *LoopbackReceiver) Receive(authURL string) (*AuthorizationResponse, error) {
+	attempt := &loopbackAttempt{
+		responses: make(chan *callbackResponse, 1),
+		contacted: make(chan struct{}),
+		offers:    make(chan string),
+	}
+	r.mu.Lock()
+	r.attempt = attempt
+	r.mu.Unlock()
+
+	r.startOnce.Do(func() {
+		r.srv = &http.Server{
+			Handler: http.HandlerFunc(r.handle),
+		}
+		listener := &requestListener{Listener: r.listener, onRequest: func() {
+			// The long-polls of the tab to reuse aren't the redirect
+			if !r.reuseTab {
+				r.mu.Lock()
+				attempt := r.attempt
+				r.mu.Unlock()
+				attempt.contact()
+			}
+		}}
+		go func() {
+			if err := r.srv.Serve(listener); err != nil {
+				// cannot panic, because this probably is an intentional close
+			}
+		}()
+	})
+
+	if r.handOffToTab(attempt, authURL) {
+		Writeln("Continuing the login on the browser tab of the previous login")
+	} else if err := openBrowser(authURL); err != nil {
+		Writeln("Failed to open the browser: %v", err)
+		Writeln("Open the following URL manually:\n\n%s\n", authURL)
+	}
+
+	ctx := runContext()
+	contacted := attempt.contacted
+	var firstContact, capture <-chan time.Time
+	if r.firstContactTimeout > 0 {
+		firstContact = time.After(r.firstContactTimeout)
+	}
+	for {
+		select {
+		case c := <-attempt.responses:
+			return c.parse()
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "Login was not completed")
+		case <-contacted:
+			contacted, firstContact = nil, nil
+			if r.redirectCaptureTimeout > 0 {
+				capture = time.After(r.redirectCaptureTimeout)
+			}
+		case <-firstContact:
+			firstContact = nil
+			if r.retryBrowser {
+				// Asked synchronously, so that no reader of stdin is left to compete with the next prompts,
+				// e.g. the role menu. The redirect which arrives while asking is received after the answer.
+				retryBrowser(authURL, r.browserCommand, attempt.contacted)
+				continue
+			}
+			// The browser may not be opened, or the redirect can't reach here, e.g. the port isn't forwarded
+			Writeln("The browser hasn't returned to %s yet. If nothing happened, open the following URL manually:\n\n%s\n", r.redirectURI, authURL)
+		case <-capture:
+			return nil, errors.Errorf("The browser reached %s but didn't deliver the authorization response within %s, set %s to wait longer",
+				r.redirectURI, r.redirectCaptureTimeout, REDIRECT_CAPTURE_TIMEOUT)
+		}
+	}
+}
+
+// requestListener calls onRequest when a connection reads the first bytes, i.e. the request is arriving.
+// The handler can't see the request which is stuck before the end of the headers.
+type requestListener struct {
+	net.Listener
+	onRequest func()
+}
+
+func (l *requestListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &requestConn{Conn: conn, onRequest: l.onRequest}, nil
+}
+
+type requestConn struct {
+	net.Conn
+	onRequest func()
+	once      sync.Once
+}
+
+func (c *requestConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(c.onRequest)
+	}
+	return n, err
+}
+
+// handOffToTab offers the authorization URL to the tab of the previous login for a while.
+func (r *LoopbackReceiver) handOffToTab(attempt *loopbackAttempt, authURL string) bool {
+	if !r.reuseTab {
+		return false
+	}
+	select {
+	case attempt.offers <- authURL:
+		return true
+	case <-time.After(tabHandoffWait):
+		return false
+	}
+}
+
+// handleTabHandoff answers the long-poll of the tab with the authorization URL, or 204 when no login offers it.
+func (r *LoopbackReceiver) handleTabHandoff(res http.ResponseWriter, req *http.Request, attempt *loopbackAttempt) {
+	res.Header().Set("Cache-Control", "no-store")
+	select {
+	case authURL := <-attempt.offers:
+		res.Header().Set("Content-Type", "text/plain")
+		res.Write([]byte(authURL))
+	case <-time.After(tabHandoffPoll):
+		res.WriteHeader(http.StatusNoContent)
+	case <-r.closing:
+		res.WriteHeader(http.StatusNoContent)
+	case <-req.Context().Done():
+	}
+}
+
+func (r *LoopbackReceiver) handle(res http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	attempt := r.attempt
+	r.mu.Unlock()
+	if r.reuseTab && req.URL.Path == tabHandoffPath {
+		r.handleTabHandoff(res, req, attempt)
+		return
+	}
+	attempt.contact()
+	if r.basePath != "" && req.URL.Path != r.basePath && !strings.HasPrefix(req.URL.Path, r.basePath+"/") {
+		// e.g. the proxy didn't strip its prefix, which is not the redirect
+		Traceln("Ignoring the request to %s out of %s %s", req.URL.Path, CALLBACK_BASE_PATH, r.basePath)
+		http.NotFound(res, req)
+		return
+	}
+
+	q := req.URL.Query()
+	code := q.Get("code")
+
+	res.Header().Set("Content-Type", "text/html")
+
+	// Response result page
+	message := "Login failed"
+	status := http.StatusOK
+	callback := &callbackResponse{query: q}
+	if code == "" {
+		callback.correlationID = newCorrelationID()
+		Traceln("Login failed, correlation ID: %s state: %s error: %s error_description: %s",
+			callback.correlationID, q.Get("state"), q.Get("error"), q.Get("error_description"))
+	}
+	var detail string
+	if code != "" {
+		message = r.successPage.message
+		status = r.successPage.status
+		if r.successPage.redirect != "" {
+			res.Header().Set("Location", r.successPage.redirect)
+		}
+	} else if isInteractionRequired(q.Get("error")) {
+		message = "Login is required, continuing to the login page"
+	} else {
+		detail = fmt.Sprintf("<p>Correlation ID: <code>%s</code></p>\n", html.EscapeString(callback.correlationID))
+	}
+	res.Header().Set("Cache-Control", "no-store")
+	res.Header().Set("Pragma", "no-cache")
+	res.WriteHeader(status)
+	// The failure page is kept open so that the user can quote the correlation ID
+	closeScript := "<script>\nwindow.close()\n</script>\n"
+	if detail != "" {
+		closeScript = ""
+	} else if code != "" && r.reuseTab {
+		closeScript = tabHandoffScript
+	}
+	res.Write([]byte(fmt.Sprintf(`<!DOCTYPE html>
+%s<body>
+%s
+%s</body>
+</html>
+`, closeScript, html.EscapeString(message), detail)))
+
+	if f, ok := res.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Only the first redirect matters, e.g. ignore the favicon request
+	select {
+	case attempt.responses <- callback:
+	default:
+	}
+}
+
+func (r *LoopbackReceiver) Close() error {
+	r.removeTimeoutCleanup()
+	r.closeOnce.Do(func() { close(r.closing) })
+	if r.srv == nil {
+		return r.listener.Close()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := r.srv.Shutdown(ctx)
+	if err == context.DeadlineExceeded {
+		// e.g. the connection of the browser which never sent the request
+		return r.srv.Close()
+	}
+	return err
+}
+
+// ManualReceiver lets the user open the authorization URL on any browser and paste the redirected URL or the code.
+type ManualReceiver struct {
+	ui          *input.UI
+	redirectURI string
+}
+
+func NewManualReceiver(client *OIDCClient) *ManualReceiver {
+	redirectURI := client.config.GetString(REDIRECT_URI)
+	if redirectURI == "" {
+		redirectURI = "http://localhost:" + DEFAULT_CALLBACK_PORT
+	}
+	return &ManualReceiver{
+		ui: &input.UI{
+			Writer: os.Stderr,
+			Reader: os.Stdin,
+		},
+		redirectURI: redirectURI,
+	}
+}
+
+func (r *ManualReceiver) RedirectURI() string {
+	return r.redirectURI
+}
+
+func (r *ManualReceiver) Receive(authURL string) (*AuthorizationResponse, error) {
+	Writeln("Open the following URL in your browser and login:")
+	Writeln("")
+	Writeln("  %s", authURL)
+	Writeln("")
+
+	answer, err := r.ui.Ask("Paste the redirected URL (or the code parameter of it):", &input.Options{
+		Required: true,
+		Loop:     true,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read the authorization code")
+	}
+	authRes, err := parseManualAnswer(strings.TrimSpace(answer))
+	if err == nil && authRes.State == "" && !strings.Contains(answer, "?") {
+		// The code alone was pasted for this request
+		if u, err := url.Parse(authURL); err == nil {
+			authRes.State = u.Query().Get("state")
+		}
+	}
+	return authRes, err
+}
+
+func parseManualAnswer(answer string) (*AuthorizationResponse, error) {
+	if !strings.Contains(answer, "?") {
+		return &AuthorizationResponse{Code: answer}, nil
+	}
+	u, err := url.Parse(answer)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the redirected URL")
+	}
+	return parseAuthorizationResponse(u.Query())
+}
+
+func (r *ManualReceiver) Close() error {
+	return nil
+}
+
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+// DeviceReceiver obtains the tokens by OAuth 2.0 Device Authorization Grant (RFC 8628).
+// It doesn't use the authorization code, so it has no redirect URI.
+type DeviceReceiver struct {
+	client *OIDCClient
+	role   *RoleConfig
+}
+
+func NewDeviceReceiver(client *OIDCClient, role *RoleConfig) (*DeviceReceiver, error) {
+	if client.metadata.DeviceAuthorizationEndpoint == "" {
+		return nil, errors.New("The OIDC provider doesn't support the device flow, no device_authorization_endpoint in the metadata")
+	}
+	return &DeviceReceiver{
+		client: client,
+		role:   role,
+	}, nil
+}
+
+func (r *DeviceReceiver) RedirectURI() string {
+	return ""
+}
+
+func (r *DeviceReceiver) Receive(authURL string) (*AuthorizationResponse, error) {
+	return nil, errors.New("The device flow doesn't use the authorization code")
+}
+
+func (r *DeviceReceiver) ReceiveToken() (*TokenResponse, error) {
+	form := r.client.ClientForm()
+	form.Set("scope", r.client.Scope())
+	if r.role.Audience != "" {
+		form.Set("audience", r.role.Audience)
+	}
+	if r.role.Resource != "" {
+		form.Set("resource", r.role.Resource)
+	}
+
+	res, err := r.client.DeviceAuthorization().Request().Form(form).Post()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to start the device flow")
+	}
+	if res.Status() != 200 {
+		return nil, errors.Errorf("Failed to start the device flow, statusCode: %d", res.Status())
+	}
+
+	var device deviceAuthorizationResponse
+	if err := res.ReadJson(&device); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the device authorization response")
+	}
+
+	r.showVerification(&device)
+
+	interval := time.Duration(device.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(device.ExpiresIn) * time.Second)
+
+	form = r.client.ClientForm()
+	form.Set("grant_type", "urn:ietf:params:oauth:grant-type:device_code")
+	form.Set("device_code", device.DeviceCode)
+
+	for device.ExpiresIn <= 0 || time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		res, err := r.client.Token().Request().Form(form).Post()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to poll the token endpoint")
+		}
+		if res.Status() == 200 {
+			var tokenResponse TokenResponse
+			if err := res.ReadJson(&tokenResponse); err != nil {
+				return nil, errors.Wrap(err, "Failed to parse the token response")
+			}
+			return &tokenResponse, nil
+		}
+
+		var json map[string]interface{}
+		if err := res.ReadJson(&json); err != nil {
+			return nil, errors.Errorf("Failed to poll the token endpoint, statusCode: %d", res.Status())
+		}
+		switch json["error"] {
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, errors.Errorf("Device flow failed, error: %s error_description: %s",
+				json["error"], json["error_description"])
+		}
+	}
+	return nil, errors.New("Device flow failed, the device code has expired")
+}
+
+// showVerification tells the user where to approve the login. verification_uri_complete has the user code in it,
+// so it's preferred to be opened by the browser of this machine or scanned by the phone as the QR code.
+func (r *DeviceReceiver) showVerification(device *deviceAuthorizationResponse) {
+	if device.VerificationURIComplete == "" {
+		Writeln("Open %s in your browser and enter the code: %s", device.VerificationURI, device.UserCode)
+		if r.client.config.GetBool(DEVICE_QR_CODE) {
+			printQRCode(device.VerificationURI)
+		}
+		return
+	}
+
+	// The user code is shown to be checked against the page, not to be typed
+	Writeln("Open %s in your browser and check the code is: %s", device.VerificationURIComplete, device.UserCode)
+	if r.client.config.GetBool(DEVICE_QR_CODE) {
+		printQRCode(device.VerificationURIComplete)
+	}
+	if r.client.config.GetBool(DEVICE_OPEN_BROWSER) {
+		if err := openBrowser(device.VerificationURIComplete); err != nil {
+			Writeln("Failed to open the browser: %v", err)
+		}
+	}
+}
+
+func printQRCode(content string) {
+	qr, err := qrcode.New(content, qrcode.Medium)
+	if err != nil {
+		Traceln("Can't render the QR code: %v", err)
+		return
+	}
+	Writeln("\n%s", qr.ToSmallString(false))
+}
+
+func (r *DeviceReceiver) Close() error {
+	return nil
+}
@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckLoopbackAddress(t *testing.T) {
+	tests := []struct {
+		host             string
+		allowNonLoopback bool
+		wantErr          bool
+	}{
+		{"127.0.0.1", false, false},
+		{"::1", false, false},
+		{"localhost", false, false},
+		{"0.0.0.0", false, true},
+		{"192.0.2.1", false, true},
+		{"192.0.2.1", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			err := checkLoopbackAddress(net.JoinHostPort(tt.host, "8080"), tt.allowNonLoopback)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkLoopbackAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newTestReceiver serves the callback on a free loopback port with the short redirect_capture_timeout.
+func newTestReceiver(t *testing.T) *LoopbackReceiver {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &LoopbackReceiver{
+		listener:               listener,
+		redirectURI:            "http://" + listener.Addr().String(),
+		redirectCaptureTimeout: 200 * time.Millisecond,
+		successPage:            &successPage{message: "Login successful", status: http.StatusOK},
+		removeTimeoutCleanup:   func() {},
+		closing:                make(chan struct{}),
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// browseBy replaces the browser by the function during the test.
+func browseBy(t *testing.T, browse func(authURL string) error) {
+	t.Helper()
+	origOpenBrowser := openBrowser
+	t.Cleanup(func() { openBrowser = origOpenBrowser })
+	openBrowser = browse
+}
+
+func TestRedirectCaptureTimeoutIgnoresBareConnection(t *testing.T) {
+	r := newTestReceiver(t)
+	browseBy(t, func(authURL string) error {
+		// The browser preconnects, then the user takes longer than the timeout to login
+		conn, err := net.Dial("tcp", r.listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			time.Sleep(2 * r.redirectCaptureTimeout)
+			res, err := http.Get(r.redirectURI + "/?code=the-code&state=the-state")
+			if err == nil {
+				res.Body.Close()
+			}
+		}()
+		return nil
+	})
+
+	authRes, err := r.Receive("https://idp.example.com/authorize")
+	if err != nil {
+		t.Fatalf("The bare connection must not start %s: %v", REDIRECT_CAPTURE_TIMEOUT, err)
+	}
+	if authRes.Code != "the-code" {
+		t.Errorf("code = %s, want the-code", authRes.Code)
+	}
+}
+
+func TestRedirectCaptureTimeoutStartsOnRequest(t *testing.T) {
+	r := newTestReceiver(t)
+	browseBy(t, func(authURL string) error {
+		// The request is started but never completed
+		conn, err := net.Dial("tcp", r.listener.Addr().String())
+		if err != nil {
+			return err
+		}
+		t.Cleanup(func() { conn.Close() })
+		_, err = conn.Write([]byte("GET /?code=the-code HTTP/1.1\r\n"))
+		return err
+	})
+
+	_, err := r.Receive("https://idp.example.com/authorize")
+	if err == nil || !strings.Contains(err.Error(), REDIRECT_CAPTURE_TIMEOUT) {
+		t.Errorf("The request without the authorization response should time out, got %v", err)
+	}
+}
+
+// useStdin replaces stdin by a pipe during the test, the returned writer types into it.
+func useStdin(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	origStdin := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = origStdin
+		w.Close()
+		r.Close()
+	})
+	return r, w
+}
+
+func TestRetryBrowserLeavesNoStdinReader(t *testing.T) {
+	stdin, typing := useStdin(t)
+	r := newTestReceiver(t)
+	r.firstContactTimeout = 50 * time.Millisecond
+	r.retryBrowser = true
+	browseBy(t, func(authURL string) error {
+		go func() {
+			// The redirect arrives while asking whether the browser opened
+			time.Sleep(4 * r.firstContactTimeout)
+			res, err := http.Get(r.redirectURI + "/?code=the-code&state=the-state")
+			if err == nil {
+				res.Body.Close()
+			}
+		}()
+		return nil
+	})
+
+	received := make(chan *AuthorizationResponse, 1)
+	go func() {
+		authRes, err := r.Receive("https://idp.example.com/authorize")
+		if err != nil {
+			t.Error(err)
+		}
+		received <- authRes
+	}()
+
+	select {
+	case <-received:
+		t.Fatal("Receive shouldn't return while the prompt is reading stdin")
+	case <-time.After(10 * r.firstContactTimeout):
+	}
+	typing.Write([]byte("y\n"))
+	select {
+	case authRes := <-received:
+		if authRes == nil || authRes.Code != "the-code" {
+			t.Fatalf("The redirect during the prompt should be received, got %+v", authRes)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Receive should return after the answer")
+	}
+
+	// The next prompt, e.g. the role menu, gets the next line
+	typing.Write([]byte("next\n"))
+	line := make([]byte, len("next\n"))
+	stdin.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(stdin, line); err != nil || string(line) != "next\n" {
+		t.Errorf("The next line should be left to the next reader, got %q %v", line, err)
+	}
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// CodeCommitGitCredential derives the username and password of the HTTPS Git access to CodeCommit
+// from the AWS credentials, in the same way as "aws codecommit credential-helper".
+// The password is the SigV4 signature of the GIT request to the repository URL.
+func CodeCommitGitCredential(cred *AWSCredentials, repositoryURL string, now time.Time) (string, string, error) {
+	u, err := url.Parse(repositoryURL)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Failed to parse the repository URL")
+	}
+	// The port isn't signed
+	host := u.Hostname()
+	region, err := codeCommitRegion(host)
+	if err != nil {
+		return "", "", err
+	}
+
+	timestamp := now.UTC().Format("20060102T150405")
+	date := timestamp[:8]
+	scope := fmt.Sprintf("%s/%s/codecommit/aws4_request", date, region)
+
+	canonicalRequest := fmt.Sprintf("GIT\n%s\n\nhost:%s\n\nhost\n", u.Path, host)
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := fmt.Sprintf("AWS4-HMAC-SHA256\n%s\n%s\n%s", timestamp, scope, hex.EncodeToString(hashedRequest[:]))
+
+	key := hmacSHA256([]byte("AWS4"+cred.AWSSecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "codecommit")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	username := cred.AWSAccessKey
+	if cred.AWSSessionToken != "" {
+		username += "%" + cred.AWSSessionToken
+	}
+	return username, timestamp + "Z" + signature, nil
+}
+
+// codeCommitRegion extracts the region from git-codecommit.<region>.amazonaws.com and its variants.
+func codeCommitRegion(host string) (string, error) {
+	parts := strings.Split(host, ".")
+	if len(parts) < 3 || !strings.HasPrefix(parts[0], "git-codecommit") {
+		return "", errors.Errorf("%s is not a CodeCommit host", host)
+	}
+	return parts[1], nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
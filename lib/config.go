@@ -1,16 +1,91 @@
 package lib
 
 import (
+	"bytes"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 )
 
 const OIDC_PROVIDER_METADATA_URL = "oidc_provider_metadata_url"
 const CLIENT_ID = "client_id"
 const CLIENT_SECRET = "client_secret"
+const SCOPE = "scope"
+const TOKEN_SIGNING_ALGS = "token_signing_algs"
+const REQUIRE_AUTHORIZATION_RESPONSE_ISS = "require_authorization_response_iss"
+const SESSION_TAGS_FROM_CLAIMS = "session_tags_from_claims"
+const STS_ENDPOINT = "sts_endpoint"
+const ENDPOINTS = "endpoints"
+const AWS_RETRY_MODE = "aws_retry_mode"
+const AWS_MAX_ATTEMPTS = "aws_max_attempts"
+const REGION = "region"
+const FALLBACK_REGION = "fallback_region"
 const MAX_SESSION_DURATION_SECONDS = "max_session_duration_seconds"
 const DEFAULT_IAM_ROLE_ARN = "default_iam_role_arn"
+const CACHE_LOCK_TIMEOUT = "cache_lock_timeout"
+const CACHE_LOCK_STALE_SECONDS = "cache_lock_stale_seconds"
+const AUDIENCE = "audience"
+const AUDIENCES = "audiences"
+const RESOURCE = "resource"
+const AUTHORIZED_PARTY = "authorized_party"
+const EXPECTED_AUDIENCES = "expected_audiences"
+const ROLES = "roles"
+const SECRET_BACKEND = "secret_backend"
+const KEYRING_SERVICE = "keyring_service"
+const KEYRING_KEY_TEMPLATE = "keyring_key_template"
+const CALLBACK_PORT = "callback_port"
+const CALLBACK_HOST = "callback_host"
+const CALLBACK_BASE_PATH = "callback_base_path"
+const ALLOW_NON_LOOPBACK_CALLBACK = "allow_non_loopback_callback"
+const FIRST_CONTACT_TIMEOUT = "first_contact_timeout"
+const REDIRECT_CAPTURE_TIMEOUT = "redirect_capture_timeout"
+const DISCOVERY_CACHE_SECONDS = "discovery_cache_seconds"
+const SESSION_DURATION_NEGOTIATION = "session_duration_negotiation"
+const ALLOWED_ROLE_ARNS = "allowed_role_arns"
+const DEVICE_OPEN_BROWSER = "device_open_browser"
+const DEVICE_QR_CODE = "device_qr_code"
+const CALLBACK_SUCCESS_MESSAGE = "callback_success_message"
+const CALLBACK_SUCCESS_STATUS = "callback_success_status"
+const CALLBACK_SUCCESS_REDIRECT = "callback_success_redirect"
+const REUSE_BROWSER_TAB = "reuse_browser_tab"
+const RETRY_BROWSER = "retry_browser"
+const BROWSER_COMMAND = "browser_command"
+const HTTP_TIMEOUT = "http_timeout"
+const DIAL_TIMEOUT = "dial_timeout"
+const TLS_HANDSHAKE_TIMEOUT = "tls_handshake_timeout"
+const REDIRECT_URI = "redirect_uri"
+const REDIRECT_URIS = "redirect_uris"
+const LOGIN_FLOW = "login_flow"
+const LOGIN_MAX_ATTEMPTS = "login_max_attempts"
+const LOGIN_RETRY_BACKOFF = "login_retry_backoff"
+const CLOCK_SKEW_SECONDS = "clock_skew_seconds"
+const STRICT_CLOCK = "strict_clock"
+const GRANT_TYPE = "grant_type"
+const USE_REFRESH_TOKEN = "use_refresh_token"
+const DURATION_FROM_TOKEN = "duration_from_token"
+const MAX_DURATION_FROM_IAM = "max_duration_from_iam"
+const MAX_CONCURRENCY = "max_concurrency"
+const DEFAULT_OUTPUT_FORMAT = "default_output_format"
+const ALLOW_INSECURE_METADATA = "allow_insecure_metadata"
+const CHECK_THUMBPRINT = "check_thumbprint"
+const PROMPT = "prompt"
+const UI_LOCALES = "ui_locales"
+const METRICS_LISTEN = "metrics_listen"
+const METRICS_STATSD_ADDRESS = "metrics_statsd_address"
+const OIDC_HTTP_PROXY = "oidc_http_proxy"
+const AWS_HTTP_PROXY = "aws_http_proxy"
+const VALIDATE_CACHED_CREDENTIALS = "validate_cached_credentials"
+const PROFILES = "profiles"
+const ROLE_ARN_FROM_AWS_CONFIG = "role_arn_from_aws_config"
+const ROLES_CLAIM = "roles_claim"
+const ROLES_FROM_USERINFO = "roles_from_userinfo"
+const ROLE_LABELS = "role_labels"
+const ROLE_LABELS_CLAIM = "role_labels_claim"
 
 // OIDC config
 const AWS_FEDERATION_ROLE_SESSION_NAME = "aws_federation_role_session_name"
@@ -19,8 +94,204 @@ const AWS_FEDERATION_ROLE_SESSION_NAME = "aws_federation_role_session_name"
 const TOKEN_TYPE_ACCESS_TOKEN = "urn:ietf:params:oauth:token-type:access_token"
 const TOKEN_TYPE_ID_TOKEN = "urn:ietf:params:oauth:token-type:id_token"
 
+// ProviderNames returns the configured OIDC providers in order.
+func ProviderNames() []string {
+	var names []string
+	for name := range viper.AllSettings() {
+		if config := viper.Sub(name); config != nil && config.IsSet(OIDC_PROVIDER_METADATA_URL) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RoleConfig is an entry of the per-role config blocks in the provider config.
+// Empty fields fall back to the provider config.
+type RoleConfig struct {
+	RoleArn  string `mapstructure:"role_arn" yaml:"role_arn"`
+	Audience string `mapstructure:"audience" yaml:"audience,omitempty"`
+	// Audiences are tried in order while STS rejects the audience
+	Audiences []string `mapstructure:"audiences" yaml:"audiences,omitempty"`
+	Resource  string   `mapstructure:"resource" yaml:"resource,omitempty"`
+	// RequireFreshLogin never reuses nor saves the cached credentials of the role
+	RequireFreshLogin bool `mapstructure:"require_fresh_login" yaml:"require_fresh_login"`
+	// RequiredAMR are the authentication methods which the amr claim must all include, e.g. mfa
+	RequiredAMR []string `mapstructure:"required_amr" yaml:"required_amr,omitempty"`
+	// AllowedACR are the authentication context classes which the acr claim must be one of
+	AllowedACR []string `mapstructure:"allowed_acr" yaml:"allowed_acr,omitempty"`
+}
+
+func (r *RoleConfig) AudienceCandidates() []string {
+	if len(r.Audiences) > 0 {
+		return r.Audiences
+	}
+	return []string{r.Audience}
+}
+
+func ResolveRoleConfig(config *viper.Viper, roleArn string) *RoleConfig {
+	role := &RoleConfig{
+		RoleArn:   roleArn,
+		Audience:  config.GetString(AUDIENCE),
+		Audiences: config.GetStringSlice(AUDIENCES),
+		Resource:  config.GetString(RESOURCE),
+	}
+
+	var roles []RoleConfig
+	if err := config.UnmarshalKey(ROLES, &roles); err != nil {
+		Writeln("Ignored the broken %s config: %v", ROLES, err)
+		return role
+	}
+	for _, r := range roles {
+		if r.RoleArn != roleArn {
+			continue
+		}
+		if r.Audience != "" {
+			role.Audience = r.Audience
+			role.Audiences = nil
+		}
+		if len(r.Audiences) > 0 {
+			role.Audiences = r.Audiences
+		}
+		if r.Resource != "" {
+			role.Resource = r.Resource
+		}
+		role.RequireFreshLogin = r.RequireFreshLogin
+		role.RequiredAMR = r.RequiredAMR
+		role.AllowedACR = r.AllowedACR
+	}
+	return role
+}
+
+// ProfileConfig maps an AWS profile name to the role in the profiles block of the provider config.
+type ProfileConfig struct {
+	RoleArn  string `mapstructure:"role_arn"`
+	Duration int64  `mapstructure:"duration"`
+}
+
+// ErrProfileNotMapped is returned when the AWS profile isn't in the profiles config.
+var ErrProfileNotMapped = errors.New("not found in " + PROFILES + " config")
+
+// ResolveProfileConfig finds the AWS profile. The name is case-insensitive because viper lowercases the keys.
+func ResolveProfileConfig(config *viper.Viper, name string) (*ProfileConfig, error) {
+	var profiles map[string]ProfileConfig
+	if err := config.UnmarshalKey(PROFILES, &profiles); err != nil {
+		return nil, errors.Wrapf(err, "Broken %s config", PROFILES)
+	}
+	profile, ok := profiles[strings.ToLower(name)]
+	if !ok {
+		return nil, errors.Wrapf(ErrProfileNotMapped, "The AWS profile %s", name)
+	}
+	if err := ValidateRoleArn(profile.RoleArn); err != nil {
+		return nil, errors.Wrapf(err, "Invalid role_arn of the AWS profile %s", name)
+	}
+	return &profile, nil
+}
+
 var configdir string
 
+// PROJECT_CONFIG_FILE in the current directory is merged over the global config
+const PROJECT_CONFIG_FILE = ".aws-cli-oidc.yaml"
+
+// TRUSTED_PROJECT_DIRS of the global config lists the directories whose project config is merged without
+// --trust-project-config
+const TRUSTED_PROJECT_DIRS = "trusted_project_dirs"
+
+// projectDeniedKeys can't be set by the project config, any cloned repository could otherwise send the tokens and
+// the credentials elsewhere, run a command, widen the allowed roles or weaken the checks of the tokens.
+// The roles are denied as a whole since the project list would replace the per-role checks of the global config.
+var projectDeniedKeys = []string{
+	STS_ENDPOINT,
+	ENDPOINTS,
+	AWS_HTTP_PROXY,
+	OIDC_HTTP_PROXY,
+	ALLOW_INSECURE_METADATA,
+	ALLOW_NON_LOOPBACK_CALLBACK,
+	CALLBACK_HOST,
+	REDIRECT_URI,
+	REDIRECT_URIS,
+	BROWSER_COMMAND,
+	ALLOWED_ROLE_ARNS,
+	ROLES,
+	TOKEN_SIGNING_ALGS,
+	REQUIRE_AUTHORIZATION_RESPONSE_ISS,
+	AUTHORIZED_PARTY,
+	EXPECTED_AUDIENCES,
+	SECRET_BACKEND,
+}
+
+// MergeProjectConfig overlays the project config on the loaded global config. The maps, i.e. the providers
+// and their nested blocks, are merged key by key and the project values win. The other values including
+// the lists are replaced as a whole. It returns the merged file, or empty if there is no project config.
+// The project config is ignored unless it's trusted by the argument or trusted_project_dirs, and it can't set
+// projectDeniedKeys nor the metadata URL of the providers of the global config.
+func MergeProjectConfig(trusted bool) (string, error) {
+	path, err := filepath.Abs(PROJECT_CONFIG_FILE)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if !trusted && !isTrustedProjectDir(filepath.Dir(path)) {
+		Writeln("Ignored the project config %s, trust it by --trust-project-config or %s of the global config", path, TRUSTED_PROJECT_DIRS)
+		return "", nil
+	}
+
+	project := viper.New()
+	project.SetConfigType("yaml")
+	if err := project.ReadConfig(bytes.NewReader(data)); err != nil {
+		return "", errors.Wrapf(err, "Failed to read %s", path)
+	}
+	if err := validateProjectConfig(project); err != nil {
+		return "", errors.Wrapf(err, "Refused %s", path)
+	}
+
+	viper.SetConfigType("yaml")
+	if err := viper.MergeConfig(bytes.NewReader(data)); err != nil {
+		return "", errors.Wrapf(err, "Failed to merge %s", path)
+	}
+	return path, nil
+}
+
+func isTrustedProjectDir(dir string) bool {
+	for _, trusted := range viper.GetStringSlice(TRUSTED_PROJECT_DIRS) {
+		expanded, err := homedir.Expand(trusted)
+		if err != nil {
+			continue
+		}
+		if abs, err := filepath.Abs(expanded); err == nil && abs == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func validateProjectConfig(project *viper.Viper) error {
+	if project.IsSet(TRUSTED_PROJECT_DIRS) {
+		return errors.Errorf("The project config can't set %s", TRUSTED_PROJECT_DIRS)
+	}
+	for name := range project.AllSettings() {
+		provider := project.Sub(name)
+		if provider == nil {
+			continue
+		}
+		for _, key := range projectDeniedKeys {
+			if provider.IsSet(key) {
+				return errors.Errorf("The project config can't set %s of %s, set it in the global config", key, name)
+			}
+		}
+		if global := viper.Sub(name); global != nil && global.IsSet(OIDC_PROVIDER_METADATA_URL) && provider.IsSet(OIDC_PROVIDER_METADATA_URL) {
+			return errors.Errorf("The project config can't override %s of %s in the global config", OIDC_PROVIDER_METADATA_URL, name)
+		}
+	}
+	return nil
+}
+
 func ConfigPath() string {
 	if configdir != "" {
 		return configdir
@@ -35,3 +306,19 @@ func ConfigPath() string {
 	}
 	return path
 }
+
+// CachePath is the directory of the caches, which can be cleared at any time apart from the config.
+// It follows XDG Base Directory: $AWS_CLI_OIDC_CACHE, $XDG_CACHE_HOME/aws-cli-oidc or ~/.cache/aws-cli-oidc.
+func CachePath() string {
+	if path := os.Getenv("AWS_CLI_OIDC_CACHE"); path != "" {
+		return path
+	}
+	if path := os.Getenv("XDG_CACHE_HOME"); path != "" {
+		return path + "/aws-cli-oidc"
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		Exit(err)
+	}
+	return home + "/.cache/aws-cli-oidc"
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// EffectiveConfig is the provider config after the project config and the overrides are merged,
+// and the values which are resolved from it for the role.
+type EffectiveConfig struct {
+	Provider string                 `yaml:"provider"`
+	Config   map[string]interface{} `yaml:"config"`
+	Resolved EffectiveValues        `yaml:"resolved"`
+}
+
+type EffectiveValues struct {
+	Scope                     string     `yaml:"scope"`
+	Region                    string     `yaml:"region"`
+	LoginFlow                 string     `yaml:"login_flow"`
+	MaxSessionDurationSeconds int64      `yaml:"max_session_duration_seconds"`
+	UseRefreshToken           bool       `yaml:"use_refresh_token"`
+	Role                      RoleConfig `yaml:"role"`
+}
+
+// EffectiveConfigOptions are the options of get-cred which change the resolved values besides the overrides.
+type EffectiveConfigOptions struct {
+	RoleArn                   string
+	AWSProfile                string
+	MaxSessionDurationSeconds int64
+}
+
+// ResolveEffectiveConfig resolves the config of the provider like get-cred without the discovery and the login.
+// The secrets are redacted, the Vault references are shown as they are.
+func ResolveEffectiveConfig(name string, overrides map[string]string, opts *EffectiveConfigOptions) (*EffectiveConfig, error) {
+	config, err := prepareProviderConfig(name, overrides)
+	if err != nil {
+		return nil, err
+	}
+	client := &OIDCClient{name: name, config: config}
+
+	roleArn, duration, err := resolveAWSProfile(client, opts.AWSProfile, opts.RoleArn, opts.MaxSessionDurationSeconds)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to resolve the AWS profile")
+	}
+	if roleArn == "" {
+		roleArn = config.GetString(DEFAULT_IAM_ROLE_ARN)
+	}
+	if duration <= 0 {
+		duration = configuredDuration(client)
+	}
+	loginFlow := config.GetString(LOGIN_FLOW)
+	if loginFlow == "" {
+		loginFlow = LOGIN_FLOW_AUTO
+	}
+	if config.GetString(GRANT_TYPE) == GRANT_TYPE_CLIENT_CREDENTIALS {
+		loginFlow = GRANT_TYPE_CLIENT_CREDENTIALS
+	}
+
+	return &EffectiveConfig{
+		Provider: name,
+		Config:   redactConfig(config.AllSettings()),
+		Resolved: EffectiveValues{
+			Scope:                     client.Scope(),
+			Region:                    ResolveRegion(client),
+			LoginFlow:                 loginFlow,
+			MaxSessionDurationSeconds: duration,
+			UseRefreshToken:           client.UseRefreshToken(),
+			Role:                      *ResolveRoleConfig(config, roleArn),
+		},
+	}, nil
+}
+
+func redactConfig(settings map[string]interface{}) map[string]interface{} {
+	for key, value := range settings {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			settings[key] = redactConfig(v)
+		case []interface{}:
+			for i, item := range v {
+				if m, ok := item.(map[string]interface{}); ok {
+					v[i] = redactConfig(m)
+				}
+			}
+		case string:
+			if isSecretKey(key) && v != "" && !strings.HasPrefix(v, VAULT_REFERENCE_PREFIX) {
+				settings[key] = redacted
+			}
+		}
+	}
+	return settings
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	return redactedParams[key] || strings.HasSuffix(key, "_secret") || strings.HasSuffix(key, "_token") ||
+		strings.Contains(key, "password")
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testShowConfig = `
+myop:
+  oidc_provider_metadata_url: https://idp.example.com/.well-known/openid-configuration
+  client_id: my-client
+  client_secret: my-secret
+  max_session_duration_seconds: "3600"
+  profiles:
+    dev:
+      role_arn: arn:aws:iam::123456789012:role/dev
+      duration: 7200
+`
+
+func useShowConfig(t *testing.T) {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(bytes.NewBufferString(testShowConfig)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveEffectiveConfigAppliesOverridesLikeGetCred(t *testing.T) {
+	useShowConfig(t)
+
+	effective, err := ResolveEffectiveConfig("myop", map[string]string{
+		SCOPE:                        "profile",
+		REGION:                       "us-west-2",
+		ALLOW_INSECURE_METADATA:      "true",
+		SESSION_DURATION_NEGOTIATION: "true",
+		STRICT_CLOCK:                 "",
+	}, &EffectiveConfigOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if effective.Config[ALLOW_INSECURE_METADATA] != "true" || effective.Config[SESSION_DURATION_NEGOTIATION] != "true" {
+		t.Errorf("The bool overrides should be applied: %v", effective.Config)
+	}
+	if _, ok := effective.Config[STRICT_CLOCK]; ok {
+		t.Errorf("The empty override shouldn't be applied: %v", effective.Config)
+	}
+	if effective.Config[CLIENT_SECRET] != redacted {
+		t.Errorf("The secret should be redacted: %v", effective.Config[CLIENT_SECRET])
+	}
+	if effective.Resolved.Region != "us-west-2" {
+		t.Errorf("region = %s, want us-west-2", effective.Resolved.Region)
+	}
+	if effective.Resolved.Scope != "openid profile" {
+		t.Errorf("scope = %s, want openid profile", effective.Resolved.Scope)
+	}
+}
+
+func TestResolveEffectiveConfigResolvesAWSProfileAndDuration(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         *EffectiveConfigOptions
+		wantRole     string
+		wantDuration int64
+	}{
+		{"provider config", &EffectiveConfigOptions{}, "", 3600},
+		{"-d", &EffectiveConfigOptions{MaxSessionDurationSeconds: 900}, "", 900},
+		{"--aws-profile", &EffectiveConfigOptions{AWSProfile: "dev"}, "arn:aws:iam::123456789012:role/dev", 7200},
+		{"-r and -d over --aws-profile", &EffectiveConfigOptions{AWSProfile: "dev", RoleArn: "arn:aws:iam::123456789012:role/ops", MaxSessionDurationSeconds: 900},
+			"arn:aws:iam::123456789012:role/ops", 900},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useShowConfig(t)
+
+			effective, err := ResolveEffectiveConfig("myop", nil, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if effective.Resolved.Role.RoleArn != tt.wantRole {
+				t.Errorf("role = %s, want %s", effective.Resolved.Role.RoleArn, tt.wantRole)
+			}
+			if effective.Resolved.MaxSessionDurationSeconds != tt.wantDuration {
+				t.Errorf("duration = %d, want %d", effective.Resolved.MaxSessionDurationSeconds, tt.wantDuration)
+			}
+		})
+	}
+}
+
+func TestResolveEffectiveConfigRejectsLikeGetCred(t *testing.T) {
+	useShowConfig(t)
+
+	if _, err := ResolveEffectiveConfig("unknown", nil, &EffectiveConfigOptions{}); err == nil {
+		t.Error("The provider which isn't configured should be an error")
+	}
+	if _, err := ResolveEffectiveConfig("myop", nil, &EffectiveConfigOptions{AWSProfile: "unmapped"}); err == nil {
+		t.Error("The AWS profile which isn't mapped should be an error")
+	}
+	viper.Set("myop."+SESSION_TAGS_FROM_CLAIMS, []string{"team"})
+	if _, err := ResolveEffectiveConfig("myop", nil, &EffectiveConfigOptions{}); err == nil {
+		t.Errorf("%s should be rejected", SESSION_TAGS_FROM_CLAIMS)
+	}
+}
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+const testGlobalConfig = `
+myop:
+  oidc_provider_metadata_url: https://idp.example.com/.well-known/openid-configuration
+  client_id: global-client
+`
+
+// useProjectDir loads the global config and changes the current directory to the project with the project config.
+func useProjectDir(t *testing.T, projectConfig string) string {
+	t.Helper()
+	viper.Reset()
+	t.Cleanup(viper.Reset)
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(bytes.NewBufferString(testGlobalConfig)); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, PROJECT_CONFIG_FILE), []byte(projectConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	// The temporary directory can be behind a symlink, e.g. on macOS
+	abs, _ := filepath.Abs(".")
+	return abs
+}
+
+func TestMergeProjectConfigIgnoresUntrusted(t *testing.T) {
+	useProjectDir(t, "myop:\n  client_id: project-client\n")
+
+	path, err := MergeProjectConfig(false)
+	if err != nil || path != "" {
+		t.Fatalf("The untrusted project config should be ignored, got %q %v", path, err)
+	}
+	if got := viper.Sub("myop").GetString(CLIENT_ID); got != "global-client" {
+		t.Errorf("client_id = %s, want global-client", got)
+	}
+}
+
+func TestMergeProjectConfigTrusted(t *testing.T) {
+	useProjectDir(t, "myop:\n  client_id: project-client\nteamop:\n  oidc_provider_metadata_url: https://team.example.com\n")
+
+	path, err := MergeProjectConfig(true)
+	if err != nil || path == "" {
+		t.Fatalf("The trusted project config should be merged, got %q %v", path, err)
+	}
+	if got := viper.Sub("myop").GetString(CLIENT_ID); got != "project-client" {
+		t.Errorf("client_id = %s, want project-client", got)
+	}
+	if got := viper.Sub("myop").GetString(OIDC_PROVIDER_METADATA_URL); !strings.HasPrefix(got, "https://idp.example.com") {
+		t.Errorf("The metadata URL of the global config should be kept, got %s", got)
+	}
+	if names := ProviderNames(); len(names) != 2 {
+		t.Errorf("The project config should add the provider, got %v", names)
+	}
+}
+
+func TestMergeProjectConfigTrustedDir(t *testing.T) {
+	dir := useProjectDir(t, "myop:\n  client_id: project-client\n")
+	viper.Set(TRUSTED_PROJECT_DIRS, []string{dir})
+
+	if path, err := MergeProjectConfig(false); err != nil || path == "" {
+		t.Fatalf("The project config in trusted_project_dirs should be merged, got %q %v", path, err)
+	}
+}
+
+func TestMergeProjectConfigRefusesDeniedKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		project string
+	}{
+		{"sts_endpoint", "myop:\n  sts_endpoint: https://attacker.example.com\n"},
+		{"endpoints", "myop:\n  endpoints:\n    sts: https://attacker.example.com\n"},
+		{"browser_command of a new provider", "teamop:\n  oidc_provider_metadata_url: https://team.example.com\n  browser_command: sh -c evil\n"},
+		{"allowed_role_arns", "myop:\n  allowed_role_arns:\n    - arn:aws:iam::*:role/*\n"},
+		{"callback_host", "myop:\n  callback_host: attacker.example.com\n"},
+		{"redirect_uri", "myop:\n  redirect_uri: https://attacker.example.com/callback\n"},
+		{"redirect_uris", "myop:\n  redirect_uris:\n    - https://attacker.example.com/callback\n"},
+		{"roles", "myop:\n  roles:\n    - role_arn: arn:aws:iam::123456789012:role/dev\n"},
+		{"token_signing_algs", "myop:\n  token_signing_algs:\n    - none\n"},
+		{"require_authorization_response_iss", "myop:\n  require_authorization_response_iss: false\n"},
+		{"authorized_party", "myop:\n  authorized_party: attacker-client\n"},
+		{"expected_audiences", "myop:\n  expected_audiences:\n    - attacker-client\n"},
+		{"metadata URL of the global provider", "myop:\n  oidc_provider_metadata_url: https://attacker.example.com\n"},
+		{"trusted_project_dirs", "trusted_project_dirs:\n  - /\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useProjectDir(t, tt.project)
+			if _, err := MergeProjectConfig(true); err == nil {
+				t.Fatal("The project config should be refused")
+			}
+			if got := viper.Sub("myop").GetString(STS_ENDPOINT); got != "" {
+				t.Errorf("The refused project config shouldn't be merged, sts_endpoint = %s", got)
+			}
+		})
+	}
+}
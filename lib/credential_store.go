@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"bytes"
+	"sync"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const DEFAULT_SECRET_BACKEND = "keyring"
+const DEFAULT_KEYRING_KEY_TEMPLATE = "{{.Provider}}/{{.Key}}"
+
+var ErrCredentialNotFound = errors.New("The credential is not found in the store")
+
+// ErrCorruptCredential is the cached entry which can't be used, it's deleted on the load
+var ErrCorruptCredential = errors.New("The cached credential is corrupt")
+
+// CredentialStore saves the AWS credentials as JSON string keyed by the role ARN.
+type CredentialStore interface {
+	// Get returns ErrCredentialNotFound when the key doesn't exist.
+	Get(key string) (string, error)
+	Set(key, value string) error
+}
+
+// CredentialDeleter is implemented by the stores which can remove a key.
+// It's used to move the entries saved with the legacy key names.
+type CredentialDeleter interface {
+	Delete(key string) error
+}
+
+type CredentialStoreFactory func(config *viper.Viper) CredentialStore
+
+var credentialStoresMu sync.Mutex
+var credentialStores = map[string]CredentialStoreFactory{
+	DEFAULT_SECRET_BACKEND: func(config *viper.Viper) CredentialStore {
+		ConfigureLock(config)
+		ConfigureKeyringService(config)
+		return &keyringStore{}
+	},
+}
+
+// RegisterCredentialStore makes the store available as the secret_backend config of the provider.
+// It replaces the store which is registered with the same name, including the built-in ones.
+func RegisterCredentialStore(name string, factory CredentialStoreFactory) {
+	credentialStoresMu.Lock()
+	defer credentialStoresMu.Unlock()
+
+	credentialStores[name] = factory
+}
+
+// NewCredentialStore returns the store of the provider. The keys are named by keyring_key_template.
+func NewCredentialStore(provider string, config *viper.Viper) (CredentialStore, error) {
+	name := config.GetString(SECRET_BACKEND)
+	if name == "" {
+		name = DEFAULT_SECRET_BACKEND
+	}
+	text := config.GetString(KEYRING_KEY_TEMPLATE)
+	if text == "" {
+		text = DEFAULT_KEYRING_KEY_TEMPLATE
+	}
+	tmpl, err := template.New(KEYRING_KEY_TEMPLATE).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid %s", KEYRING_KEY_TEMPLATE)
+	}
+
+	credentialStoresMu.Lock()
+	factory, ok := credentialStores[name]
+	credentialStoresMu.Unlock()
+
+	if !ok {
+		return nil, errors.Errorf("Unknown %s: %s", SECRET_BACKEND, name)
+	}
+	return &namespacedStore{
+		backend:  factory(config),
+		provider: provider,
+		template: tmpl,
+	}, nil
+}
+
+type keyName struct {
+	Provider string
+	Key      string
+}
+
+// namespacedStore names the keys of the backend by the template.
+// The entries saved with the bare key by older versions are moved to the templated key on the first access.
+type namespacedStore struct {
+	backend  CredentialStore
+	provider string
+	template *template.Template
+}
+
+func (s *namespacedStore) name(key string) (string, error) {
+	var buf bytes.Buffer
+	if err := s.template.Execute(&buf, keyName{Provider: s.provider, Key: key}); err != nil {
+		return "", errors.Wrapf(err, "Can't render %s", KEYRING_KEY_TEMPLATE)
+	}
+	return buf.String(), nil
+}
+
+func (s *namespacedStore) Get(key string) (string, error) {
+	name, err := s.name(key)
+	if err != nil {
+		return "", err
+	}
+	value, err := s.backend.Get(name)
+	if err == nil && value == "" {
+		// Deleted from the backend without CredentialDeleter
+		return "", ErrCredentialNotFound
+	}
+	if err != ErrCredentialNotFound || name == key {
+		return value, err
+	}
+
+	// Migrate the legacy entry
+	value, err = s.backend.Get(key)
+	if err != nil {
+		return "", err
+	}
+	if err := s.backend.Set(name, value); err != nil {
+		return "", err
+	}
+	if deleter, ok := s.backend.(CredentialDeleter); ok {
+		if err := deleter.Delete(key); err != nil {
+			return "", err
+		}
+	}
+	return value, nil
+}
+
+func (s *namespacedStore) Set(key, value string) error {
+	name, err := s.name(key)
+	if err != nil {
+		return err
+	}
+	return s.backend.Set(name, value)
+}
+
+// Delete overwrites the entry with the empty value if the backend can't delete it, which Get reads as not found.
+func (s *namespacedStore) Delete(key string) error {
+	name, err := s.name(key)
+	if err != nil {
+		return err
+	}
+	deleter, ok := s.backend.(CredentialDeleter)
+	if !ok {
+		return s.backend.Set(name, "")
+	}
+	return deleter.Delete(name)
+}
+
+// keyringStore is the OS secret store
+type keyringStore struct{}
+
+func (s *keyringStore) Get(key string) (string, error) {
+	Secret.Load()
+
+	value, ok := Secret.AWSCredentials[key]
+	if !ok {
+		return "", ErrCredentialNotFound
+	}
+	return value, nil
+}
+
+func (s *keyringStore) Set(key, value string) error {
+	Secret.Save(key, value)
+	return nil
+}
+
+func (s *keyringStore) Delete(key string) error {
+	Secret.Delete(key)
+	return nil
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// getSetStore is the backend without CredentialDeleter.
+type getSetStore map[string]string
+
+func (s getSetStore) Get(key string) (string, error) {
+	value, ok := s[key]
+	if !ok {
+		return "", ErrCredentialNotFound
+	}
+	return value, nil
+}
+
+func (s getSetStore) Set(key, value string) error {
+	s[key] = value
+	return nil
+}
+
+// useCredentialStore registers the backend as secret_backend of the name during the test.
+func useCredentialStore(t *testing.T, name string, backend CredentialStore) {
+	t.Helper()
+	RegisterCredentialStore(name, func(config *viper.Viper) CredentialStore {
+		return backend
+	})
+	t.Cleanup(func() {
+		credentialStoresMu.Lock()
+		defer credentialStoresMu.Unlock()
+		delete(credentialStores, name)
+	})
+}
+
+// captureStdout returns what the function printed to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	return captureOutput(t, &os.Stdout, f)
+}
+
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	return captureOutput(t, &os.Stderr, f)
+}
+
+func captureOutput(t *testing.T, file **os.File, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := *file
+	*file = w
+	defer func() { *file = orig }()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	f()
+	w.Close()
+	return <-out
+}
+
+func TestNamespacedStoreDeleteWithoutDeleter(t *testing.T) {
+	useCredentialStore(t, "test-get-set", getSetStore{})
+	store, err := NewCredentialStore("myop", newTestClient(map[string]interface{}{SECRET_BACKEND: "test-get-set"}).config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.(CredentialDeleter).Delete("key"); err != nil {
+		t.Fatalf("The entry should be overwritten: %v", err)
+	}
+	if _, err := store.Get("key"); err != ErrCredentialNotFound {
+		t.Errorf("The deleted entry should be not found, got %v", err)
+	}
+}
+
+func TestCorruptCachedCredentialLogsInAgain(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend CredentialStore
+		cached  string
+	}{
+		{"truncated", memoryStore{}, `{"AccessKeyId":"ASIA`},
+		{"garbage", memoryStore{}, "\x00garbage"},
+		{"missing fields", memoryStore{}, `{"AccessKeyId":"ASIATEST"}`},
+		{"truncated in the backend without delete", getSetStore{}, `{"AccessKeyId":"ASIA`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTempLockDir(t)
+			f := newSelftestFixture(t)
+			useCredentialStore(t, "test-memory", tt.backend)
+			client := f.client(t, map[string]string{SECRET_BACKEND: "test-memory"})
+
+			duration := configuredDuration(client)
+			store, err := NewCredentialStore(client.Name(), client.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Set(CredentialCacheKey(selftestRoleArn, duration, nil), tt.cached); err != nil {
+				t.Fatal(err)
+			}
+
+			out := captureStdout(t, func() {
+				Authenticate(client, &AuthenticateOptions{
+					RoleArn:      selftestRoleArn,
+					UseSecret:    true,
+					LoginFlow:    LOGIN_FLOW_LOOPBACK,
+					OutputFormat: OUTPUT_FORMAT_JSON,
+				})
+			})
+			var cred AWSCredentials
+			if err := json.Unmarshal([]byte(out), &cred); err != nil || cred.AWSAccessKey != selftestAccessKeyID {
+				t.Fatalf("The login should issue new credentials, got %q %v", out, err)
+			}
+
+			cached, err := AWSCredential(store, selftestRoleArn, duration, nil)
+			if err != nil || cached.AWSAccessKey != selftestAccessKeyID {
+				t.Errorf("The corrupt entry should be replaced by the new credentials, got %+v %v", cached, err)
+			}
+			if !strings.Contains(out, selftestSessionToken) {
+				t.Errorf("The output should have the session token: %s", out)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+//go:build windows
+
+package lib
+
+import (
+	"encoding/json"
+
+	"github.com/danieljoos/wincred"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// WINCRED_SECRET_BACKEND saves each entry as its own generic credential of the Windows Credential Manager
+const WINCRED_SECRET_BACKEND = "wincred"
+
+// wincredTargetPrefix is the prefix of the target names, e.g. aws-cli-oidc:myop/arn:aws:iam::123456789012:role/dev#...
+const wincredTargetPrefix = "aws-cli-oidc:"
+
+// The limit of CredentialBlob of the Windows Credential Manager (CRED_MAX_CREDENTIAL_BLOB_SIZE)
+const wincredMaxBlobSize = 5 * 512
+
+func init() {
+	RegisterCredentialStore(WINCRED_SECRET_BACKEND, func(config *viper.Viper) CredentialStore {
+		return &wincredStore{}
+	})
+}
+
+// wincredStore keeps the credential_process JSON of the role as the blob and the access key ID as the user name,
+// so that other tools on Windows can read the session by the target name. It's overwritten on each login.
+type wincredStore struct{}
+
+func (s *wincredStore) Get(key string) (string, error) {
+	cred, err := wincred.GetGenericCredential(wincredTargetPrefix + key)
+	if err == wincred.ErrElementNotFound {
+		return "", ErrCredentialNotFound
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read the Windows Credential Manager")
+	}
+	return string(cred.CredentialBlob), nil
+}
+
+func (s *wincredStore) Set(key, value string) error {
+	if len(value) > wincredMaxBlobSize {
+		return errors.Errorf("The entry %s is %d bytes, it exceeds %d bytes limit of the Windows Credential Manager", key, len(value), wincredMaxBlobSize)
+	}
+	cred := wincred.NewGenericCredential(wincredTargetPrefix + key)
+	cred.CredentialBlob = []byte(value)
+	cred.Persist = wincred.PersistLocalMachine
+	cred.Comment = "AWS credentials by aws-cli-oidc"
+	var awsCred AWSCredentials
+	if err := json.Unmarshal([]byte(value), &awsCred); err == nil {
+		cred.UserName = awsCred.AWSAccessKey
+	}
+	if err := cred.Write(); err != nil {
+		return errors.Wrap(err, "Failed to write the Windows Credential Manager")
+	}
+	return nil
+}
+
+func (s *wincredStore) Delete(key string) error {
+	cred, err := wincred.GetGenericCredential(wincredTargetPrefix + key)
+	if err == wincred.ErrElementNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to read the Windows Credential Manager")
+	}
+	return cred.Delete()
+}
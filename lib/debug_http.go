@@ -0,0 +1,128 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var IsDebugHTTPEnabled bool
+
+const redacted = "REDACTED"
+
+var redactedParams = map[string]bool{
+	"code":             true,
+	"code_verifier":    true,
+	"client_secret":    true,
+	"client_assertion": true,
+	"assertion":        true,
+	"access_token":     true,
+	"id_token":         true,
+	"refresh_token":    true,
+	"token":            true,
+	"device_code":      true,
+	"subject_token":    true,
+	"password":         true,
+}
+
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Vault-Token"}
+
+// debugTransport logs the HTTP interactions with the OIDC provider when --debug-http is enabled.
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !IsDebugHTTPEnabled {
+		return t.base.RoundTrip(req)
+	}
+
+	var reqBody []byte
+	if req.Body != nil {
+		reqBody, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+	Writeln("HTTP request: %s %s", req.Method, redactURL(req.URL))
+	writeDebugHeaders(req.Header)
+	if len(reqBody) > 0 {
+		Writeln("  body: %s", redactBody(req.Header.Get("Content-Type"), reqBody))
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		Writeln("HTTP error: %v", err)
+		return nil, err
+	}
+
+	resBody, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(resBody))
+	Writeln("HTTP response: %s", res.Status)
+	writeDebugHeaders(res.Header)
+	// Vault responses are the secrets themselves
+	if len(resBody) > 0 && req.Header.Get("X-Vault-Token") == "" {
+		Writeln("  body: %s", redactBody(res.Header.Get("Content-Type"), resBody))
+	}
+
+	return res, nil
+}
+
+func writeDebugHeaders(header http.Header) {
+	for name, values := range redactHeaders(header) {
+		Writeln("  %s: %s", name, strings.Join(values, ", "))
+	}
+}
+
+func redactHeaders(header http.Header) http.Header {
+	h := header.Clone()
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, redacted)
+		}
+	}
+	return h
+}
+
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	redactedURL.RawQuery = redactValues(u.Query()).Encode()
+	return redactedURL.String()
+}
+
+func redactValues(values url.Values) url.Values {
+	v := url.Values{}
+	for name, value := range values {
+		if redactedParams[name] {
+			v.Set(name, redacted)
+		} else {
+			v[name] = value
+		}
+	}
+	return v
+}
+
+func redactBody(contentType string, body []byte) string {
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(body))
+		if err == nil {
+			return redactValues(values).Encode()
+		}
+	}
+	if strings.HasPrefix(contentType, "application/json") {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(body, &obj); err == nil {
+			for name := range obj {
+				if redactedParams[name] {
+					obj[name] = redacted
+				}
+			}
+			redactedBody, _ := json.Marshal(obj)
+			return string(redactedBody)
+		}
+	}
+	return string(body)
+}
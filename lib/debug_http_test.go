@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDebugHTTPRedactsSecretParams(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"secret-response-access_token","refresh_token":"secret-response-refresh_token"}`))
+	}))
+	defer server.Close()
+
+	origDebug, origQuiet := IsDebugHTTPEnabled, IsQuiet
+	IsDebugHTTPEnabled, IsQuiet = true, false
+	defer func() { IsDebugHTTPEnabled, IsQuiet = origDebug, origQuiet }()
+
+	form := url.Values{}
+	for name := range redactedParams {
+		form.Set(name, "secret-form-"+name)
+	}
+	query := url.Values{}
+	for name := range redactedParams {
+		query.Set(name, "secret-query-"+name)
+	}
+	client := &http.Client{Transport: &debugTransport{base: http.DefaultTransport}}
+
+	out := captureStderr(t, func() {
+		res, err := client.PostForm(server.URL+"?"+query.Encode(), form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	})
+	if strings.Contains(out, "secret-") {
+		t.Errorf("The debug output has a secret value:\n%s", out)
+	}
+	for _, name := range []string{"token", "client_assertion", "assertion"} {
+		if !strings.Contains(out, name+"="+redacted) {
+			t.Errorf("%s should be redacted in the debug output:\n%s", name, out)
+		}
+	}
+}
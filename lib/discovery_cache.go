@@ -0,0 +1,63 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const discoveryCacheDir = "discovery"
+
+type cachedDiscovery struct {
+	FetchedAt time.Time             `json:"fetched_at"`
+	Metadata  *OIDCMetadataResponse `json:"metadata"`
+}
+
+// discoveryCacheTTL is discovery_cache_seconds of the provider config, 0 disables the cache.
+func discoveryCacheTTL(config *viper.Viper) time.Duration {
+	return time.Duration(config.GetInt64(DISCOVERY_CACHE_SECONDS)) * time.Second
+}
+
+func discoveryCachePath(providerURL string) string {
+	sum := sha256.Sum256([]byte(providerURL))
+	return filepath.Join(CachePath(), discoveryCacheDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// loadCachedDiscovery returns the discovery document of the URL fetched within the TTL, otherwise nil.
+func loadCachedDiscovery(providerURL string, ttl time.Duration) *OIDCMetadataResponse {
+	if ttl <= 0 {
+		return nil
+	}
+	b, err := os.ReadFile(discoveryCachePath(providerURL))
+	if err != nil {
+		return nil
+	}
+	var cached cachedDiscovery
+	if err := json.Unmarshal(b, &cached); err != nil || cached.Metadata == nil {
+		Traceln("Ignoring the broken discovery cache of %s: %v", providerURL, err)
+		return nil
+	}
+	if time.Since(cached.FetchedAt) > ttl {
+		return nil
+	}
+	Traceln("Using the discovery cache of %s fetched at %s", providerURL, cached.FetchedAt.Format(time.RFC3339))
+	return cached.Metadata
+}
+
+// saveCachedDiscovery keeps the discovery document, the failure only costs the fetch of the next run.
+func saveCachedDiscovery(providerURL string, metadata *OIDCMetadataResponse) {
+	b, err := json.Marshal(&cachedDiscovery{FetchedAt: time.Now(), Metadata: metadata})
+	if err != nil {
+		return
+	}
+	path := discoveryCachePath(providerURL)
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		Traceln("Can't save %s: %v", path, err)
+	}
+}
@@ -0,0 +1,93 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/pkg/errors"
+)
+
+const sessionDurationsFile = "session_durations.json"
+
+// The negotiated max of the role is reused for a week, then the configured duration is tried again
+// in case MaxSessionDuration of the role has been raised
+const sessionDurationCacheAge = 7 * 24 * time.Hour
+
+// Every role accepts 1 hour, the default of MaxSessionDuration
+const fallbackMaxDuration = 3600
+
+var maxDurationPattern = regexp.MustCompile(`MaxSessionDuration[^0-9]*([0-9]+)`)
+
+type negotiatedDuration struct {
+	MaxDurationSeconds int64     `json:"max_duration_seconds"`
+	NegotiatedAt       time.Time `json:"negotiated_at"`
+}
+
+// isDurationExceeded tells STS rejected DurationSeconds which exceeds MaxSessionDuration of the role.
+func isDurationExceeded(err error) bool {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		return aerr.Code() == "ValidationError" && strings.Contains(aerr.Message(), "MaxSessionDuration")
+	}
+	return false
+}
+
+// negotiateMaxDuration finds the max session duration of the role after STS rejected the duration.
+// The max is parsed from the error when it's included, otherwise read by iam:GetRole, otherwise 1 hour.
+func negotiateMaxDuration(client *OIDCClient, roleArn string, err error) int64 {
+	if aerr, ok := errors.Cause(err).(awserr.Error); ok {
+		if m := maxDurationPattern.FindStringSubmatch(aerr.Message()); m != nil {
+			if max, err := strconv.ParseInt(m[1], 10, 64); err == nil && max > 0 {
+				return max
+			}
+		}
+	}
+	max, err := roleMaxSessionDuration(client, roleArn)
+	if err != nil {
+		Traceln("Can't read the max session duration of the role, requesting %d seconds: %v", fallbackMaxDuration, err)
+		return fallbackMaxDuration
+	}
+	return max
+}
+
+func loadNegotiatedDurations() map[string]negotiatedDuration {
+	durations := map[string]negotiatedDuration{}
+	b, err := os.ReadFile(filepath.Join(CachePath(), sessionDurationsFile))
+	if err != nil {
+		return durations
+	}
+	if err := json.Unmarshal(b, &durations); err != nil {
+		Traceln("Ignoring the broken %s: %v", sessionDurationsFile, err)
+		return map[string]negotiatedDuration{}
+	}
+	return durations
+}
+
+// cachedMaxDuration returns the max session duration of the role negotiated by the previous runs.
+func cachedMaxDuration(roleArn string) (int64, bool) {
+	d, ok := loadNegotiatedDurations()[roleArn]
+	if !ok || time.Since(d.NegotiatedAt) > sessionDurationCacheAge {
+		return 0, false
+	}
+	return d.MaxDurationSeconds, true
+}
+
+// saveMaxDuration keeps the negotiated max of the role, the failure only costs the rejected request of the next run.
+func saveMaxDuration(roleArn string, max int64) {
+	durations := loadNegotiatedDurations()
+	durations[roleArn] = negotiatedDuration{MaxDurationSeconds: max, NegotiatedAt: time.Now()}
+	b, err := json.MarshalIndent(durations, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(CachePath(), 0700)
+	path := filepath.Join(CachePath(), sessionDurationsFile)
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		Traceln("Can't save %s: %v", path, err)
+	}
+}
@@ -0,0 +1,76 @@
+package lib
+
+import (
+	"encoding/base64"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+)
+
+const (
+	eksTokenPrefix     = "k8s-aws-v1."
+	eksClusterIDHeader = "x-k8s-aws-id"
+	// The presigned URL is signed for 60 seconds, but EKS accepts it for 15 minutes from the signing.
+	// kubectl refreshes it a minute earlier like aws-iam-authenticator.
+	eksPresignExpiry = 60 * time.Second
+	eksTokenLifetime = 14 * time.Minute
+
+	EKS_EXEC_CREDENTIAL_API_VERSION = "client.authentication.k8s.io/v1beta1"
+)
+
+// ExecCredential is the output of the client-go credential plugin, which kubectl reads from the exec command.
+type ExecCredential struct {
+	Kind       string               `json:"kind"`
+	APIVersion string               `json:"apiVersion"`
+	Spec       struct{}             `json:"spec"`
+	Status     ExecCredentialStatus `json:"status"`
+}
+
+type ExecCredentialStatus struct {
+	ExpirationTimestamp time.Time `json:"expirationTimestamp"`
+	Token               string    `json:"token"`
+}
+
+// EKSToken returns the bearer token of the EKS cluster in the same way as aws-iam-authenticator and "aws eks get-token".
+// The token is the sts:GetCallerIdentity URL presigned by the credentials, with the cluster name in the signed header.
+func EKSToken(client *OIDCClient, cred *AWSCredentials, clusterName string) (*ExecCredential, error) {
+	if clusterName == "" {
+		return nil, errors.New("The EKS cluster name is required")
+	}
+
+	sess, configs, err := newAWSClientConfig(client, "sts")
+	if err != nil {
+		return nil, err
+	}
+	if ResolveRegion(client) == "" && aws.StringValue(sess.Config.Region) == "" {
+		// The global endpoint of STS
+		configs = append(configs, aws.NewConfig().WithRegion("us-east-1"))
+	}
+	configs = append(configs, aws.NewConfig().WithCredentials(
+		credentials.NewStaticCredentials(cred.AWSAccessKey, cred.AWSSecretKey, cred.AWSSessionToken)))
+	svc := sts.New(sess, configs...)
+
+	req, _ := svc.GetCallerIdentityRequest(&sts.GetCallerIdentityInput{})
+	req.HTTPRequest.Header.Add(eksClusterIDHeader, clusterName)
+	signedAt := time.Now()
+	presignedURL, err := req.Presign(eksPresignExpiry)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to presign the GetCallerIdentity request")
+	}
+
+	expires := signedAt.Add(eksTokenLifetime)
+	if !cred.Expires.IsZero() && cred.Expires.Before(expires) {
+		expires = cred.Expires
+	}
+	return &ExecCredential{
+		Kind:       "ExecCredential",
+		APIVersion: EKS_EXEC_CREDENTIAL_API_VERSION,
+		Status: ExecCredentialStatus{
+			ExpirationTimestamp: expires.UTC(),
+			Token:               eksTokenPrefix + base64.RawURLEncoding.EncodeToString([]byte(presignedURL)),
+		},
+	}, nil
+}
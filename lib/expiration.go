@@ -0,0 +1,37 @@
+package lib
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// CachedExpiration returns the expiration of the cached credentials of the role only from the secret store,
+// without the OIDC provider nor STS. The duration is the requested one, max_session_duration_seconds if it's 0.
+func CachedExpiration(name, roleArn string, durationSeconds int64) (time.Time, error) {
+	config := viper.Sub(name)
+	if config == nil {
+		return time.Time{}, errors.Errorf("The OIDC provider %s is not configured", name)
+	}
+	if roleArn == "" {
+		roleArn = config.GetString(DEFAULT_IAM_ROLE_ARN)
+	}
+
+	store, err := NewCredentialStore(name, config)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if durationSeconds <= 0 {
+		durationSeconds, _ = strconv.ParseInt(config.GetString(MAX_SESSION_DURATION_SECONDS), 10, 64)
+	}
+	cred, err := AWSCredential(store, roleArn, durationSeconds, nil)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "No cached session")
+	}
+	if cred.Expires.IsZero() || !time.Now().Before(cred.Expires) {
+		return time.Time{}, errors.Errorf("The cached session of %s has expired", roleArn)
+	}
+	return cred.Expires, nil
+}
@@ -0,0 +1,64 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/pkg/errors"
+)
+
+// OUTPUT_FORMAT_FULL_JSON is the credentials with the identity and the region, for the wrapper scripts
+const OUTPUT_FORMAT_FULL_JSON = "full-json"
+
+type FullCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	SessionToken    string
+	Expiration      time.Time
+	AccountId       string
+	// Arn is the assumed role session
+	Arn     string
+	RoleArn string
+	Region  string
+	// Scopes are granted by the login, only with --include-scopes
+	Scopes []string `json:",omitempty"`
+}
+
+// NewFullCredentials adds the identity and the region to the credentials of the role. The cached credentials
+// don't have the ARN of the session, so it's asked by sts:GetCallerIdentity.
+func NewFullCredentials(client *OIDCClient, cred *AWSCredentials, roleArn string) (*FullCredentials, error) {
+	principalArn := cred.PrincipalARN
+	if principalArn == "" {
+		svc, err := newSTSClient(client, aws.NewConfig().WithCredentials(credentials.NewStaticCredentialsFromCreds(credentials.Value{
+			AccessKeyID:     cred.AWSAccessKey,
+			SecretAccessKey: cred.AWSSecretKey,
+			SessionToken:    cred.AWSSessionToken,
+		})))
+		if err != nil {
+			return nil, err
+		}
+		identity, err := svc.GetCallerIdentityWithContext(runContext(), &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get the caller identity")
+		}
+		principalArn = aws.StringValue(identity.Arn)
+	}
+	a, err := arn.Parse(principalArn)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the ARN of the session")
+	}
+
+	return &FullCredentials{
+		AccessKeyId:     cred.AWSAccessKey,
+		SecretAccessKey: cred.AWSSecretKey,
+		SessionToken:    cred.AWSSessionToken,
+		Expiration:      cred.Expires,
+		AccountId:       a.AccountID,
+		Arn:             principalArn,
+		RoleArn:         roleArn,
+		Region:          ResolveRegion(client),
+	}, nil
+}
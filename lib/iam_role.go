@@ -0,0 +1,53 @@
+package lib
+
+import (
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/service/iam"
+	"github.com/pkg/errors"
+)
+
+// clampToRoleMaxDuration lowers the duration to MaxSessionDuration of the role when max_duration_from_iam is enabled,
+// so that STS doesn't reject the request. The role is read by iam:GetRole with the credentials of the AWS SDK
+// default chain. The duration is kept as is when the role can't be read, e.g. without the permission.
+func clampToRoleMaxDuration(client *OIDCClient, roleArn string, duration int64) int64 {
+	if !client.config.GetBool(MAX_DURATION_FROM_IAM) {
+		return duration
+	}
+	max, err := roleMaxSessionDuration(client, roleArn)
+	if err != nil {
+		Traceln("Can't read the max session duration of the role, requesting %d seconds: %v", duration, err)
+		return duration
+	}
+	if duration > max {
+		Writeln("Requesting the session duration %d seconds, the max of the role", max)
+		return max
+	}
+	return duration
+}
+
+func roleMaxSessionDuration(client *OIDCClient, roleArn string) (int64, error) {
+	a, err := arn.Parse(roleArn)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to parse the role ARN")
+	}
+	// role/<path>/<name>
+	roleName := a.Resource[strings.LastIndex(a.Resource, "/")+1:]
+
+	sess, configs, err := newAWSClientConfig(client, "iam")
+	if err != nil {
+		return 0, err
+	}
+	output, err := iam.New(sess, configs...).GetRoleWithContext(runContext(), &iam.GetRoleInput{
+		RoleName: aws.String(roleName),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to get the role")
+	}
+	if output.Role == nil || output.Role.MaxSessionDuration == nil {
+		return 0, errors.New("The role has no max session duration")
+	}
+	return *output.Role.MaxSessionDuration, nil
+}
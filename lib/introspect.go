@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TokenIntrospection is the state of the access token.
+type TokenIntrospection struct {
+	Active    bool
+	Expires   time.Time
+	Scope     string
+	Audiences []string
+	// Local is true when the JWT is decoded by this tool because the OIDC provider has no introspection endpoint
+	Local bool
+}
+
+// IntrospectToken asks the introspection endpoint (RFC 7662) of the OIDC provider about the access token
+// with the client credentials. Without the endpoint, the JWT access token is decoded instead,
+// but the opaque one can't be inspected.
+func IntrospectToken(client *OIDCClient, accessToken string) (*TokenIntrospection, error) {
+	endpoint := client.metadata.IntrospectionEndpoint
+	if endpoint == "" {
+		endpoint = client.metadata.TokenIntrospectionEndpoint
+	}
+	if endpoint == "" {
+		claims, err := ParseJWTClaims(accessToken)
+		if err != nil {
+			return nil, errors.New("The OIDC provider doesn't support the introspection and the access token is not a JWT")
+		}
+		return newTokenIntrospection(claims, true), nil
+	}
+
+	form := client.ClientForm()
+	form.Set("token", accessToken)
+	form.Set("token_type_hint", "access_token")
+
+	res, err := client.restClient.Target(endpoint).Request().Form(form).Post()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to introspect the token")
+	}
+	if res.Status() != 200 {
+		return nil, errors.Errorf("Failed to introspect the token, statusCode: %d", res.Status())
+	}
+	var claims JWTClaims
+	if err := res.ReadJson(&claims); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the introspection response")
+	}
+	return newTokenIntrospection(claims, false), nil
+}
+
+func newTokenIntrospection(claims JWTClaims, local bool) *TokenIntrospection {
+	ti := &TokenIntrospection{
+		Audiences: claims.Audiences(),
+		Local:     local,
+	}
+	ti.Scope, _ = claims["scope"].(string)
+	exp, hasExp := claims.Expiry()
+	if hasExp {
+		ti.Expires = exp
+	}
+	if local {
+		ti.Active = !hasExp || time.Now().Before(exp)
+	} else {
+		ti.Active, _ = claims["active"].(bool)
+	}
+	return ti
+}
+
+// CurrentAccessToken gets the access token by the refresh token in the secret store, without the browser.
+// The rotated refresh token is saved back.
+func CurrentAccessToken(client *OIDCClient) (string, error) {
+	store, err := NewCredentialStore(client.Name(), client.config)
+	if err != nil {
+		return "", err
+	}
+	session, err := LoadProviderSession(store, client.Name())
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to load the OIDC session of %s", client.Name())
+	}
+	if err := checkRefreshTokenEnabled(client, store, session); err != nil {
+		return "", err
+	}
+	if session.RefreshToken == "" {
+		return "", errors.Errorf("No refresh token is stored for %s, login with --use-secret first or pass the access token", client.Name())
+	}
+
+	tokenResponse, err := refreshToken(client, session.RefreshToken)
+	if err != nil {
+		return "", err
+	}
+	if tokenResponse.RefreshToken != "" && tokenResponse.RefreshToken != session.RefreshToken {
+		session.RefreshToken = tokenResponse.RefreshToken
+		if err := SaveProviderSession(store, client.Name(), session); err != nil {
+			Writeln("Can't save the OIDC session: %v", err)
+		}
+	}
+	if strings.TrimSpace(tokenResponse.AccessToken) == "" {
+		return "", errors.New("The OIDC provider didn't return an access token on the refresh")
+	}
+	return tokenResponse.AccessToken, nil
+}
@@ -0,0 +1,146 @@
+package lib
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JWTClaims is the decoded payload of a JWT. The signature isn't verified here,
+// AWS STS verifies it with the JWKS of the OIDC provider.
+type JWTClaims map[string]interface{}
+
+func ParseJWTClaims(token string) (JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("The token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to decode the JWT payload")
+	}
+	var claims JWTClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the JWT payload")
+	}
+	return claims, nil
+}
+
+// JWTAlgorithm returns the alg header of the JWT.
+func JWTAlgorithm(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("The token is not a JWT")
+	}
+	header, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "="))
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to decode the JWT header")
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(header, &h); err != nil {
+		return "", errors.Wrap(err, "Failed to parse the JWT header")
+	}
+	return h.Alg, nil
+}
+
+// Audiences returns the aud claim, which can be either a string or an array.
+func (c JWTClaims) Audiences() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var auds []string
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+		return auds
+	}
+	return nil
+}
+
+// Expiry returns the exp claim, the second value is false when it doesn't exist.
+func (c JWTClaims) Expiry() (time.Time, bool) {
+	exp, ok := c["exp"].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(exp), 0), true
+}
+
+// AWSSessionTags returns the session tags and the transitive tag keys of the https://aws.amazon.com/tags claim,
+// which STS applies to the session of AssumeRoleWithWebIdentity.
+func (c JWTClaims) AWSSessionTags() (map[string]string, []string) {
+	tags := map[string]string{}
+	var transitive []string
+
+	claim, ok := c["https://aws.amazon.com/tags"].(map[string]interface{})
+	if !ok {
+		return tags, nil
+	}
+	if principalTags, ok := claim["principal_tags"].(map[string]interface{}); ok {
+		for key, v := range principalTags {
+			// The values are the arrays of a single string
+			if values, ok := v.([]interface{}); ok && len(values) > 0 {
+				if s, ok := values[0].(string); ok {
+					tags[key] = s
+				}
+			}
+		}
+	}
+	if keys, ok := claim["transitive_tag_keys"].([]interface{}); ok {
+		for _, k := range keys {
+			if s, ok := k.(string); ok {
+				transitive = append(transitive, s)
+			}
+		}
+	}
+	return tags, transitive
+}
+
+func (c JWTClaims) HasAudience(audience string) bool {
+	for _, aud := range c.Audiences() {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// Scopes returns the scope claim of the access token (RFC 9068), or the scp claim which some OIDC providers use.
+func (c JWTClaims) Scopes() []string {
+	if s, ok := c["scope"].(string); ok {
+		return strings.Fields(s)
+	}
+	switch scp := c["scp"].(type) {
+	case string:
+		return strings.Fields(scp)
+	case []interface{}:
+		var scopes []string
+		for _, v := range scp {
+			if s, ok := v.(string); ok {
+				scopes = append(scopes, s)
+			}
+		}
+		return scopes
+	}
+	return nil
+}
+
+// AMR returns the amr claim, the authentication methods such as pwd and mfa.
+func (c JWTClaims) AMR() []string {
+	values, _ := c["amr"].([]interface{})
+	var amr []string
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			amr = append(amr, s)
+		}
+	}
+	return amr
+}
@@ -4,26 +4,79 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strings"
 )
 
 var IsTraceEnabled bool
 
+// IsQuiet suppresses the messages to stderr except the error on exit
+var IsQuiet bool
+
 func Write(format string, msg ...interface{}) {
+	if IsQuiet {
+		return
+	}
 	fmt.Fprintf(os.Stderr, format, msg...)
 }
 
 func Writeln(format string, msg ...interface{}) {
+	if IsQuiet {
+		return
+	}
 	fmt.Fprintln(os.Stderr, fmt.Sprintf(format, msg...))
 }
 
-func Export(key string, value string) {
-	var msg string
-	if runtime.GOOS == "windows" {
-		msg = fmt.Sprintf("set %s=%s\n", key, value)
-	} else {
-		msg = fmt.Sprintf("export %s=%s\n", key, value)
+const SHELL_SH = "sh"
+const SHELL_CMD = "cmd"
+const SHELL_POWERSHELL = "powershell"
+
+// exportShell returns the shell which evaluates the export lines: AWS_CLI_OIDC_SHELL if it's set, otherwise sh,
+// or cmd or PowerShell on Windows. PowerShell adds the modules directory under the user profile to PSModulePath,
+// while cmd only has the system ones.
+func exportShell(goos string, getenv func(string) string) string {
+	if shell := getenv("AWS_CLI_OIDC_SHELL"); shell != "" {
+		return shell
+	}
+	if goos != "windows" {
+		return SHELL_SH
+	}
+	profile := strings.ToLower(getenv("USERPROFILE"))
+	if profile != "" {
+		for _, dir := range strings.Split(getenv("PSModulePath"), ";") {
+			if strings.HasPrefix(strings.ToLower(dir), profile) {
+				return SHELL_POWERSHELL
+			}
+		}
+	}
+	return SHELL_CMD
+}
+
+func exportLine(shell, key, value string) string {
+	switch shell {
+	case SHELL_CMD:
+		return fmt.Sprintf("set %s=%s\n", key, value)
+	case SHELL_POWERSHELL:
+		return fmt.Sprintf("$env:%s=\"%s\"\n", key, value)
 	}
-	fmt.Fprint(os.Stdout, msg)
+	return fmt.Sprintf("export %s=%s\n", key, value)
+}
+
+func unsetLine(shell, key string) string {
+	switch shell {
+	case SHELL_CMD:
+		return fmt.Sprintf("set %s=\n", key)
+	case SHELL_POWERSHELL:
+		return fmt.Sprintf("Remove-Item Env:%s -ErrorAction SilentlyContinue\n", key)
+	}
+	return fmt.Sprintf("unset %s\n", key)
+}
+
+func Export(key string, value string) {
+	fmt.Fprint(os.Stdout, exportLine(exportShell(runtime.GOOS, os.Getenv), key, value))
+}
+
+func Unset(key string) {
+	fmt.Fprint(os.Stdout, unsetLine(exportShell(runtime.GOOS, os.Getenv), key))
 }
 
 func Traceln(format string, msg ...interface{}) {
@@ -34,7 +87,10 @@ func Traceln(format string, msg ...interface{}) {
 
 func Exit(err error) {
 	if err != nil {
-		Writeln(err.Error())
+		fmt.Fprintln(os.Stderr, err.Error())
+	}
+	if isTimedOut() {
+		os.Exit(EXIT_CODE_TIMEOUT)
 	}
 	os.Exit(1)
 }
@@ -0,0 +1,53 @@
+package lib
+
+import "testing"
+
+func TestExportShell(t *testing.T) {
+	tests := []struct {
+		name string
+		goos string
+		env  map[string]string
+		want string
+	}{
+		{"linux", "linux", nil, SHELL_SH},
+		{"cmd", "windows", map[string]string{
+			"USERPROFILE":  `C:\Users\me`,
+			"PSModulePath": `C:\Program Files\WindowsPowerShell\Modules;C:\Windows\system32\WindowsPowerShell\v1.0\Modules`,
+		}, SHELL_CMD},
+		{"powershell", "windows", map[string]string{
+			"USERPROFILE":  `C:\Users\me`,
+			"PSModulePath": `c:\users\me\Documents\WindowsPowerShell\Modules;C:\Program Files\WindowsPowerShell\Modules`,
+		}, SHELL_POWERSHELL},
+		{"overridden", "linux", map[string]string{"AWS_CLI_OIDC_SHELL": SHELL_POWERSHELL}, SHELL_POWERSHELL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string { return tt.env[key] }
+			if got := exportShell(tt.goos, getenv); got != tt.want {
+				t.Errorf("exportShell() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportAndUnsetLines(t *testing.T) {
+	tests := []struct {
+		shell      string
+		wantExport string
+		wantUnset  string
+	}{
+		{SHELL_SH, "export AWS_PROFILE=dev\n", "unset AWS_PROFILE\n"},
+		{SHELL_CMD, "set AWS_PROFILE=dev\n", "set AWS_PROFILE=\n"},
+		{SHELL_POWERSHELL, "$env:AWS_PROFILE=\"dev\"\n", "Remove-Item Env:AWS_PROFILE -ErrorAction SilentlyContinue\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.shell, func(t *testing.T) {
+			if got := exportLine(tt.shell, "AWS_PROFILE", "dev"); got != tt.wantExport {
+				t.Errorf("exportLine() = %q, want %q", got, tt.wantExport)
+			}
+			if got := unsetLine(tt.shell, "AWS_PROFILE"); got != tt.wantUnset {
+				t.Errorf("unsetLine() = %q, want %q", got, tt.wantUnset)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package lib
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+
+	pkce "github.com/nirasan/go-oauth-pkce-code-verifier"
+	"github.com/pkg/errors"
+)
+
+// newCodeVerifier and newState generate the PKCE code_verifier and the state of the authorization request.
+// They're random, the tests fix them to assert the requests against the mock OIDC provider.
+var newCodeVerifier = func() (*pkce.CodeVerifier, error) {
+	return pkce.CreateCodeVerifierWithLength(pkce.MaxLength)
+}
+
+var newState = func() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "Cannot generate OAuth2 state")
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// newCorrelationID identifies the failed login on both the callback page and the CLI error, for the support tickets.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	pkce "github.com/nirasan/go-oauth-pkce-code-verifier"
+)
+
+// fixLoginParams fixes the code_verifier and the state of the authorization requests in the test.
+func fixLoginParams(t *testing.T, codeVerifier, state string) {
+	t.Helper()
+	origCodeVerifier, origState := newCodeVerifier, newState
+	t.Cleanup(func() { newCodeVerifier, newState = origCodeVerifier, origState })
+	newCodeVerifier = func() (*pkce.CodeVerifier, error) {
+		return &pkce.CodeVerifier{Value: codeVerifier}, nil
+	}
+	newState = func() (string, error) {
+		return state, nil
+	}
+}
+
+// browseWith emulates the browser which rewrites the authorization URL before opening it.
+func browseWith(t *testing.T, rewrite func(authURL *url.URL)) {
+	t.Helper()
+	origOpenBrowser := openBrowser
+	t.Cleanup(func() { openBrowser = origOpenBrowser })
+	openBrowser = func(authURL string) error {
+		u, err := url.Parse(authURL)
+		if err != nil {
+			return err
+		}
+		rewrite(u)
+		res, err := http.Get(u.String())
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+}
+
+func TestAuthorizationRequestWithFixedLoginParams(t *testing.T) {
+	f := newSelftestFixture(t)
+	codeVerifier := strings.Repeat("v", pkce.MaxLength)
+	fixLoginParams(t, codeVerifier, "fixed-state")
+
+	var query url.Values
+	browseWith(t, func(authURL *url.URL) {
+		query = authURL.Query()
+	})
+	f.login(t, f.client(t, nil))
+
+	want := (&pkce.CodeVerifier{Value: codeVerifier}).CodeChallengeS256()
+	if got := query.Get("code_challenge"); got != want || query.Get("code_challenge_method") != "S256" {
+		t.Errorf("code_challenge = %s %s, want %s S256", got, query.Get("code_challenge_method"), want)
+	}
+	if got := query.Get("state"); got != "fixed-state" {
+		t.Errorf("state = %s, want fixed-state", got)
+	}
+}
+
+func TestAuthorizationResponseWithAnotherStateIsRejected(t *testing.T) {
+	f := newSelftestFixture(t)
+	fixLoginParams(t, strings.Repeat("v", pkce.MaxLength), "fixed-state")
+
+	browseWith(t, func(authURL *url.URL) {
+		q := authURL.Query()
+		q.Set("state", "forged-state")
+		authURL.RawQuery = q.Encode()
+	})
+	client := f.client(t, nil)
+	_, err := doLogin(client, ResolveRoleConfig(client.config, selftestRoleArn), &AuthenticateOptions{LoginFlow: LOGIN_FLOW_LOOPBACK})
+	if err == nil || !strings.Contains(err.Error(), "state") {
+		t.Errorf("The response with another state should be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DEFAULT_LOGIN_RETRY_BACKOFF = 1 * time.Second
+const maxLoginRetryBackoff = 30 * time.Second
+
+var loginRetryJitter = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// serverError is the 5xx response of the OIDC provider which remains after the retries of the request itself.
+type serverError struct {
+	error
+}
+
+func (e *serverError) Unwrap() error {
+	return e.error
+}
+
+// loginWithRetry runs the login up to login_max_attempts times while it fails transiently, e.g. the OIDC provider
+// is briefly unavailable. The attempts are spaced by the exponential backoff with jitter, and they stop at the
+// deadline of --timeout.
+func loginWithRetry(client *OIDCClient, role *RoleConfig, opts *AuthenticateOptions) (*TokenResponse, error) {
+	maxAttempts := client.config.GetInt(LOGIN_MAX_ATTEMPTS)
+	base := DEFAULT_LOGIN_RETRY_BACKOFF
+	if client.config.IsSet(LOGIN_RETRY_BACKOFF) {
+		base = time.Duration(client.config.GetFloat64(LOGIN_RETRY_BACKOFF) * float64(time.Second))
+	}
+
+	for attempt := 1; ; attempt++ {
+		tokenResponse, err := login(client, role, opts)
+		if err == nil || attempt >= maxAttempts || !isTransientLoginError(err) {
+			return tokenResponse, err
+		}
+
+		wait := loginRetryBackoff(base, attempt)
+		if deadline, ok := runContext().Deadline(); ok && time.Until(deadline) < wait {
+			Writeln("The login attempt %d failed, not retrying as the timeout expires before the next attempt", attempt)
+			return nil, err
+		}
+		Writeln("The login attempt %d of %d failed: %v, retrying in %s", attempt, maxAttempts, err, wait.Round(time.Millisecond))
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-runContext().Done():
+			timer.Stop()
+			return nil, err
+		}
+	}
+}
+
+// loginRetryBackoff doubles the base for each attempt up to maxLoginRetryBackoff, then picks a random wait between
+// its half and itself, so that the clients failed at once don't retry at once.
+func loginRetryBackoff(base time.Duration, attempt int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	wait := base
+	for i := 1; i < attempt && wait < maxLoginRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxLoginRetryBackoff {
+		wait = maxLoginRetryBackoff
+	}
+	return wait/2 + time.Duration(loginRetryJitter.Int63n(int64(wait/2)+1))
+}
+
+// isTransientLoginError tells whether the login may succeed by trying again. The decisions of the user or the OIDC
+// provider, e.g. access_denied by the consent, and the misconfigurations fail again, so they aren't retried.
+func isTransientLoginError(err error) bool {
+	if isTimedOut() || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var authErr *AuthorizationError
+	if errors.As(err, &authErr) {
+		// RFC 6749 4.1.2.1
+		return authErr.Code == "temporarily_unavailable" || authErr.Code == "server_error"
+	}
+	var srvErr *serverError
+	if errors.As(err, &srvErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
@@ -0,0 +1,150 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestIsTransientLoginError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"access_denied", &AuthorizationError{Code: "access_denied"}, false},
+		{"invalid_scope", &AuthorizationError{Code: "invalid_scope"}, false},
+		{"temporarily_unavailable", &AuthorizationError{Code: "temporarily_unavailable"}, true},
+		{"server_error", errors.Wrap(&AuthorizationError{Code: "server_error"}, "Login failed"), true},
+		{"5xx of the token endpoint", &serverError{errors.New("503 Service Unavailable")}, true},
+		{"network error", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"canceled", errors.Wrap(context.Canceled, "Login failed"), false},
+		{"deadline exceeded", context.DeadlineExceeded, false},
+		{"invalid_grant", errors.New("invalid_grant"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTransientLoginError(tt.err); got != tt.want {
+				t.Errorf("isTransientLoginError() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoginRetryBackoff(t *testing.T) {
+	tests := []struct {
+		base    time.Duration
+		attempt int
+		max     time.Duration
+	}{
+		{time.Second, 1, time.Second},
+		{time.Second, 2, 2 * time.Second},
+		{time.Second, 3, 4 * time.Second},
+		{time.Second, 10, maxLoginRetryBackoff},
+		{time.Minute, 1, maxLoginRetryBackoff},
+		{0, 3, 0},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s attempt %d", tt.base, tt.attempt), func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := loginRetryBackoff(tt.base, tt.attempt); got < tt.max/2 || got > tt.max {
+					t.Fatalf("loginRetryBackoff() = %s, want between %s and %s", got, tt.max/2, tt.max)
+				}
+			}
+		})
+	}
+}
+
+// browseFailing answers the authorization request by the error while failures remain, then logs in.
+// It returns the number of the authorization requests.
+func browseFailing(t *testing.T, f *selftestFixture, code string, failures int) func() int {
+	t.Helper()
+	var mu sync.Mutex
+	opened := 0
+	browseBy(t, func(authURL string) error {
+		mu.Lock()
+		opened++
+		fail := opened <= failures
+		mu.Unlock()
+		if fail {
+			q, err := url.Parse(authURL)
+			if err != nil {
+				return err
+			}
+			redirect := q.Query().Get("redirect_uri") + "?" + url.Values{
+				"error": {code}, "state": {q.Query().Get("state")}, "iss": {f.idp.server.URL},
+			}.Encode()
+			authURL = redirect
+		}
+		res, err := http.Get(authURL)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	})
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return opened
+	}
+}
+
+func TestLoginWithRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		code       string
+		failures   int
+		wantErr    bool
+		wantOpened int
+	}{
+		{"access_denied is not retried", "access_denied", 1, true, 1},
+		{"temporarily_unavailable is retried", "temporarily_unavailable", 2, false, 3},
+		{"retries stop at login_max_attempts", "server_error", 3, true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newSelftestFixture(t)
+			opened := browseFailing(t, f, tt.code, tt.failures)
+			client := f.client(t, map[string]string{LOGIN_MAX_ATTEMPTS: "3", LOGIN_RETRY_BACKOFF: "0.01"})
+
+			_, err := loginWithRetry(client, ResolveRoleConfig(client.config, selftestRoleArn), &AuthenticateOptions{LoginFlow: LOGIN_FLOW_LOOPBACK})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loginWithRetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := opened(); got != tt.wantOpened {
+				t.Errorf("The login should be attempted %d times, got %d", tt.wantOpened, got)
+			}
+		})
+	}
+}
+
+func TestLoginWithRetryStopsAtDeadline(t *testing.T) {
+	f := newSelftestFixture(t)
+	opened := browseFailing(t, f, "temporarily_unavailable", 1)
+	client := f.client(t, map[string]string{LOGIN_MAX_ATTEMPTS: "3", LOGIN_RETRY_BACKOFF: "10"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	origRunCtx := runCtx
+	runCtx = ctx
+	defer func() { runCtx = origRunCtx }()
+
+	started := time.Now()
+	_, err := loginWithRetry(client, ResolveRoleConfig(client.config, selftestRoleArn), &AuthenticateOptions{LoginFlow: LOGIN_FLOW_LOOPBACK})
+	if err == nil {
+		t.Fatal("The login shouldn't be retried after the deadline")
+	}
+	if got := opened(); got != 1 {
+		t.Errorf("The login should be attempted once, got %d", got)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("The login should give up without waiting for the backoff, took %s", elapsed)
+	}
+}
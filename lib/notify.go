@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// NotifyLoginCompleted tells the user who tabbed away during the browser login that it's done.
+// It uses the desktop notification when available, otherwise rings the terminal bell.
+func NotifyLoginCompleted(message string) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("osascript", "-e", fmt.Sprintf("display notification %q with title %q", message, "aws-cli-oidc"))
+	case "linux", "freebsd", "openbsd", "netbsd":
+		if _, err := exec.LookPath("notify-send"); err == nil {
+			cmd = exec.Command("notify-send", "aws-cli-oidc", message)
+		}
+	}
+
+	if cmd != nil {
+		if err := cmd.Run(); err == nil {
+			return
+		}
+	}
+
+	// The bell goes to stderr not to break the output
+	fmt.Fprint(os.Stderr, "\a")
+}
@@ -0,0 +1,216 @@
+package lib
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	"github.com/zalando/go-keyring"
+)
+
+const (
+	PREFLIGHT_OK   = "ok"
+	PREFLIGHT_FAIL = "fail"
+	PREFLIGHT_SKIP = "skip"
+
+	preflightKey = "aws-cli-oidc-preflight"
+)
+
+type PreflightOptions struct {
+	// Providers to check, all the configured providers if empty
+	Providers []string
+	// SkipKeyring skips the check of the secret backend, e.g. on the headless CI without it
+	SkipKeyring bool
+}
+
+type PreflightCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type PreflightProviderReport struct {
+	Provider string            `json:"provider"`
+	OK       bool              `json:"ok"`
+	Checks   []*PreflightCheck `json:"checks"`
+}
+
+type PreflightReport struct {
+	OK        bool                       `json:"ok"`
+	Providers []*PreflightProviderReport `json:"providers"`
+}
+
+// Preflight validates the config of the providers without login, for the admins who roll out the config to many
+// machines. It checks the discovery, the endpoints, the JWKS, the clock skew, the callback port and the secret backend.
+func Preflight(opts *PreflightOptions) *PreflightReport {
+	providers := opts.Providers
+	if len(providers) == 0 {
+		providers = ProviderNames()
+	}
+
+	report := &PreflightReport{OK: true, Providers: []*PreflightProviderReport{}}
+	for _, name := range providers {
+		providerReport := preflightProvider(name, opts)
+		report.OK = report.OK && providerReport.OK
+		report.Providers = append(report.Providers, providerReport)
+	}
+	return report
+}
+
+func preflightProvider(name string, opts *PreflightOptions) *PreflightProviderReport {
+	report := &PreflightProviderReport{Provider: name, OK: true}
+	add := func(check string, err error) {
+		c := &PreflightCheck{Name: check, Status: PREFLIGHT_OK}
+		switch {
+		case err == errSkipped:
+			c.Status = PREFLIGHT_SKIP
+		case err != nil:
+			c.Status = PREFLIGHT_FAIL
+			c.Error = err.Error()
+			report.OK = false
+		}
+		report.Checks = append(report.Checks, c)
+	}
+
+	config := viper.Sub(name)
+	if config == nil || !config.IsSet(OIDC_PROVIDER_METADATA_URL) {
+		add("discovery", errors.Errorf("%s is not configured", name))
+		return report
+	}
+
+	// The discovery is checked live, not from the cache
+	client, err := InitializeClient(nil, name, map[string]string{DISCOVERY_CACHE_SECONDS: "0"})
+	add("discovery", err)
+	if err != nil {
+		add("endpoints", errSkipped)
+		add("jwks", errSkipped)
+		add("clock_skew", errSkipped)
+	} else {
+		add("endpoints", preflightEndpoints(client))
+		add("jwks", preflightJWKS(client))
+		add("clock_skew", checkClockSkew(client))
+	}
+	add("callback_port", preflightCallbackPort(config))
+	if opts.SkipKeyring {
+		add("secret_backend", errSkipped)
+	} else {
+		add("secret_backend", preflightSecretBackend(name, config))
+	}
+	return report
+}
+
+func preflightEndpoints(client *OIDCClient) error {
+	allowInsecure := client.config.GetBool(ALLOW_INSECURE_METADATA)
+	endpoints := map[string]string{
+		"authorization_endpoint":        client.metadata.AuthorizationEndpoint,
+		"token_endpoint":                client.metadata.TokenEndpoint,
+		"jwks_uri":                      client.metadata.JwksURI,
+		"device_authorization_endpoint": client.metadata.DeviceAuthorizationEndpoint,
+	}
+	for key, endpoint := range endpoints {
+		if endpoint == "" {
+			if key == "jwks_uri" {
+				return errors.New("jwks_uri is missing in the OIDC metadata, AWS STS can't verify the ID token")
+			}
+			continue
+		}
+		if err := ValidateMetadataURL(endpoint, allowInsecure); err != nil {
+			return errors.Wrapf(err, "Invalid %s", key)
+		}
+	}
+	return nil
+}
+
+func preflightJWKS(client *OIDCClient) error {
+	res, err := client.restClient.Target(client.metadata.JwksURI).Request().Get()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get JWKS")
+	}
+	if res.Status() != 200 {
+		return errors.Errorf("Failed to get JWKS, statusCode: %d", res.Status())
+	}
+	var jwks struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := res.ReadJson(&jwks); err != nil {
+		return errors.Wrap(err, "Failed to parse JWKS")
+	}
+	if len(jwks.Keys) == 0 {
+		return errors.New("JWKS has no keys")
+	}
+	return nil
+}
+
+// preflightCallbackPort binds the redirect URI candidates like the loopback login, one of them must be bindable.
+func preflightCallbackPort(config *viper.Viper) error {
+	if config.GetString(LOGIN_FLOW) == LOGIN_FLOW_DEVICE || config.GetString(LOGIN_FLOW) == LOGIN_FLOW_MANUAL ||
+		config.GetString(GRANT_TYPE) == GRANT_TYPE_CLIENT_CREDENTIALS {
+		return errSkipped
+	}
+	callbackHost := config.GetString(CALLBACK_HOST)
+	if callbackHost == "" {
+		callbackHost = "127.0.0.1"
+	}
+
+	candidates, port := redirectURICandidates(config)
+	var lastErr error
+	for _, redirectURI := range candidates {
+		addr, _, err := callbackAddress(redirectURI, callbackHost, port, callbackBasePath(config))
+		if err == nil {
+			err = checkLoopbackAddress(addr, config.GetBool(ALLOW_NON_LOOPBACK_CALLBACK))
+		}
+		if err != nil {
+			lastErr = errors.Wrap(err, redirectURI)
+			continue
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			lastErr = errors.Wrap(err, redirectURI)
+			continue
+		}
+		return listener.Close()
+	}
+	return lastErr
+}
+
+// preflightSecretBackend saves, loads and deletes a dummy entry. The entries of the cached credentials aren't touched.
+// The backend which can't delete the entry is only read, so that the check leaves nothing behind.
+func preflightSecretBackend(name string, config *viper.Viper) error {
+	backend := config.GetString(SECRET_BACKEND)
+	if backend == "" || backend == DEFAULT_SECRET_BACKEND {
+		if err := keyring.Set(preflightKey, secretUser, "ok"); err != nil {
+			return err
+		}
+		defer keyring.Delete(preflightKey, secretUser)
+		v, err := keyring.Get(preflightKey, secretUser)
+		if err != nil {
+			return err
+		}
+		if v != "ok" {
+			return errors.New("The loaded secret differs from the saved one")
+		}
+		return nil
+	}
+
+	store, err := NewCredentialStore(name, config)
+	if err != nil {
+		return err
+	}
+	if _, ok := store.(*namespacedStore).backend.(CredentialDeleter); !ok {
+		if _, err := store.Get(preflightKey); err != nil && err != ErrCredentialNotFound {
+			return err
+		}
+		return nil
+	}
+	if err := store.Set(preflightKey, "ok"); err != nil {
+		return err
+	}
+	v, err := store.Get(preflightKey)
+	if err == nil && v != "ok" {
+		err = errors.New("The loaded secret differs from the saved one")
+	}
+	if deleteErr := store.(CredentialDeleter).Delete(preflightKey); err == nil {
+		err = deleteErr
+	}
+	return err
+}
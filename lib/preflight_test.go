@@ -0,0 +1,27 @@
+package lib
+
+import "testing"
+
+func TestPreflightSecretBackendLeavesNoEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend func(entries map[string]string) CredentialStore
+	}{
+		{"backend with delete", func(entries map[string]string) CredentialStore { return memoryStore(entries) }},
+		{"backend without delete", func(entries map[string]string) CredentialStore { return getSetStore(entries) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries := map[string]string{}
+			useCredentialStore(t, "test-preflight", tt.backend(entries))
+			config := newTestClient(map[string]interface{}{SECRET_BACKEND: "test-preflight"}).config
+
+			if err := preflightSecretBackend("myop", config); err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("The check should leave no entry, got %v", entries)
+			}
+		})
+	}
+}
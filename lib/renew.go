@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type RenewOptions struct {
+	// Buffer renews the credentials which expire within it
+	Buffer time.Duration
+	// TokenFile is rewritten with the refreshed ID token, in TokenFileFormat: jwt or json
+	TokenFile       string
+	TokenFileFormat string
+}
+
+// Renew refreshes the cached AWS credentials of the provider which are expiring soon, using the stored refresh token.
+// It returns an error only when every renewal fails.
+func Renew(client *OIDCClient, opts *RenewOptions) error {
+	store, err := NewCredentialStore(client.Name(), client.config)
+	if err != nil {
+		return err
+	}
+	session, err := LoadProviderSession(store, client.Name())
+	if err != nil {
+		return err
+	}
+	if err := checkRefreshTokenEnabled(client, store, session); err != nil {
+		return err
+	}
+	if session.RefreshToken == "" {
+		return errors.Errorf("No refresh token is stored for %s, run get-cred with --use-secret first", client.Name())
+	}
+
+	durationSeconds := configuredDuration(client)
+
+	var idToken, scope string
+	var renewed, failed int
+	var lastErr error
+	roles := session.Roles
+	for _, roleArn := range session.RoleArns {
+		roles = append(roles, CachedRole{RoleArn: roleArn, DurationSeconds: durationSeconds})
+	}
+
+	for _, role := range roles {
+		roleArn := role.RoleArn
+		cred, err := AWSCredential(store, roleArn, role.DurationSeconds, role.Policy)
+		if err == nil && time.Until(cred.Expires) > opts.Buffer {
+			Writeln("The credentials of %s are valid until %s", roleArn, cred.Expires.Format(time.RFC3339))
+			continue
+		}
+
+		if idToken == "" {
+			tokenResponse, err := refreshToken(client, session.RefreshToken)
+			if err != nil {
+				return err
+			}
+			idToken = tokenResponse.IDToken
+			scope = grantedScope(client, tokenResponse)
+			if opts.TokenFile != "" {
+				if err := WriteTokenFile(opts.TokenFile, opts.TokenFileFormat, idToken); err != nil {
+					return err
+				}
+			}
+			if tokenResponse.RefreshToken != "" {
+				// The refresh token may be rotated
+				session.RefreshToken = tokenResponse.RefreshToken
+				if err := SaveProviderSession(store, client.Name(), session); err != nil {
+					Writeln("Can't save the OIDC session: %v", err)
+				}
+			}
+		}
+
+		cred, err = GetCredentialsWithOIDCOptions(client, idToken, roleArn, role.DurationSeconds, &AssumeRoleOptions{Policy: role.Policy})
+		if err != nil {
+			Writeln("Failed to renew the credentials of %s: %v", roleArn, err)
+			lastErr = err
+			failed++
+			continue
+		}
+		cred.Scope = client.Scope()
+		cred.GrantedScope = scope
+		SaveAWSCredential(store, roleArn, role.DurationSeconds, role.Policy, cred)
+		Writeln("Renewed the credentials of %s", roleArn)
+		renewed++
+	}
+
+	if failed > 0 && renewed == 0 {
+		return errors.Wrap(lastErr, "Failed to renew every credential")
+	}
+	return nil
+}
+
+func refreshToken(client *OIDCClient, refreshToken string) (*TokenResponse, error) {
+	form := client.ClientForm()
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", refreshToken)
+	form.Set("scope", client.Scope())
+
+	res, err := client.Token().Request().Form(form).Post()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to refresh the token")
+	}
+
+	if res.Status() != 200 {
+		if res.MediaType() != "" {
+			var json map[string]interface{}
+			err := res.ReadJson(&json)
+			if err == nil {
+				if json["error"] == "invalid_client" {
+					return nil, invalidClientError(client.Name(), json["error_description"])
+				}
+				return nil, errors.Errorf("Failed to refresh the token, error: %s error_description: %s",
+					json["error"], json["error_description"])
+			}
+		}
+		return nil, errors.Errorf("Failed to refresh the token, statusCode: %d", res.Status())
+	}
+
+	var tokenResponse TokenResponse
+	if err := res.ReadJson(&tokenResponse); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse the token response")
+	}
+	if tokenResponse.IDToken == "" {
+		return nil, errors.New("The OIDC provider didn't return an ID token on the refresh")
+	}
+	if err := validateSigningAlg(client, tokenResponse.IDToken); err != nil {
+		return nil, err
+	}
+	return &tokenResponse, nil
+}
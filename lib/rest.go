@@ -6,9 +6,11 @@ import (
 	"encoding/json"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 )
 
 // Wrapper around net/url and net/http.  Fluent style modeled from Java's JAX-RS
@@ -25,8 +27,18 @@ type RestClientConfig struct {
 	ClientKey          string
 	ClientCA           string
 	InsecureSkipVerify bool
+	// Timeout limits the whole request, DialTimeout and TLSHandshakeTimeout limit the connection setup.
+	// Zero means the default.
+	Timeout             time.Duration
+	DialTimeout         time.Duration
+	TLSHandshakeTimeout time.Duration
+	// Proxy is the proxy URL or "direct", the environment variables are used if it's empty
+	Proxy string
 }
 
+const DEFAULT_DIAL_TIMEOUT = 30 * time.Second
+const DEFAULT_TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
 type WebTarget struct {
 	url    url.URL
 	client *RestClient
@@ -46,12 +58,29 @@ type Response struct {
 func NewRestClient(config *RestClientConfig) (*RestClient, error) {
 	tlsConfig := &tls.Config{}
 
+	dialTimeout := config.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = DEFAULT_DIAL_TIMEOUT
+	}
+	tlsHandshakeTimeout := config.TLSHandshakeTimeout
+	if tlsHandshakeTimeout <= 0 {
+		tlsHandshakeTimeout = DEFAULT_TLS_HANDSHAKE_TIMEOUT
+	}
+
+	proxy, err := proxyFunc(config.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
 	tr := &http.Transport{
-		Proxy:           http.ProxyFromEnvironment,
-		TLSClientConfig: tlsConfig,
+		Proxy:               proxy,
+		TLSClientConfig:     tlsConfig,
+		DialContext:         (&net.Dialer{Timeout: dialTimeout}).DialContext,
+		TLSHandshakeTimeout: tlsHandshakeTimeout,
 	}
 	httpClient := &http.Client{
-		Transport: tr,
+		Timeout:   config.Timeout,
+		Transport: &debugTransport{base: tr},
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
@@ -136,7 +165,7 @@ func (r *Request) Header(name string, value string) *Request {
 }
 
 func (r *Request) Get() (*Response, error) {
-	request, _ := http.NewRequest("GET", r.url.String(), nil)
+	request, _ := http.NewRequestWithContext(runContext(), "GET", r.url.String(), nil)
 	request.Header = r.headers
 	res, err := r.client.httpClient.Do(request)
 	if err != nil {
@@ -146,7 +175,7 @@ func (r *Request) Get() (*Response, error) {
 }
 
 func (r *Request) Delete() (*Response, error) {
-	request, _ := http.NewRequest("DELETE", r.url.String(), nil)
+	request, _ := http.NewRequestWithContext(runContext(), "DELETE", r.url.String(), nil)
 	request.Header = r.headers
 	res, err := r.client.httpClient.Do(request)
 	if err != nil {
@@ -156,7 +185,7 @@ func (r *Request) Delete() (*Response, error) {
 }
 
 func (r *Request) Post() (*Response, error) {
-	request, _ := http.NewRequest("POST", r.url.String(), r.body)
+	request, _ := http.NewRequestWithContext(runContext(), "POST", r.url.String(), r.body)
 	request.Header = r.headers
 	res, err := r.client.httpClient.Do(request)
 	if err != nil {
@@ -166,7 +195,7 @@ func (r *Request) Post() (*Response, error) {
 }
 
 func (r *Request) Put() (*Response, error) {
-	request, err := http.NewRequest("Put", r.url.String(), r.body)
+	request, err := http.NewRequestWithContext(runContext(), "Put", r.url.String(), r.body)
 	if err != nil {
 		return nil, err
 	}
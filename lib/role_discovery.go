@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	input "github.com/natsukagami/go-input"
+	"github.com/pkg/errors"
+)
+
+// discoverRole finds the candidate role ARNs in the roles_claim of the ID token, or of the userinfo
+// when roles_from_userinfo is enabled, then lets the user select one of them.
+func discoverRole(client *OIDCClient, idToken string, tokenResponse *TokenResponse) (string, error) {
+	claimName := client.config.GetString(ROLES_CLAIM)
+	if claimName == "" {
+		return "", errors.Errorf("No role is specified, set -r option, %s or %s config", DEFAULT_IAM_ROLE_ARN, ROLES_CLAIM)
+	}
+
+	var claims JWTClaims
+	var err error
+	if client.config.GetBool(ROLES_FROM_USERINFO) {
+		if tokenResponse == nil || tokenResponse.AccessToken == "" {
+			return "", errors.New("No access token to fetch the userinfo")
+		}
+		claims, err = client.Userinfo(tokenResponse.AccessToken)
+	} else {
+		claims, err = ParseJWTClaims(idToken)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var roleArns []string
+	for _, roleArn := range rolesFromClaim(claims[claimName]) {
+		// Not to offer the roles which would be refused
+		if CheckAllowedRole(client, roleArn) == nil {
+			roleArns = append(roleArns, roleArn)
+		}
+	}
+	labels := roleLabels(client, claims)
+	switch len(roleArns) {
+	case 0:
+		return "", errors.Errorf("No IAM Role ARN is found in the %s claim", claimName)
+	case 1:
+		Writeln("Selected role: %s", describeRole(roleArns[0], labels))
+		return roleArns[0], nil
+	}
+
+	return selectRole(roleArns, labels)
+}
+
+// selectRole asks the user to select one of the roles by the label, or by the ARN if it has no label.
+func selectRole(roleArns []string, labels map[string]string) (string, error) {
+	options := make([]string, len(roleArns))
+	byOption := map[string]string{}
+	count := map[string]int{}
+	for _, roleArn := range roleArns {
+		count[roleLabel(roleArn, labels)]++
+	}
+	for i, roleArn := range roleArns {
+		option := roleLabel(roleArn, labels)
+		if count[option] > 1 {
+			// The same label to the roles, e.g. of the accounts, has to be told apart
+			option = describeRole(roleArn, labels)
+		}
+		options[i] = option
+		byOption[option] = roleArn
+	}
+
+	ui := &input.UI{
+		Writer: os.Stderr,
+		Reader: os.Stdin,
+	}
+	option, err := ui.Select("Select the role to assume:", options, &input.Options{
+		Required: true,
+		Loop:     true,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to select the role")
+	}
+	roleArn := byOption[option]
+	Writeln("Selected role: %s", describeRole(roleArn, labels))
+	return roleArn, nil
+}
+
+// roleLabels returns the friendly labels of the role ARNs from the role_labels_claim, which is an object of the
+// ARN to the label, and role_labels of the provider config which takes precedence. The keys are lowercased
+// because viper lowercases the keys of the config.
+func roleLabels(client *OIDCClient, claims JWTClaims) map[string]string {
+	labels := map[string]string{}
+	if claimName := client.config.GetString(ROLE_LABELS_CLAIM); claimName != "" {
+		if m, ok := claims[claimName].(map[string]interface{}); ok {
+			for roleArn, v := range m {
+				if label, ok := v.(string); ok && label != "" {
+					labels[strings.ToLower(roleArn)] = label
+				}
+			}
+		} else if claims[claimName] != nil {
+			Writeln("Ignored the %s claim, it's not an object of the role ARN to the label", claimName)
+		}
+	}
+	for roleArn, label := range client.config.GetStringMapString(ROLE_LABELS) {
+		if label != "" {
+			labels[strings.ToLower(roleArn)] = label
+		}
+	}
+	return labels
+}
+
+// roleLabel returns the label of the role, or the ARN if it has no label.
+func roleLabel(roleArn string, labels map[string]string) string {
+	if label := labels[strings.ToLower(roleArn)]; label != "" {
+		return label
+	}
+	return roleArn
+}
+
+func describeRole(roleArn string, labels map[string]string) string {
+	if label := labels[strings.ToLower(roleArn)]; label != "" {
+		return fmt.Sprintf("%s (%s)", label, roleArn)
+	}
+	return roleArn
+}
+
+// rolesFromClaim extracts the IAM Role ARNs from the claim value, which can be a string separated
+// by comma or space, or an array of them. The other ARNs such as the provider ARN are ignored.
+func rolesFromClaim(value interface{}) []string {
+	var values []string
+	switch v := value.(type) {
+	case string:
+		values = append(values, v)
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var roleArns []string
+	seen := map[string]bool{}
+	for _, v := range values {
+		for _, s := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if ValidateRoleArn(s) == nil && !seen[s] {
+				seen[s] = true
+				roleArns = append(roleArns, s)
+			}
+		}
+	}
+	return roleArns
+}
@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"runtime"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 	"github.com/werf/lockgate"
 	"github.com/werf/lockgate/pkg/file_locker"
 	"github.com/zalando/go-keyring"
@@ -14,6 +19,8 @@ import (
 var lockDir = os.TempDir() + "/aws-clie-oidc-lock"
 var locker lockgate.Locker
 var lockResource = "aws-cli-oidc"
+var lockTimeout = 3 * time.Minute
+var lockStaleAge = 10 * time.Minute
 
 func init() {
 	var err error
@@ -24,12 +31,148 @@ func init() {
 	}
 
 	Secret.AWSCredentials = make(map[string]string)
-	Secret.Load()
 }
 
-var secretService = "aws-cli-oidc"
+type lockOwner struct {
+	Pid        int       `json:"pid"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// ConfigureLock applies the lock timeout and stale lock age of the provider config.
+func ConfigureLock(config *viper.Viper) {
+	if s := config.GetString(CACHE_LOCK_TIMEOUT); s != "" {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil && i > 0 {
+			lockTimeout = time.Duration(i) * time.Second
+		}
+	}
+	if s := config.GetString(CACHE_LOCK_STALE_SECONDS); s != "" {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil && i > 0 {
+			lockStaleAge = time.Duration(i) * time.Second
+		}
+	}
+}
+
+func lockOwnerPath() string {
+	return lockDir + "/" + lockResource + ".owner"
+}
+
+func acquireLock() (lockgate.LockHandle, error) {
+	_, lock, err := locker.Acquire(lockResource, lockgate.AcquireOptions{Shared: false, Timeout: lockTimeout})
+	if err != nil {
+		// The lock file is never unlinked: the OS already unlocked it if the holder died, and unlinking the file
+		// locked by another process would let the next one lock a new file while it still holds the old one
+		owner, dead := deadLockOwner()
+		if dead {
+			return lock, errors.Wrapf(err, "Timed out after %s waiting for the lock recorded for pid %d which has exited, "+
+				"a process started by it may still hold the lock", lockTimeout, owner.Pid)
+		}
+		if owner != nil && time.Since(owner.AcquiredAt) > lockStaleAge {
+			// The holder may be hung, but its lock can't be taken over while it's alive
+			return lock, errors.Wrapf(err, "Timed out after %s waiting for the lock held by pid %d since %s, stop the process if it hangs",
+				lockTimeout, owner.Pid, owner.AcquiredAt.Format(time.RFC3339))
+		}
+		return lock, errors.Wrapf(err, "Timed out after %s waiting for the lock", lockTimeout)
+	}
+
+	// The owner record of the dead holder is only replaced while holding the lock
+	if owner, dead := deadLockOwner(); dead {
+		Traceln("Took the lock left by pid %d since %s", owner.Pid, owner.AcquiredAt.Format(time.RFC3339))
+	}
+	owner, _ := json.Marshal(lockOwner{Pid: os.Getpid(), AcquiredAt: time.Now()})
+	os.WriteFile(lockOwnerPath(), owner, 0600)
+
+	return lock, nil
+}
+
+func releaseLock(lock lockgate.LockHandle) {
+	os.Remove(lockOwnerPath())
+	if err := locker.Release(lock); err != nil {
+		Writeln("Can't unlock")
+		Exit(err)
+	}
+}
+
+// acquireLoginLock serializes the logins of the provider across the processes, e.g. the parallel
+// credential_process calls of the AWS SDK on a cold cache. The lock file is unlocked by the OS
+// even if the holder dies. The second value is true when another process held it.
+func acquireLoginLock(provider string) (lockgate.LockHandle, bool, error) {
+	waited := false
+	_, lock, err := locker.Acquire(lockResource+"-login-"+provider, lockgate.AcquireOptions{
+		Timeout: lockTimeout,
+		OnWaitFunc: func(lockName string, doWait func() error) error {
+			waited = true
+			Writeln("Waiting for the login by another process")
+			return doWait()
+		},
+	})
+	if err != nil {
+		return lock, waited, errors.Wrapf(err, "Timed out after %s waiting for the login by another process", lockTimeout)
+	}
+	return lock, waited, nil
+}
+
+// deadLockOwner returns the recorded holder of the lock and whether its process is gone. The lock of the live
+// process is never reclaimed however old it is, otherwise two processes would hold the lock at once.
+func deadLockOwner() (*lockOwner, bool) {
+	data, err := os.ReadFile(lockOwnerPath())
+	if err != nil {
+		return nil, false
+	}
+	var owner lockOwner
+	if err := json.Unmarshal(data, &owner); err != nil {
+		return nil, false
+	}
+	return &owner, !processAlive(owner.Pid)
+}
+
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		// FindProcess already opened the process handle
+		return true
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
+
+const DEFAULT_KEYRING_SERVICE = "aws-cli-oidc"
+
+var secretService = DEFAULT_KEYRING_SERVICE
 var secretUser = os.Getenv("USER")
 
+// ConfigureKeyringService switches the keyring item to the keyring_service of the provider config.
+func ConfigureKeyringService(config *viper.Viper) {
+	secretService = DEFAULT_KEYRING_SERVICE
+	if service := config.GetString(KEYRING_SERVICE); service != "" {
+		secretService = service
+	}
+}
+
+// getSecretJson reads the keyring item. When the item of a custom service doesn't exist yet,
+// the one of the default service is moved to it so that the upgraded config keeps the cached credentials.
+// It's called with the lock held.
+func getSecretJson() (string, error) {
+	jsonStr, err := keyring.Get(secretService, secretUser)
+	if err != keyring.ErrNotFound || secretService == DEFAULT_KEYRING_SERVICE {
+		return jsonStr, err
+	}
+	jsonStr, err = keyring.Get(DEFAULT_KEYRING_SERVICE, secretUser)
+	if err != nil {
+		return jsonStr, err
+	}
+
+	if err := keyring.Set(secretService, secretUser, jsonStr); err != nil {
+		return "", errors.Wrapf(err, "Failed to move the secret to the keyring service %s", secretService)
+	}
+	if err := keyring.Delete(DEFAULT_KEYRING_SERVICE, secretUser); err != nil && err != keyring.ErrNotFound {
+		return "", errors.Wrapf(err, "Failed to delete the secret of the keyring service %s", DEFAULT_KEYRING_SERVICE)
+	}
+	Writeln("Moved the secret of the keyring service %s to %s", DEFAULT_KEYRING_SERVICE, secretService)
+	return jsonStr, nil
+}
+
 var Secret SecretStore
 
 type SecretStore struct {
@@ -37,26 +180,14 @@ type SecretStore struct {
 }
 
 func (s *SecretStore) Load() {
-	acquired, lock, err := locker.Acquire(lockResource, lockgate.AcquireOptions{Shared: false, Timeout: 3 * time.Minute})
+	lock, err := acquireLock()
 	if err != nil {
 		Writeln("Can't load secret due to locked now")
 		Exit(err)
 	}
-	defer func() {
-		if acquired {
-			if err := locker.Release(lock); err != nil {
-				Writeln("Can't unlock")
-				Exit(err)
-			}
-		}
-	}()
+	defer releaseLock(lock)
 
-	if !acquired {
-		Writeln("Can't load secret due to locked now")
-		Exit(err)
-	}
-
-	jsonStr, err := keyring.Get(secretService, secretUser)
+	jsonStr, err := getSecretJson()
 	if err != nil {
 		if err == keyring.ErrNotFound {
 			return
@@ -71,22 +202,27 @@ func (s *SecretStore) Load() {
 }
 
 func (s *SecretStore) Save(roleArn, cred string) {
-	acquired, lock, err := locker.Acquire(lockResource, lockgate.AcquireOptions{Shared: false, Timeout: 3 * time.Minute})
+	s.update(func() {
+		s.AWSCredentials[roleArn] = cred
+	})
+}
+
+func (s *SecretStore) Delete(roleArn string) {
+	s.update(func() {
+		delete(s.AWSCredentials, roleArn)
+	})
+}
+
+func (s *SecretStore) update(modify func()) {
+	lock, err := acquireLock()
 	if err != nil {
 		Writeln("Can't save secret due to locked now")
 		Exit(err)
 	}
-	defer func() {
-		if acquired {
-			if err := locker.Release(lock); err != nil {
-				Writeln("Can't unlock")
-				Exit(err)
-			}
-		}
-	}()
+	defer releaseLock(lock)
 
 	// Load the latest credentials
-	jsonStr, err := keyring.Get(secretService, secretUser)
+	jsonStr, err := getSecretJson()
 	if err != nil {
 		if err != keyring.ErrNotFound {
 			Writeln("Can't load secret due to unexpected error: %v", err)
@@ -100,8 +236,8 @@ func (s *SecretStore) Save(roleArn, cred string) {
 		}
 	}
 
-	// Add/Update credential
-	s.AWSCredentials[roleArn] = cred
+	// Add/Update/Delete credential
+	modify()
 
 	// Save
 	newJsonStr, err := json.Marshal(s)
@@ -115,37 +251,66 @@ func (s *SecretStore) Save(roleArn, cred string) {
 	}
 }
 
-func AWSCredential(roleArn string) (*AWSCredentials, error) {
-	Secret.Load()
-
-	jsonStr, ok := Secret.AWSCredentials[roleArn]
-	if !ok {
-		return nil, fmt.Errorf("not found the credential for %s", roleArn)
+// AWSCredential loads the cached credentials of the role which were requested with the duration and the session policies.
+// The corrupt entry is deleted and ErrCorruptCredential is returned, so that the caller logs in again.
+func AWSCredential(store CredentialStore, roleArn string, durationSeconds int64, policy *SessionPolicy) (*AWSCredentials, error) {
+	key := CredentialCacheKey(roleArn, durationSeconds, policy)
+	jsonStr, err := store.Get(key)
+	if err != nil {
+		if err == ErrCredentialNotFound {
+			return nil, fmt.Errorf("not found the credential for %s", roleArn)
+		}
+		return nil, err
 	}
 
-	Writeln("Got credential from OS secret store for %s", roleArn)
+	Writeln("Got credential from the secret store for %s", roleArn)
 
 	var cred AWSCredentials
-
-	err := json.Unmarshal([]byte(jsonStr), &cred)
+	err = json.Unmarshal([]byte(jsonStr), &cred)
+	if err == nil {
+		err = validateCachedCredential(&cred)
+	}
 	if err != nil {
-		Writeln("Can't load secret due to the broken data")
-		Exit(err)
+		Writeln("The cached credential for %s is corrupt, deleting it: %v", roleArn, err)
+		if deleter, ok := store.(CredentialDeleter); ok {
+			if err := deleter.Delete(key); err != nil {
+				Writeln("Can't delete the corrupt credential: %v", err)
+			}
+		}
+		return nil, errors.Wrap(ErrCorruptCredential, err.Error())
 	}
 
 	return &cred, nil
 }
 
-func SaveAWSCredential(roleArn string, cred *AWSCredentials) {
+// validateCachedCredential checks the fields which are required to use the credentials.
+func validateCachedCredential(cred *AWSCredentials) error {
+	switch {
+	case cred.AWSAccessKey == "":
+		return errors.New("AccessKeyId is missing")
+	case cred.AWSSecretKey == "":
+		return errors.New("SecretAccessKey is missing")
+	case cred.AWSSessionToken == "":
+		return errors.New("SessionToken is missing")
+	case cred.Expires.IsZero():
+		return errors.New("Expiration is missing")
+	}
+	return nil
+}
+
+func SaveAWSCredential(store CredentialStore, roleArn string, durationSeconds int64, policy *SessionPolicy, cred *AWSCredentials) {
 	jsonStr, err := json.Marshal(cred)
 	if err != nil {
 		Writeln("Can't save secret due to the broken data")
 		Exit(err)
 	}
 
-	Secret.Save(roleArn, string(jsonStr))
+	if err := store.Set(CredentialCacheKey(roleArn, durationSeconds, policy), string(jsonStr)); err != nil {
+		Writeln("Can't save secret")
+		Exit(err)
+	}
 
-	Write("The AWS credentials has been saved in OS secret store")
+	Write("The AWS credentials has been saved in the secret store")
 }
 
 func Clear() error {
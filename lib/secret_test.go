@@ -0,0 +1,169 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/werf/lockgate/pkg/file_lock"
+	"github.com/werf/lockgate/pkg/file_locker"
+	"github.com/zalando/go-keyring"
+)
+
+// useTempLockDir points the lock at a temporary directory with the short timeout.
+func useTempLockDir(t *testing.T) {
+	t.Helper()
+	origDir, origLocker, origTimeout, origStaleAge := lockDir, locker, lockTimeout, lockStaleAge
+	t.Cleanup(func() {
+		lockDir, locker, lockTimeout, lockStaleAge = origDir, origLocker, origTimeout, origStaleAge
+	})
+
+	lockDir = t.TempDir()
+	l, err := file_locker.NewFileLocker(lockDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locker = l
+	lockTimeout = 200 * time.Millisecond
+	lockStaleAge = time.Minute
+}
+
+// holdLock holds the lock by another open file, as another process does.
+func holdLock(t *testing.T) *flock.Flock {
+	t.Helper()
+	lockFile := file_lock.NewFileLock(lockResource, lockDir).(*file_lock.FileLock).LockFilePath()
+	holder := flock.New(lockFile)
+	if locked, err := holder.TryLock(); err != nil || !locked {
+		t.Fatalf("Failed to hold the lock: %v", err)
+	}
+	t.Cleanup(func() { holder.Unlock() })
+	return holder
+}
+
+func writeLockOwner(t *testing.T, pid int, acquiredAt time.Time) {
+	t.Helper()
+	data, _ := json.Marshal(lockOwner{Pid: pid, AcquiredAt: acquiredAt})
+	if err := os.WriteFile(lockOwnerPath(), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPid returns the pid of the process which has exited.
+func deadPid(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("Can't run a process: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestAcquireLockFree(t *testing.T) {
+	useTempLockDir(t)
+
+	lock, err := acquireLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, dead := deadLockOwner()
+	if owner == nil || owner.Pid != os.Getpid() || dead {
+		t.Errorf("The owner should be this process, got %+v", owner)
+	}
+	releaseLock(lock)
+	if _, err := os.Stat(lockOwnerPath()); !os.IsNotExist(err) {
+		t.Errorf("The owner file should be removed on release: %v", err)
+	}
+}
+
+func TestAcquireLockHeld(t *testing.T) {
+	useTempLockDir(t)
+	holdLock(t)
+	writeLockOwner(t, os.Getpid(), time.Now())
+
+	if _, err := acquireLock(); err == nil || !strings.Contains(err.Error(), "Timed out") {
+		t.Errorf("The held lock should time out, got %v", err)
+	}
+}
+
+func TestAcquireLockOldButAliveHolderIsNotReclaimed(t *testing.T) {
+	useTempLockDir(t)
+	holdLock(t)
+	// This process is alive, only the age is over lockStaleAge
+	writeLockOwner(t, os.Getpid(), time.Now().Add(-time.Hour))
+
+	_, err := acquireLock()
+	if err == nil {
+		t.Fatal("The lock of the live holder must not be reclaimed")
+	}
+	if !strings.Contains(err.Error(), "stop the process") {
+		t.Errorf("The error should hint the hung holder, got %v", err)
+	}
+	lockFile := file_lock.NewFileLock(lockResource, lockDir).(*file_lock.FileLock).LockFilePath()
+	if _, err := os.Stat(lockFile); err != nil {
+		t.Errorf("The lock file of the live holder must be kept: %v", err)
+	}
+}
+
+func TestAcquireLockLeftByDeadHolder(t *testing.T) {
+	useTempLockDir(t)
+	// The OS unlocked the lock file when the holder died, only its owner record is left
+	writeLockOwner(t, deadPid(t), time.Now())
+
+	lock, err := acquireLock()
+	if err != nil {
+		t.Fatalf("The lock left by the dead holder should be acquired: %v", err)
+	}
+	defer releaseLock(lock)
+	owner, _ := deadLockOwner()
+	if owner == nil || owner.Pid != os.Getpid() {
+		t.Errorf("The owner should be this process, got %+v", owner)
+	}
+}
+
+func TestAcquireLockHeldAfterDeadHolderIsNotUnlinked(t *testing.T) {
+	useTempLockDir(t)
+	// The lock file is still locked, e.g. by the child which inherited it, while the recorded holder is gone
+	holdLock(t)
+	writeLockOwner(t, deadPid(t), time.Now())
+
+	if _, err := acquireLock(); err == nil || !strings.Contains(err.Error(), "has exited") {
+		t.Fatalf("The lock still held should time out, got %v", err)
+	}
+	lockFile := file_lock.NewFileLock(lockResource, lockDir).(*file_lock.FileLock).LockFilePath()
+	if _, err := os.Stat(lockFile); err != nil {
+		t.Errorf("The locked file must not be unlinked: %v", err)
+	}
+	if owner, _ := deadLockOwner(); owner == nil || owner.Pid == os.Getpid() {
+		t.Errorf("The owner record must not be replaced without the lock, got %+v", owner)
+	}
+}
+
+func TestKeyringServiceMigration(t *testing.T) {
+	keyring.MockInit()
+	useTempLockDir(t)
+	origService := secretService
+	t.Cleanup(func() { secretService = origService })
+
+	legacy := `{"credentials":{"myop/arn:aws:iam::123456789012:role/test":"cached"}}`
+	if err := keyring.Set(DEFAULT_KEYRING_SERVICE, secretUser, legacy); err != nil {
+		t.Fatal(err)
+	}
+	ConfigureKeyringService(newTestClient(map[string]interface{}{KEYRING_SERVICE: "aws-cli-oidc-myop"}).config)
+
+	for i := 0; i < 2; i++ {
+		jsonStr, err := getSecretJson()
+		if err != nil || jsonStr != legacy {
+			t.Fatalf("The secret of the default service should be read, got %q %v", jsonStr, err)
+		}
+	}
+	if moved, err := keyring.Get("aws-cli-oidc-myop", secretUser); err != nil || moved != legacy {
+		t.Errorf("The secret should be moved to the new service, got %q %v", moved, err)
+	}
+	if _, err := keyring.Get(DEFAULT_KEYRING_SERVICE, secretUser); err != keyring.ErrNotFound {
+		t.Errorf("The secret of the default service should be deleted, got %v", err)
+	}
+}
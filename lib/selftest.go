@@ -0,0 +1,330 @@
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/zalando/go-keyring"
+)
+
+const (
+	selftestProvider        = "aws-cli-oidc-selftest"
+	selftestClientID        = "aws-cli-oidc-selftest"
+	selftestRoleArn         = "arn:aws:iam::123456789012:role/selftest"
+	selftestAccessKeyID     = "ASIASELFTEST"
+	selftestSecretAccessKey = "selftest-secret"
+	selftestSessionToken    = "selftest-session-token"
+)
+
+type SelftestOptions struct {
+	// SkipKeyring skips the check of the OS secret store, e.g. on the headless CI without it
+	SkipKeyring bool
+}
+
+// Selftest runs the login and the STS call against the in-process mock OIDC provider and STS,
+// to check this binary works on the OS without a real OIDC provider.
+func Selftest(opts *SelftestOptions) error {
+	idp := newMockIdP()
+	defer idp.server.Close()
+	mockSTS := newMockSTS(idp)
+	defer mockSTS.Close()
+
+	port, err := freeLocalPort()
+	if err != nil {
+		return errors.Wrap(err, "Failed to find a free port for the callback")
+	}
+
+	defer emulateBrowser()()
+	overrides := selftestOverrides(idp, mockSTS.URL, port)
+
+	steps := []struct {
+		name string
+		run  func(state *selftestState) error
+	}{
+		{"Discover the OIDC provider", func(s *selftestState) error {
+			client, err := CheckInstalledWithOverrides(selftestProvider, overrides)
+			s.client = client
+			return err
+		}},
+		{"Login by the loopback redirect", func(s *selftestState) error {
+			tokenResponse, err := doLogin(s.client, ResolveRoleConfig(s.client.config, selftestRoleArn), &AuthenticateOptions{LoginFlow: LOGIN_FLOW_LOOPBACK})
+			if err != nil {
+				return err
+			}
+			if tokenResponse.IDToken != idp.issuedIDToken() {
+				return errors.New("The ID token differs from the issued one")
+			}
+			s.tokenResponse = tokenResponse
+			return nil
+		}},
+		{"Login through a reverse proxy with the callback base path", func(s *selftestState) error {
+			return selftestProxiedLogin(overrides)
+		}},
+		{"Assume the role with the ID token", func(s *selftestState) error {
+			cred, err := GetCredentialsWithOIDC(s.client, s.tokenResponse.IDToken, selftestRoleArn, 900)
+			if err != nil {
+				return err
+			}
+			if cred.AWSAccessKey != selftestAccessKeyID || cred.AWSSecretKey != selftestSecretAccessKey || cred.AWSSessionToken != selftestSessionToken {
+				return errors.New("The credentials differ from the issued ones")
+			}
+			return nil
+		}},
+		{"Save and load the OS secret store", func(s *selftestState) error {
+			if opts.SkipKeyring {
+				return errSkipped
+			}
+			if err := keyring.Set(selftestProvider, secretUser, "ok"); err != nil {
+				return err
+			}
+			defer keyring.Delete(selftestProvider, secretUser)
+			v, err := keyring.Get(selftestProvider, secretUser)
+			if err != nil {
+				return err
+			}
+			if v != "ok" {
+				return errors.New("The loaded secret differs from the saved one")
+			}
+			return nil
+		}},
+	}
+
+	state := &selftestState{}
+	for _, step := range steps {
+		err := step.run(state)
+		switch {
+		case err == errSkipped:
+			fmt.Printf("SKIP  %s\n", step.name)
+		case err != nil:
+			fmt.Printf("FAIL  %s\n", step.name)
+			return errors.Wrap(err, step.name)
+		default:
+			fmt.Printf("OK    %s\n", step.name)
+		}
+	}
+	return nil
+}
+
+var errSkipped = errors.New("skipped")
+
+// emulateBrowser follows the redirects instead of opening the browser. The returned func restores the browser.
+func emulateBrowser() func() {
+	origOpenBrowser := openBrowser
+	openBrowser = func(authURL string) error {
+		res, err := http.Get(authURL)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+	return func() { openBrowser = origOpenBrowser }
+}
+
+// selftestOverrides is the provider config to login the mock OIDC provider and to call the mock STS.
+func selftestOverrides(idp *mockIdP, stsURL string, callbackPort int) map[string]string {
+	return map[string]string{
+		OIDC_PROVIDER_METADATA_URL:       idp.server.URL + "/.well-known/openid-configuration",
+		CLIENT_ID:                        selftestClientID,
+		CALLBACK_PORT:                    strconv.Itoa(callbackPort),
+		STS_ENDPOINT:                     stsURL,
+		AWS_FEDERATION_ROLE_SESSION_NAME: "selftest",
+		// The mock OIDC provider is served by http on the loopback address
+		ALLOW_INSECURE_METADATA: "true",
+	}
+}
+
+// selftestProxiedLogin logs in through the reverse proxy which strips its path prefix before the callback server
+// mounted at callback_base_path. It has its own mock OIDC provider, so the ID token of the other steps is kept.
+func selftestProxiedLogin(overrides map[string]string) error {
+	idp := newMockIdP()
+	defer idp.server.Close()
+
+	port, err := freeLocalPort()
+	if err != nil {
+		return errors.Wrap(err, "Failed to find a free port for the callback")
+	}
+	proxy := httptest.NewServer(&httputil.ReverseProxy{Director: func(req *http.Request) {
+		req.URL.Scheme = "http"
+		req.URL.Host = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, "/proxy")
+	}})
+	defer proxy.Close()
+
+	proxied := map[string]string{
+		OIDC_PROVIDER_METADATA_URL: idp.server.URL + "/.well-known/openid-configuration",
+		CALLBACK_PORT:              strconv.Itoa(port),
+		CALLBACK_BASE_PATH:         "/aws-cli-oidc",
+		REDIRECT_URI:               proxy.URL + "/proxy/aws-cli-oidc/callback",
+	}
+	for key, value := range overrides {
+		if _, ok := proxied[key]; !ok {
+			proxied[key] = value
+		}
+	}
+	client, err := CheckInstalledWithOverrides(selftestProvider, proxied)
+	if err != nil {
+		return err
+	}
+	tokenResponse, err := doLogin(client, ResolveRoleConfig(client.config, selftestRoleArn), &AuthenticateOptions{LoginFlow: LOGIN_FLOW_LOOPBACK})
+	if err != nil {
+		return err
+	}
+	if tokenResponse.IDToken != idp.issuedIDToken() {
+		return errors.New("The ID token differs from the issued one")
+	}
+	return nil
+}
+
+type selftestState struct {
+	client        *OIDCClient
+	tokenResponse *TokenResponse
+}
+
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// mockIdP is the minimal OIDC provider which issues an unsigned-but-RS256-labelled ID token.
+// STS isn't real, so nobody verifies the signature.
+type mockIdP struct {
+	server *httptest.Server
+
+	mu         sync.Mutex
+	challenges map[string]string
+	idToken    string
+}
+
+// issuedIDToken returns the latest ID token which the token endpoint issued.
+func (idp *mockIdP) issuedIDToken() string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.idToken
+}
+
+func newMockIdP() *mockIdP {
+	idp := &mockIdP{challenges: map[string]string{}}
+	mux := http.NewServeMux()
+	idp.server = httptest.NewServer(mux)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+			"authorization_response_iss_parameter_supported": true,
+		})
+	})
+
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != selftestClientID || q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		code := strconv.FormatInt(time.Now().UnixNano(), 36)
+		idp.mu.Lock()
+		idp.challenges[code] = q.Get("code_challenge")
+		idp.mu.Unlock()
+
+		redirect, err := url.Parse(q.Get("redirect_uri"))
+		if err != nil {
+			http.Error(w, "invalid_request", http.StatusBadRequest)
+			return
+		}
+		rq := redirect.Query()
+		rq.Set("code", code)
+		rq.Set("state", q.Get("state"))
+		rq.Set("iss", idp.server.URL)
+		redirect.RawQuery = rq.Encode()
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		challenge, ok := idp.challenges[r.Form.Get("code")]
+		delete(idp.challenges, r.Form.Get("code"))
+		idp.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+		w.Header().Set("Content-Type", "application/json")
+		if !ok || r.Form.Get("grant_type") != "authorization_code" || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+			return
+		}
+		idToken := mockJWT(map[string]interface{}{
+			"iss": idp.server.URL,
+			"sub": "selftest",
+			"aud": selftestClientID,
+			"iat": time.Now().Unix(),
+			"exp": time.Now().Add(5 * time.Minute).Unix(),
+		})
+		idp.mu.Lock()
+		idp.idToken = idToken
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(&TokenResponse{
+			AccessToken: "selftest-access-token",
+			IDToken:     idToken,
+			ExpiresIn:   300,
+		})
+	})
+	return idp
+}
+
+func mockJWT(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	return base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte("selftest"))
+}
+
+// newMockSTS answers AssumeRoleWithWebIdentity for the ID token which the mock OIDC provider issued.
+func newMockSTS(idp *mockIdP) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "text/xml")
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("RoleArn") != selftestRoleArn ||
+			r.Form.Get("WebIdentityToken") == "" || r.Form.Get("WebIdentityToken") != idp.issuedIDToken() {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `<ErrorResponse><Error><Type>Sender</Type><Code>InvalidIdentityToken</Code><Message>Unexpected request</Message></Error><RequestId>selftest</RequestId></ErrorResponse>`)
+			return
+		}
+		fmt.Fprintf(w, `<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>%s</AccessKeyId>
+      <SecretAccessKey>%s</SecretAccessKey>
+      <SessionToken>%s</SessionToken>
+      <Expiration>%s</Expiration>
+    </Credentials>
+    <AssumedRoleUser>
+      <Arn>arn:aws:sts::123456789012:assumed-role/selftest/selftest</Arn>
+      <AssumedRoleId>AROASELFTEST:selftest</AssumedRoleId>
+    </AssumedRoleUser>
+  </AssumeRoleWithWebIdentityResult>
+  <ResponseMetadata><RequestId>selftest</RequestId></ResponseMetadata>
+</AssumeRoleWithWebIdentityResponse>`, selftestAccessKeyID, selftestSecretAccessKey, selftestSessionToken,
+			time.Now().Add(15*time.Minute).UTC().Format(time.RFC3339))
+	}))
+}
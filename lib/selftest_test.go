@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// selftestFixture is the mock OIDC provider and STS of the selftest, with the browser emulated.
+type selftestFixture struct {
+	idp       *mockIdP
+	sts       *httptest.Server
+	overrides map[string]string
+}
+
+func newSelftestFixture(t *testing.T) *selftestFixture {
+	t.Helper()
+	t.Setenv("AWS_CLI_OIDC_CACHE", t.TempDir())
+
+	idp := newMockIdP()
+	t.Cleanup(idp.server.Close)
+	sts := newMockSTS(idp)
+	t.Cleanup(sts.Close)
+	t.Cleanup(emulateBrowser())
+
+	port, err := freeLocalPort()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &selftestFixture{idp: idp, sts: sts, overrides: selftestOverrides(idp, sts.URL, port)}
+}
+
+// client initializes the client of the mock OIDC provider, with the extra overrides of the test.
+func (f *selftestFixture) client(t *testing.T, extra map[string]string) *OIDCClient {
+	t.Helper()
+	overrides := map[string]string{}
+	for key, value := range f.overrides {
+		overrides[key] = value
+	}
+	for key, value := range extra {
+		overrides[key] = value
+	}
+	client, err := CheckInstalledWithOverrides(selftestProvider, overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func (f *selftestFixture) login(t *testing.T, client *OIDCClient) *TokenResponse {
+	t.Helper()
+	tokenResponse, err := doLogin(client, ResolveRoleConfig(client.config, selftestRoleArn), &AuthenticateOptions{LoginFlow: LOGIN_FLOW_LOOPBACK})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenResponse
+}
+
+func TestSelftest(t *testing.T) {
+	t.Setenv("AWS_CLI_OIDC_CACHE", t.TempDir())
+
+	if err := Selftest(&SelftestOptions{SkipKeyring: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelftestLoginAndAssumeRole(t *testing.T) {
+	f := newSelftestFixture(t)
+	client := f.client(t, nil)
+
+	tokenResponse := f.login(t, client)
+	if tokenResponse.IDToken == "" || tokenResponse.IDToken != f.idp.issuedIDToken() {
+		t.Fatalf("The ID token differs from the issued one: %s", tokenResponse.IDToken)
+	}
+
+	cred, err := GetCredentialsWithOIDC(client, tokenResponse.IDToken, selftestRoleArn, 900)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.AWSAccessKey != selftestAccessKeyID || cred.AWSSecretKey != selftestSecretAccessKey || cred.AWSSessionToken != selftestSessionToken {
+		t.Errorf("The credentials differ from the issued ones: %+v", cred)
+	}
+}
+
+func TestSelftestSTSRejectsUnissuedToken(t *testing.T) {
+	f := newSelftestFixture(t)
+	client := f.client(t, nil)
+
+	token := mockJWT(map[string]interface{}{"iss": f.idp.server.URL, "aud": selftestClientID})
+	_, err := GetCredentialsWithOIDC(client, token, selftestRoleArn, 900)
+	if err == nil || !strings.Contains(err.Error(), "InvalidIdentityToken") {
+		t.Errorf("The token which the mock OIDC provider didn't issue should be rejected, got %v", err)
+	}
+}
+
+func TestSelftestProxiedLogin(t *testing.T) {
+	f := newSelftestFixture(t)
+	idToken := f.login(t, f.client(t, nil)).IDToken
+
+	if err := selftestProxiedLogin(f.overrides); err != nil {
+		t.Fatalf("The login through the reverse proxy failed: %v", err)
+	}
+	if got := f.idp.issuedIDToken(); got != idToken {
+		t.Errorf("The proxied login should have its own mock OIDC provider, the ID token changed to %s", got)
+	}
+}
@@ -0,0 +1,318 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+type ServeOptions struct {
+	RoleArn                   string
+	MaxSessionDurationSeconds int64
+	LoginFlow                 string
+	// SocketPath is the Unix domain socket to serve the credentials
+	SocketPath string
+	// RefreshBuffer renews the credentials which expire within it
+	RefreshBuffer time.Duration
+	// ReadyFD is the file descriptor to write a newline and close when the socket is ready, or -1
+	ReadyFD int
+	// TriggerFile refreshes the credentials immediately when it's created or written, so does SIGHUP
+	TriggerFile string
+	// ReloginOnTrigger logs in again on the trigger instead of using the refresh token
+	ReloginOnTrigger bool
+}
+
+// credentialServer keeps the credentials of the role fresh in the background and hands them to the local tools.
+type credentialServer struct {
+	client   *OIDCClient
+	role     *RoleConfig
+	opts     *ServeOptions
+	duration int64
+	metrics  *serveMetrics
+	// triggers requests the refresh loop to refresh now, the pending one absorbs the following
+	triggers chan string
+
+	mu            sync.RWMutex
+	cred          *AWSCredentials
+	refreshToken  string
+	lastRefreshed error
+}
+
+// Serve serves the credentials over the Unix domain socket until it's interrupted.
+// Each connection receives the credential_process JSON, or {"Error": "..."}, then it's closed.
+func Serve(client *OIDCClient, opts *ServeOptions) error {
+	roleArn := opts.RoleArn
+	if roleArn == "" {
+		roleArn = client.config.GetString(DEFAULT_IAM_ROLE_ARN)
+	}
+	if err := ValidateRoleArn(roleArn); err != nil {
+		return err
+	}
+	duration := opts.MaxSessionDurationSeconds
+	if duration <= 0 {
+		duration = configuredDuration(client)
+	}
+
+	metrics, err := newServeMetrics(client)
+	if err != nil {
+		return err
+	}
+	s := &credentialServer{
+		client:   client,
+		role:     ResolveRoleConfig(client.config, roleArn),
+		opts:     opts,
+		duration: duration,
+		metrics:  metrics,
+		triggers: make(chan string, 1),
+	}
+	if err := s.refresh(false); err != nil {
+		return err
+	}
+
+	listener, err := listenUnix(opts.SocketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(opts.SocketPath)
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-stop
+		listener.Close()
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.trigger("SIGHUP")
+		}
+	}()
+	if opts.TriggerFile != "" {
+		if err := s.watchTriggerFile(opts.TriggerFile); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	go s.refreshLoop()
+
+	Writeln("Serving the credentials of %s on %s", roleArn, opts.SocketPath)
+	// Printed only when the credentials are obtained, so that the scripts can wait for it
+	fmt.Println(opts.SocketPath)
+	if opts.ReadyFD >= 0 {
+		if err := notifyReady(opts.ReadyFD); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return errors.Wrap(err, "Failed to accept the connection")
+		}
+		go s.handle(conn)
+	}
+}
+
+func notifyReady(fd int) error {
+	f := os.NewFile(uintptr(fd), "ready-fd")
+	if f == nil {
+		return errors.Errorf("The ready fd %d is invalid", fd)
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte("\n")); err != nil {
+		return errors.Wrapf(err, "Failed to notify the readiness to fd %d", fd)
+	}
+	return nil
+}
+
+// listenUnix creates the socket which only the user can connect to. The socket is bound in a private directory
+// and moved to the path after its permission is restricted, since it's created with the umask.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, errors.Errorf("%s exists and is not a socket", path)
+		}
+		// Left by the previous run
+		os.Remove(path)
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".aws-cli-oidc-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create the directory to listen on %s", path)
+	}
+	defer os.RemoveAll(dir)
+
+	bound := filepath.Join(dir, "sock")
+	listener, err := net.Listen("unix", bound)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to listen on %s", path)
+	}
+	// The socket is removed by Serve, not by Close at the bound path
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(bound, 0600); err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "Failed to restrict the permission of %s", path)
+	}
+	if err := os.Rename(bound, path); err != nil {
+		listener.Close()
+		return nil, errors.Wrapf(err, "Failed to listen on %s", path)
+	}
+	return listener, nil
+}
+
+func (s *credentialServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	s.mu.RLock()
+	cred, lastErr := s.cred, s.lastRefreshed
+	s.mu.RUnlock()
+
+	var v interface{}
+	if cred == nil || !time.Now().Before(cred.Expires) {
+		msg := "The credentials have expired"
+		if lastErr != nil {
+			msg += ": " + lastErr.Error()
+		}
+		v = map[string]string{"Error": msg}
+	} else {
+		out := *cred
+		out.Version = 1
+		out.Scope = ""
+		v = &out
+		s.metrics.inc("served_credentials_total")
+	}
+	if err := json.NewEncoder(conn).Encode(v); err != nil {
+		Traceln("Failed to write the credentials: %v", err)
+	}
+}
+
+// refreshLoop is the only goroutine which refreshes after the first credentials, so the triggers never race
+// with the scheduled refresh.
+func (s *credentialServer) refreshLoop() {
+	for {
+		s.mu.RLock()
+		wait := time.Until(s.cred.Expires) - s.opts.RefreshBuffer
+		s.mu.RUnlock()
+
+		if wait < 10*time.Second {
+			wait = 10 * time.Second
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			if err := s.refresh(false); err != nil {
+				Writeln("Failed to refresh the credentials: %v", err)
+			}
+		case source := <-s.triggers:
+			timer.Stop()
+			Writeln("Refreshing the credentials triggered by %s", source)
+			s.metrics.inc("triggered_refreshes_total")
+			if err := s.refresh(s.opts.ReloginOnTrigger); err != nil {
+				Writeln("Failed to refresh the credentials triggered by %s: %v", source, err)
+			}
+		}
+	}
+}
+
+func (s *credentialServer) trigger(source string) {
+	select {
+	case s.triggers <- source:
+	default:
+		Traceln("The refresh is already triggered, ignoring %s", source)
+	}
+}
+
+// watchTriggerFile triggers the refresh when the file is created, written or touched.
+// The directory is watched, so the file doesn't need to exist yet.
+func (s *credentialServer) watchTriggerFile(path string) error {
+	path = filepath.Clean(path)
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.Wrap(err, "Failed to watch the trigger file")
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return errors.Wrapf(err, "Failed to watch the directory of %s", path)
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == path && event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Chmod) != 0 {
+					s.trigger(path)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				Writeln("Failed to watch the trigger file: %v", err)
+			}
+		}
+	}()
+	Writeln("Refreshing the credentials when %s is touched", path)
+	return nil
+}
+
+// refresh gets the new credentials by the refresh token if it's issued, otherwise by the login.
+// With relogin, the refresh token isn't used.
+func (s *credentialServer) refresh(relogin bool) error {
+	var tokenResponse *TokenResponse
+	var err error
+	if s.refreshToken != "" && !relogin {
+		tokenResponse, err = refreshToken(s.client, s.refreshToken)
+		if err != nil {
+			Writeln("Failed to refresh the token, login again: %v", err)
+		}
+	}
+	if tokenResponse == nil {
+		tokenResponse, err = doLogin(s.client, s.role, &AuthenticateOptions{LoginFlow: s.opts.LoginFlow})
+		if err == nil {
+			Writeln("Login successful!")
+			s.metrics.inc("logins_total")
+		}
+	}
+
+	var cred *AWSCredentials
+	if err == nil {
+		cred, err = GetCredentialsWithOIDC(s.client, tokenResponse.IDToken, s.role.RoleArn, s.duration)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRefreshed = err
+	if err != nil {
+		s.metrics.inc("refresh_failures_total")
+		return err
+	}
+	s.metrics.inc("refreshes_total")
+	var tokenExpires time.Time
+	if claims, err := ParseJWTClaims(tokenResponse.IDToken); err == nil {
+		tokenExpires, _ = claims.Expiry()
+	}
+	s.metrics.setExpiry(cred.Expires, tokenExpires)
+	s.cred = cred
+	if tokenResponse.RefreshToken != "" {
+		s.refreshToken = tokenResponse.RefreshToken
+	}
+	Writeln("The credentials are valid until %s", cred.Expires.Format(time.RFC3339))
+	return nil
+}
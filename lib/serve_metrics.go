@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const metricsPrefix = "aws_cli_oidc_serve_"
+
+// serveMetrics counts the events of serve. They're exposed on /metrics of metrics_listen in the Prometheus text format
+// and/or pushed to metrics_statsd_address, without any client library.
+type serveMetrics struct {
+	mu                sync.Mutex
+	counters          map[string]int64
+	credentialExpires time.Time
+	tokenExpires      time.Time
+
+	statsd net.Conn
+}
+
+var serveCounters = []struct {
+	name string
+	help string
+}{
+	{"logins_total", "Logins to the OIDC provider"},
+	{"refreshes_total", "Successful refreshes of the credentials"},
+	{"refresh_failures_total", "Failed refreshes of the credentials"},
+	{"triggered_refreshes_total", "Refreshes triggered by SIGHUP or the trigger file"},
+	{"served_credentials_total", "Credentials handed to the clients"},
+}
+
+func newServeMetrics(client *OIDCClient) (*serveMetrics, error) {
+	m := &serveMetrics{counters: map[string]int64{}}
+	if addr := client.config.GetString(METRICS_STATSD_ADDRESS); addr != "" {
+		conn, err := net.Dial("udp", addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to connect to the StatsD %s", addr)
+		}
+		m.statsd = conn
+		go m.pushGauges()
+	}
+	if addr := client.config.GetString(METRICS_LISTEN); addr != "" {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to listen on %s for the metrics", addr)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", m)
+		go http.Serve(listener, mux)
+		Writeln("Serving the metrics on http://%s/metrics", listener.Addr())
+	}
+	return m, nil
+}
+
+func (m *serveMetrics) inc(name string) {
+	m.mu.Lock()
+	m.counters[name]++
+	m.mu.Unlock()
+	m.send(fmt.Sprintf("%s%s:1|c", metricsPrefix, name))
+}
+
+func (m *serveMetrics) setExpiry(credentialExpires, tokenExpires time.Time) {
+	m.mu.Lock()
+	m.credentialExpires = credentialExpires
+	m.tokenExpires = tokenExpires
+	m.mu.Unlock()
+}
+
+// ttls returns the remaining seconds of the credentials and the ID token, 0 when unknown or expired.
+func (m *serveMetrics) ttls() (int64, int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ttl := func(t time.Time) int64 {
+		if d := time.Until(t); !t.IsZero() && d > 0 {
+			return int64(d.Seconds())
+		}
+		return 0
+	}
+	return ttl(m.credentialExpires), ttl(m.tokenExpires)
+}
+
+func (m *serveMetrics) send(line string) {
+	if m.statsd == nil {
+		return
+	}
+	if _, err := m.statsd.Write([]byte(line)); err != nil {
+		Traceln("Failed to push the metric: %v", err)
+	}
+}
+
+// pushGauges pushes the TTL gauges to StatsD periodically, they change without any event.
+func (m *serveMetrics) pushGauges() {
+	for range time.Tick(10 * time.Second) {
+		credentialTTL, tokenTTL := m.ttls()
+		m.send(fmt.Sprintf("%scredential_ttl_seconds:%d|g", metricsPrefix, credentialTTL))
+		m.send(fmt.Sprintf("%stoken_ttl_seconds:%d|g", metricsPrefix, tokenTTL))
+	}
+}
+
+func (m *serveMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mu.Lock()
+	for _, c := range serveCounters {
+		fmt.Fprintf(w, "# HELP %s%s %s.\n# TYPE %s%s counter\n%s%s %d\n",
+			metricsPrefix, c.name, c.help, metricsPrefix, c.name, metricsPrefix, c.name, m.counters[c.name])
+	}
+	m.mu.Unlock()
+
+	credentialTTL, tokenTTL := m.ttls()
+	fmt.Fprintf(w, "# HELP %scredential_ttl_seconds Remaining lifetime of the served credentials.\n# TYPE %scredential_ttl_seconds gauge\n%scredential_ttl_seconds %d\n",
+		metricsPrefix, metricsPrefix, metricsPrefix, credentialTTL)
+	fmt.Fprintf(w, "# HELP %stoken_ttl_seconds Remaining lifetime of the ID token.\n# TYPE %stoken_ttl_seconds gauge\n%stoken_ttl_seconds %d\n",
+		metricsPrefix, metricsPrefix, metricsPrefix, tokenTTL)
+}
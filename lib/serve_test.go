@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveSocket serves the credentials of the server on a socket in a temporary directory until the test ends.
+func serveSocket(t *testing.T, s *credentialServer) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cred.sock")
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+	return path
+}
+
+func readSocket(t *testing.T, path string) map[string]interface{} {
+	t.Helper()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var got map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestListenUnixRestrictsPermission(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cred.sock")
+	listener, err := listenUnix(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Errorf("The socket should be only for the user, got %v", fi.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("The directory to bind the socket should be removed, got %v", entries)
+	}
+}
+
+func TestServeHandle(t *testing.T) {
+	metrics, err := newServeMetrics(newTestClient(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("valid credentials", func(t *testing.T) {
+		cred := testCredential()
+		cred.Scope = "openid"
+		got := readSocket(t, serveSocket(t, &credentialServer{cred: cred, metrics: metrics}))
+		if got["AccessKeyId"] != cred.AWSAccessKey || got["SessionToken"] != cred.AWSSessionToken || got["Version"] != float64(1) {
+			t.Errorf("The credential_process JSON should be served, got %v", got)
+		}
+		if _, ok := got["Scope"]; ok {
+			t.Errorf("The scope shouldn't be served: %v", got)
+		}
+	})
+
+	t.Run("expired credentials", func(t *testing.T) {
+		cred := testCredential()
+		cred.Expires = time.Now().Add(-time.Minute)
+		s := &credentialServer{cred: cred, lastRefreshed: errors.New("the refresh failed"), metrics: metrics}
+		got := readSocket(t, serveSocket(t, s))
+		msg, _ := got["Error"].(string)
+		if !strings.HasPrefix(msg, "The credentials have expired") || !strings.Contains(msg, "the refresh failed") {
+			t.Errorf("The expiry and the last refresh error should be served, got %v", got)
+		}
+		if _, ok := got["AccessKeyId"]; ok {
+			t.Errorf("The expired credentials shouldn't be served: %v", got)
+		}
+	})
+}
+
+func TestServeRefreshesOnTrigger(t *testing.T) {
+	f := newSelftestFixture(t)
+	fake := &fakeSTS{}
+	useFakeSTS(t, fake)
+	client := f.client(t, nil)
+	metrics, err := newServeMetrics(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &credentialServer{
+		client:   client,
+		role:     ResolveRoleConfig(client.config, selftestRoleArn),
+		opts:     &ServeOptions{LoginFlow: LOGIN_FLOW_LOOPBACK, RefreshBuffer: time.Minute},
+		duration: 900,
+		metrics:  metrics,
+		triggers: make(chan string, 1),
+	}
+	if err := s.refresh(false); err != nil {
+		t.Fatal(err)
+	}
+	path := serveSocket(t, s)
+	if got := readSocket(t, path); got["AccessKeyId"] != "ASIAFAKE" {
+		t.Fatalf("The credentials of the login should be served, got %v", got)
+	}
+
+	go s.refreshLoop()
+	s.trigger("test")
+	deadline := time.Now().Add(10 * time.Second)
+	for len(fake.requestedDurations()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("The trigger should refresh the credentials")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,207 @@
+package lib
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const sessionKeyPrefix = "oidc:"
+
+// ProviderSession is the login state of the OIDC provider which is kept in the secret store
+// next to the AWS credentials, so that they can be renewed without the browser.
+type ProviderSession struct {
+	RefreshToken string `json:"refresh_token,omitempty"`
+	// IDToken is reused to assume another role without login while it's valid
+	IDToken  string    `json:"id_token,omitempty"`
+	Scope    string    `json:"scope,omitempty"`
+	StoredAt time.Time `json:"stored_at"`
+	// RoleArns are the roles cached before the cache key had the duration and the policies,
+	// they're renewed with the configured duration
+	RoleArns []string     `json:"role_arns,omitempty"`
+	Roles    []CachedRole `json:"roles,omitempty"`
+}
+
+// CachedRole is the request of the cached credentials, to renew them in the same way.
+type CachedRole struct {
+	RoleArn         string         `json:"role_arn"`
+	DurationSeconds int64          `json:"duration_seconds"`
+	Policy          *SessionPolicy `json:"policy,omitempty"`
+}
+
+func (r CachedRole) key() string {
+	return CredentialCacheKey(r.RoleArn, r.DurationSeconds, r.Policy)
+}
+
+func LoadProviderSession(store CredentialStore, provider string) (*ProviderSession, error) {
+	jsonStr, err := store.Get(sessionKeyPrefix + provider)
+	if err != nil {
+		if err == ErrCredentialNotFound {
+			return &ProviderSession{}, nil
+		}
+		return nil, err
+	}
+
+	var session ProviderSession
+	if err := json.Unmarshal([]byte(jsonStr), &session); err != nil {
+		return nil, errors.Wrap(err, "The stored OIDC session is broken")
+	}
+	return &session, nil
+}
+
+func SaveProviderSession(store CredentialStore, provider string, session *ProviderSession) error {
+	session.StoredAt = time.Now()
+	jsonStr, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return store.Set(sessionKeyPrefix+provider, string(jsonStr))
+}
+
+// StoredRefreshToken describes the refresh token in the secret store without revealing it.
+type StoredRefreshToken struct {
+	Provider    string
+	MaskedToken string
+	StoredAt    time.Time
+}
+
+// StoredRefreshTokens lists the refresh tokens of the configured providers.
+func StoredRefreshTokens() ([]StoredRefreshToken, error) {
+	var tokens []StoredRefreshToken
+	for _, name := range ProviderNames() {
+		store, err := NewCredentialStore(name, viper.Sub(name))
+		if err != nil {
+			return nil, err
+		}
+		session, err := LoadProviderSession(store, name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to load the OIDC session of %s", name)
+		}
+		if session.RefreshToken == "" {
+			continue
+		}
+		tokens = append(tokens, StoredRefreshToken{
+			Provider:    name,
+			MaskedToken: maskToken(session.RefreshToken),
+			StoredAt:    session.StoredAt,
+		})
+	}
+	return tokens, nil
+}
+
+// ClearRefreshToken deletes the refresh token of the provider from the secret store.
+// The cached AWS credentials are kept. With revoke, the token is also revoked by the OIDC provider.
+func ClearRefreshToken(name string, revoke bool) error {
+	config := viper.Sub(name)
+	if config == nil {
+		return errors.Errorf("The OIDC provider %s is not configured", name)
+	}
+	store, err := NewCredentialStore(name, config)
+	if err != nil {
+		return err
+	}
+	session, err := LoadProviderSession(store, name)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to load the OIDC session of %s", name)
+	}
+	if session.RefreshToken == "" {
+		return errors.Errorf("No refresh token is stored for %s", name)
+	}
+
+	if revoke {
+		client, err := CheckInstalled(name)
+		if err != nil {
+			return err
+		}
+		if err := client.RevokeRefreshToken(session.RefreshToken); err != nil {
+			return err
+		}
+	}
+
+	session.RefreshToken = ""
+	return SaveProviderSession(store, name, session)
+}
+
+// The cached ID token which expires within it isn't reused, STS may reject it on the way
+const idTokenReuseBuffer = 30 * time.Second
+
+// reusableIDToken returns the cached ID token of the provider if it's still valid for the role, otherwise empty.
+func reusableIDToken(client *OIDCClient, store CredentialStore, role *RoleConfig) string {
+	session, err := LoadProviderSession(store, client.Name())
+	if err != nil || session.IDToken == "" || !sameScopes(session.Scope, client.Scope()) {
+		return ""
+	}
+	claims, err := ParseJWTClaims(session.IDToken)
+	if err != nil {
+		return ""
+	}
+	if exp, ok := claims.Expiry(); !ok || time.Until(exp) < idTokenReuseBuffer {
+		return ""
+	}
+	audience := role.Audience
+	if audience == "" {
+		audience = client.config.GetString(CLIENT_ID)
+	}
+	if !claims.HasAudience(audience) {
+		return ""
+	}
+	return session.IDToken
+}
+
+// checkRefreshTokenEnabled fails if use_refresh_token is false, purging the refresh token stored before it.
+func checkRefreshTokenEnabled(client *OIDCClient, store CredentialStore, session *ProviderSession) error {
+	if client.UseRefreshToken() {
+		return nil
+	}
+	if session.RefreshToken != "" {
+		session.RefreshToken = ""
+		if err := SaveProviderSession(store, client.Name(), session); err != nil {
+			return errors.Wrap(err, "Failed to purge the stored refresh token")
+		}
+		Writeln("Purged the stored refresh token because %s is false", USE_REFRESH_TOKEN)
+	}
+	return errors.Errorf("%s is false for %s, login again", USE_REFRESH_TOKEN, client.Name())
+}
+
+func maskToken(token string) string {
+	if len(token) < 16 {
+		return "****"
+	}
+	return token[:4] + "..." + token[len(token)-4:]
+}
+
+func (s *ProviderSession) AddRole(role CachedRole) {
+	for _, r := range s.Roles {
+		if r.key() == role.key() {
+			return
+		}
+	}
+	s.Roles = append(s.Roles, role)
+}
+
+// saveLoginSession keeps the refresh token and the ID token of the login for the role.
+func saveLoginSession(client *OIDCClient, store CredentialStore, role CachedRole, tokenResponse *TokenResponse) {
+	if tokenResponse == nil || (tokenResponse.RefreshToken == "" && tokenResponse.IDToken == "") {
+		return
+	}
+	session, err := LoadProviderSession(store, client.Name())
+	if err != nil {
+		Traceln("Replacing the broken OIDC session: %v", err)
+		session = &ProviderSession{}
+	}
+	if tokenResponse.RefreshToken != "" {
+		session.RefreshToken = tokenResponse.RefreshToken
+	}
+	if !client.UseRefreshToken() {
+		// Purge the refresh token stored before use_refresh_token was disabled
+		session.RefreshToken = ""
+	}
+	session.IDToken = tokenResponse.IDToken
+	session.Scope = client.Scope()
+	session.AddRole(role)
+	if err := SaveProviderSession(store, client.Name(), session); err != nil {
+		Writeln("Can't save the OIDC session: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SessionPolicy downscopes the role session by the managed policies and the inline policy JSON.
+type SessionPolicy struct {
+	PolicyArns []string `json:"policy_arns,omitempty"`
+	Policy     string   `json:"policy,omitempty"`
+}
+
+func (p *SessionPolicy) IsEmpty() bool {
+	return p == nil || (len(p.PolicyArns) == 0 && p.Policy == "")
+}
+
+func (p *SessionPolicy) Validate() error {
+	if p == nil || p.Policy == "" {
+		return nil
+	}
+	if !json.Valid([]byte(p.Policy)) {
+		return errors.New("The inline session policy is not a valid JSON")
+	}
+	return nil
+}
+
+// CredentialCacheKey is the key of the cached credentials of the role. The requested duration and the session
+// policies are a part of it, so that a shorter or downscoped request never gets a broader cached session.
+// The inline policy is hashed after compacting the JSON.
+func CredentialCacheKey(roleArn string, durationSeconds int64, policy *SessionPolicy) string {
+	key := fmt.Sprintf("%s#duration=%d", roleArn, durationSeconds)
+	if policy.IsEmpty() {
+		return key
+	}
+	if len(policy.PolicyArns) > 0 {
+		arns := append([]string{}, policy.PolicyArns...)
+		sort.Strings(arns)
+		key += ";policy_arns=" + strings.Join(arns, ",")
+	}
+	if policy.Policy != "" {
+		var compact bytes.Buffer
+		doc := []byte(policy.Policy)
+		if json.Compact(&compact, doc) == nil {
+			doc = compact.Bytes()
+		}
+		sum := sha256.Sum256(doc)
+		key += ";policy=" + hex.EncodeToString(sum[:16])
+	}
+	return key
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// memoryStore is the in-memory CredentialStore.
+type memoryStore map[string]string
+
+func (s memoryStore) Get(key string) (string, error) {
+	value, ok := s[key]
+	if !ok {
+		return "", ErrCredentialNotFound
+	}
+	return value, nil
+}
+
+func (s memoryStore) Set(key, value string) error {
+	s[key] = value
+	return nil
+}
+
+func (s memoryStore) Delete(key string) error {
+	delete(s, key)
+	return nil
+}
+
+const testRoleArn = "arn:aws:iam::123456789012:role/test"
+
+func testCredential() *AWSCredentials {
+	return &AWSCredentials{
+		Version:         1,
+		AWSAccessKey:    "ASIATEST",
+		AWSSecretKey:    "secret",
+		AWSSessionToken: "token",
+		Expires:         time.Now().Add(time.Hour),
+	}
+}
+
+func TestCredentialCacheKeyChangedPolicyMisses(t *testing.T) {
+	cached := &SessionPolicy{
+		PolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess"},
+		Policy:     `{"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": "s3:GetObject", "Resource": "*"}]}`,
+	}
+	store := memoryStore{}
+	SaveAWSCredential(store, testRoleArn, 3600, cached, testCredential())
+
+	tests := []struct {
+		name   string
+		policy *SessionPolicy
+		hit    bool
+	}{
+		{"same policies reordered and reformatted", &SessionPolicy{
+			PolicyArns: []string{"arn:aws:iam::aws:policy/AmazonS3ReadOnlyAccess", "arn:aws:iam::aws:policy/ReadOnlyAccess"},
+			Policy:     `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`,
+		}, true},
+		{"changed inline policy", &SessionPolicy{
+			PolicyArns: cached.PolicyArns,
+			Policy:     `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:*","Resource":"*"}]}`,
+		}, false},
+		{"changed policy ARN", &SessionPolicy{
+			PolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess", "arn:aws:iam::aws:policy/AdministratorAccess"},
+			Policy:     cached.Policy,
+		}, false},
+		{"removed policy ARN", &SessionPolicy{
+			PolicyArns: []string{"arn:aws:iam::aws:policy/ReadOnlyAccess"},
+			Policy:     cached.Policy,
+		}, false},
+		{"no policies", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cred, err := AWSCredential(store, testRoleArn, 3600, tt.policy)
+			if tt.hit && (err != nil || cred == nil) {
+				t.Errorf("The cached credential should be hit, got %v", err)
+			}
+			if !tt.hit && err == nil {
+				t.Errorf("The cached credential of other policies must miss, got %+v", cred)
+			}
+		})
+	}
+}
+
+func TestCredentialCacheKeyChangedDurationMisses(t *testing.T) {
+	store := memoryStore{}
+	SaveAWSCredential(store, testRoleArn, 3600, nil, testCredential())
+
+	if _, err := AWSCredential(store, testRoleArn, 900, nil); err == nil {
+		t.Error("The cached credential of another duration must miss")
+	}
+}
+
+func TestChangedSessionPolicyAssumesRoleAgain(t *testing.T) {
+	useTempLockDir(t)
+	f := newSelftestFixture(t)
+	fake := &fakeSTS{}
+	useFakeSTS(t, fake)
+	useCredentialStore(t, "test-memory", memoryStore{})
+	client := f.client(t, map[string]string{SECRET_BACKEND: "test-memory"})
+
+	readOnly := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:GetObject","Resource":"*"}]}`
+	readWrite := `{"Version":"2012-10-17","Statement":[{"Effect":"Allow","Action":"s3:*","Resource":"*"}]}`
+	for _, policy := range []string{readOnly, readOnly, readWrite} {
+		authenticateJSON(t, client, &AuthenticateOptions{SessionPolicy: &SessionPolicy{Policy: policy}})
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.assumeInputs) != 2 {
+		t.Fatalf("The role should be assumed for the first and the changed policy only, got %d calls", len(fake.assumeInputs))
+	}
+	if got := aws.StringValue(fake.assumeInputs[0].Policy); got != readOnly {
+		t.Errorf("The first policy = %s, want %s", got, readOnly)
+	}
+	if got := aws.StringValue(fake.assumeInputs[1].Policy); got != readWrite {
+		t.Errorf("The changed policy should be sent, got %s", got)
+	}
+}
@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -10,7 +11,135 @@ import (
 	"github.com/spf13/viper"
 )
 
-func RunSetup(ui *input.UI) {
+// ProviderConfig is the provider config which RunSetup asks.
+type ProviderConfig struct {
+	Name                      string
+	MetadataURL               string
+	ClientID                  string
+	ClientSecret              string
+	MaxSessionDurationSeconds int64
+	DefaultIAMRoleArn         string
+	RoleSessionName           string
+	// AllowInsecureMetadata accepts the http metadata URL, only for the local testing
+	AllowInsecureMetadata bool
+}
+
+// SetupOptions changes the validation of RunSetup.
+type SetupOptions struct {
+	AllowInsecureMetadata bool
+}
+
+// ValidationError tells which field of ProviderConfig is invalid.
+type ValidationError struct {
+	Field string
+	Err   error
+}
+
+func (e *ValidationError) Error() string {
+	return "Invalid " + e.Field + ": " + e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// Validate checks the fields in the same way as the prompts of RunSetup.
+func (c *ProviderConfig) Validate() error {
+	required := []struct {
+		field string
+		value string
+	}{
+		{"name", c.Name},
+		{OIDC_PROVIDER_METADATA_URL, c.MetadataURL},
+		{CLIENT_ID, c.ClientID},
+		{AWS_FEDERATION_ROLE_SESSION_NAME, c.RoleSessionName},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			return &ValidationError{Field: r.field, Err: errors.New("Input is required")}
+		}
+	}
+	if err := ValidateMetadataURL(c.MetadataURL, c.AllowInsecureMetadata); err != nil {
+		return &ValidationError{Field: OIDC_PROVIDER_METADATA_URL, Err: err}
+	}
+	if err := validateMaxSessionDuration(c.MaxSessionDurationSeconds); err != nil {
+		return &ValidationError{Field: MAX_SESSION_DURATION_SECONDS, Err: err}
+	}
+	if c.DefaultIAMRoleArn != "" {
+		if err := ValidateRoleArn(c.DefaultIAMRoleArn); err != nil {
+			return &ValidationError{Field: DEFAULT_IAM_ROLE_ARN, Err: err}
+		}
+	}
+	return nil
+}
+
+// Configure writes the provider config into the global config without prompts.
+func Configure(cfg ProviderConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	config := map[string]string{}
+
+	config[OIDC_PROVIDER_METADATA_URL] = cfg.MetadataURL
+	config[CLIENT_ID] = cfg.ClientID
+	config[CLIENT_SECRET] = cfg.ClientSecret
+	config[MAX_SESSION_DURATION_SECONDS] = strconv.FormatInt(cfg.MaxSessionDurationSeconds, 10)
+	config[DEFAULT_IAM_ROLE_ARN] = cfg.DefaultIAMRoleArn
+	config[AWS_FEDERATION_ROLE_SESSION_NAME] = cfg.RoleSessionName
+	if cfg.AllowInsecureMetadata {
+		config[ALLOW_INSECURE_METADATA] = "true"
+	}
+
+	viper.Set(cfg.Name, config)
+
+	// Write the global config only, the project config merged into viper stays in the project
+	os.MkdirAll(ConfigPath(), 0700)
+	configPath := ConfigPath() + "/config.yaml"
+	global := viper.New()
+	global.SetConfigFile(configPath)
+	global.ReadInConfig()
+	global.Set(cfg.Name, config)
+	if err := global.WriteConfig(); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", configPath)
+	}
+	return nil
+}
+
+// ValidateMetadataURL requires the https metadata URL, because the client secret and the tokens are sent to
+// the endpoints which it lists. The http one on a loopback address is accepted with a warning if it's allowed.
+func ValidateMetadataURL(metadataURL string, allowInsecure bool) error {
+	u, err := url.Parse(metadataURL)
+	if err != nil || u.Host == "" {
+		return errors.Errorf("%s is not a URL", metadataURL)
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if !allowInsecure {
+			return errors.Errorf("%s must be https, set %s or --insecure only for the local testing", metadataURL, ALLOW_INSECURE_METADATA)
+		}
+		if !isLoopbackHost(u.Hostname()) {
+			return errors.Errorf("%s must be https, %s allows http only on a loopback address", metadataURL, ALLOW_INSECURE_METADATA)
+		}
+		Writeln("WARNING: The metadata URL %s is not https. The client secret and the tokens are sent in the clear.", metadataURL)
+		return nil
+	}
+	return errors.Errorf("%s must be https", metadataURL)
+}
+
+func validateMaxSessionDuration(i int64) error {
+	if i < 900 || i > 43200 {
+		return errors.New("Input must be 900-43200")
+	}
+	return nil
+}
+
+func RunSetup(ui *input.UI, opts *SetupOptions) {
+	if opts == nil {
+		opts = &SetupOptions{}
+	}
 	if ui == nil {
 		ui = &input.UI{
 			Writer: os.Stdout,
@@ -22,10 +151,26 @@ func RunSetup(ui *input.UI) {
 		Required: true,
 		Loop:     true,
 	})
-	server, _ := ui.Ask("OIDC provider metadata URL (https://your-oidc-provider/.well-known/openid-configuration):", &input.Options{
+	var discovered string
+	server, _ := ui.Ask("OIDC provider metadata URL (https://your-oidc-provider/.well-known/openid-configuration), or your email address to discover it by WebFinger:", &input.Options{
 		Required: true,
 		Loop:     true,
+		ValidateFunc: func(s string) error {
+			if !IsWebFingerIdentifier(s) {
+				return ValidateMetadataURL(s, opts.AllowInsecureMetadata)
+			}
+			metadataURL, err := DiscoverMetadataURL(s)
+			if err != nil {
+				return err
+			}
+			discovered = metadataURL
+			return nil
+		},
 	})
+	if discovered != "" {
+		Writeln("Discovered the OIDC provider: %s", discovered)
+		server = discovered
+	}
 	clientID, _ := ui.Ask("Client ID which is registered in the OIDC provider:", &input.Options{
 		Required: true,
 		Loop:     true,
@@ -40,10 +185,10 @@ func RunSetup(ui *input.UI) {
 		Loop:     true,
 		ValidateFunc: func(s string) error {
 			i, err := strconv.ParseInt(s, 10, 64)
-			if err != nil || i < 900 || i > 43200 {
+			if err != nil {
 				return errors.New("Input must be 900-43200")
 			}
-			return nil
+			return validateMaxSessionDuration(i)
 		},
 	})
 	defaultIAMRoleArn, _ := ui.Ask("The default IAM Role ARN when you have multiple roles, as arn:aws:iam::<account-id>:role/<role-name> (Default: none):", &input.Options{
@@ -54,45 +199,45 @@ func RunSetup(ui *input.UI) {
 			if s == "" {
 				return nil
 			}
-			arn := strings.Split(s, ":")
-			if len(arn) == 6 {
-				if arn[0] == "arn" && arn[1] == "aws" && arn[2] == "iam" && arn[3] == "" && strings.HasPrefix(arn[5], "role/") {
-					return nil
-				}
-			}
-			return errors.New("Input must be IAM Role ARN")
+			return ValidateRoleArn(s)
 		},
 	})
 
-	config := map[string]string{}
-
-	config[OIDC_PROVIDER_METADATA_URL] = server
-	config[CLIENT_ID] = clientID
-	config[CLIENT_SECRET] = clientSecret
-	config[MAX_SESSION_DURATION_SECONDS] = maxSessionDurationSeconds
-	config[DEFAULT_IAM_ROLE_ARN] = defaultIAMRoleArn
-
-	oidcSetup(ui, config)
+	duration, _ := strconv.ParseInt(maxSessionDurationSeconds, 10, 64)
+	cfg := ProviderConfig{
+		Name:                      providerName,
+		MetadataURL:               server,
+		ClientID:                  clientID,
+		ClientSecret:              clientSecret,
+		MaxSessionDurationSeconds: duration,
+		DefaultIAMRoleArn:         defaultIAMRoleArn,
+		AllowInsecureMetadata:     opts.AllowInsecureMetadata,
+	}
 
-	viper.Set(providerName, config)
+	oidcSetup(ui, &cfg)
 
-	os.MkdirAll(ConfigPath(), 0700)
-	configPath := ConfigPath() + "/config.yaml"
-	viper.SetConfigFile(configPath)
-	err := viper.WriteConfig()
-
-	if err != nil {
-		Writeln("Failed to write %s", configPath)
+	if err := Configure(cfg); err != nil {
+		Writeln("Failed to save the config")
 		Exit(err)
 	}
 
-	Writeln("Saved %s", configPath)
+	Writeln("Saved %s", ConfigPath()+"/config.yaml")
+}
+
+func ValidateRoleArn(s string) error {
+	arn := strings.Split(s, ":")
+	if len(arn) == 6 {
+		if arn[0] == "arn" && arn[1] == "aws" && arn[2] == "iam" && arn[3] == "" && strings.HasPrefix(arn[5], "role/") {
+			return nil
+		}
+	}
+	return errors.New("Input must be IAM Role ARN")
 }
 
-func oidcSetup(ui *input.UI, config map[string]string) {
+func oidcSetup(ui *input.UI, cfg *ProviderConfig) {
 	awsRoleSessionName, _ := ui.Ask("AWS federation roleSessionName:", &input.Options{
 		Required: true,
 		Loop:     true,
 	})
-	config[AWS_FEDERATION_ROLE_SESSION_NAME] = awsRoleSessionName
+	cfg.RoleSessionName = awsRoleSessionName
 }
@@ -0,0 +1,29 @@
+package lib
+
+import "testing"
+
+func TestValidateMetadataURL(t *testing.T) {
+	tests := []struct {
+		url           string
+		allowInsecure bool
+		wantErr       bool
+	}{
+		{"https://idp.example.com/.well-known/openid-configuration", false, false},
+		{"http://idp.example.com/.well-known/openid-configuration", false, true},
+		{"http://idp.example.com/.well-known/openid-configuration", true, true},
+		{"http://192.0.2.1:8080/.well-known/openid-configuration", true, true},
+		{"http://127.0.0.1:8080/.well-known/openid-configuration", false, true},
+		{"http://127.0.0.1:8080/.well-known/openid-configuration", true, false},
+		{"http://[::1]:8080/.well-known/openid-configuration", true, false},
+		{"http://localhost:8080/.well-known/openid-configuration", true, false},
+		{"ftp://idp.example.com/", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			err := ValidateMetadataURL(tt.url, tt.allowInsecure)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateMetadataURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
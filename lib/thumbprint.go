@@ -0,0 +1,94 @@
+package lib
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const thumbprintsFile = "thumbprints.json"
+
+// seenThumbprint is the last thumbprint of the provider which is cached in the config directory.
+type seenThumbprint struct {
+	Host       string    `json:"host"`
+	Thumbprint string    `json:"thumbprint"`
+	SeenAt     time.Time `json:"seen_at"`
+}
+
+// IssuerThumbprint returns the thumbprint of the IAM OIDC identity provider: the SHA-1 of the top intermediate CA
+// certificate which the host of jwks_uri serves.
+func IssuerThumbprint(client *OIDCClient) (string, string, error) {
+	jwksURI := client.metadata.JwksURI
+	if jwksURI == "" {
+		jwksURI = client.metadata.Issuer
+	}
+	u, err := url.Parse(jwksURI)
+	if err != nil || u.Hostname() == "" {
+		return "", "", errors.Errorf("Invalid jwks_uri: %s", jwksURI)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: DEFAULT_DIAL_TIMEOUT}}
+	conn, err := dialer.DialContext(runContext(), "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return "", "", errors.Wrapf(err, "Failed to connect %s", u.Host)
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", "", errors.Errorf("%s served no certificate", u.Host)
+	}
+	sum := sha1.Sum(certs[len(certs)-1].Raw)
+	return u.Hostname(), hex.EncodeToString(sum[:]), nil
+}
+
+// checkThumbprint warns when the thumbprint differs from the last one, e.g. the OIDC provider rotated
+// the certificate. STS rejects the tokens by InvalidIdentityToken until the IAM OIDC provider is updated.
+func checkThumbprint(client *OIDCClient) {
+	host, thumbprint, err := IssuerThumbprint(client)
+	if err != nil {
+		Traceln("Skipped the thumbprint check: %v", err)
+		return
+	}
+
+	path := filepath.Join(CachePath(), thumbprintsFile)
+	seen := map[string]seenThumbprint{}
+	if b, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(b, &seen); err != nil {
+			Traceln("Replacing the broken %s: %v", path, err)
+			seen = map[string]seenThumbprint{}
+		}
+	}
+
+	last, ok := seen[client.Name()]
+	if ok && last.Host == host && last.Thumbprint == thumbprint {
+		return
+	}
+	if ok && last.Host == host {
+		Writeln("WARNING: The TLS certificate thumbprint of %s changed from %s to %s since %s.", host, last.Thumbprint, thumbprint, last.SeenAt.Format(time.RFC3339))
+		Writeln("If STS rejects the token by InvalidIdentityToken, add the new thumbprint to the IAM OIDC identity provider:")
+		Writeln("  aws iam update-open-id-connect-provider-thumbprint --open-id-connect-provider-arn <ARN> --thumbprint-list %s", thumbprint)
+	}
+
+	seen[client.Name()] = seenThumbprint{Host: host, Thumbprint: thumbprint, SeenAt: time.Now()}
+	b, err := json.MarshalIndent(seen, "", "  ")
+	if err != nil {
+		return
+	}
+	os.MkdirAll(CachePath(), 0700)
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		Traceln("Can't save %s: %v", path, err)
+	}
+}
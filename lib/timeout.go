@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// EXIT_CODE_TIMEOUT is the exit code when --timeout expires, the same as timeout(1)
+const EXIT_CODE_TIMEOUT = 124
+
+var runCtx = context.Background()
+
+var timeoutCleanupsMu sync.Mutex
+var timeoutCleanups = map[int]func(){}
+var timeoutCleanupSeq int
+
+// SetTimeout bounds the whole run: the discovery, the login and the AWS calls. The HTTP requests and the wait for
+// the callback are canceled by the deadline, and the process exits with EXIT_CODE_TIMEOUT after the cleanups
+// even if it's blocked elsewhere, e.g. on the prompt.
+func SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	runCtx = ctx
+	go func() {
+		<-ctx.Done()
+		cancel()
+		runTimeoutCleanups()
+		// Let the step which observed the deadline report its error first
+		time.Sleep(100 * time.Millisecond)
+		Writeln("Timed out after %s", timeout)
+		os.Exit(EXIT_CODE_TIMEOUT)
+	}()
+}
+
+// runContext is the context of every request of the run, it has the deadline of --timeout.
+func runContext() context.Context {
+	return runCtx
+}
+
+func isTimedOut() bool {
+	return runCtx.Err() != nil
+}
+
+// onTimeout registers the cleanup on the timeout, e.g. closing the callback server. The returned func unregisters it.
+func onTimeout(cleanup func()) func() {
+	timeoutCleanupsMu.Lock()
+	defer timeoutCleanupsMu.Unlock()
+
+	timeoutCleanupSeq++
+	id := timeoutCleanupSeq
+	timeoutCleanups[id] = cleanup
+	return func() {
+		timeoutCleanupsMu.Lock()
+		defer timeoutCleanupsMu.Unlock()
+		delete(timeoutCleanups, id)
+	}
+}
+
+func runTimeoutCleanups() {
+	timeoutCleanupsMu.Lock()
+	cleanups := timeoutCleanups
+	timeoutCleanups = map[int]func(){}
+	timeoutCleanupsMu.Unlock()
+
+	for _, cleanup := range cleanups {
+		cleanup()
+	}
+}
@@ -0,0 +1,66 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	TokenFileFormatJWT  = "jwt"
+	TokenFileFormatJSON = "json"
+)
+
+type tokenFile struct {
+	IDToken   string `json:"id_token"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// WriteTokenFile saves the ID token for the other tools, as the raw JWT or JSON with its expiration.
+// The file is readable only by the user and replaced atomically.
+func WriteTokenFile(path, format, idToken string) error {
+	var data []byte
+	switch format {
+	case "", TokenFileFormatJWT:
+		data = []byte(idToken)
+	case TokenFileFormatJSON:
+		v := tokenFile{IDToken: idToken}
+		if claims, err := ParseJWTClaims(idToken); err == nil {
+			if exp, ok := claims.Expiry(); ok {
+				v.ExpiresAt = exp.UTC().Format(time.RFC3339)
+			}
+		}
+		var err error
+		data, err = json.Marshal(v)
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal the token file")
+		}
+	default:
+		return errors.Errorf("Unknown token file format: %s", format)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".token-*")
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return errors.Wrapf(err, "Failed to write %s", path)
+	}
+	return nil
+}
@@ -1,6 +1,9 @@
 package lib
 
-import "time"
+import (
+	"strings"
+	"time"
+)
 
 type AWSCredentials struct {
 	Version         int
@@ -9,6 +12,44 @@ type AWSCredentials struct {
 	AWSSessionToken string    `json:"SessionToken"`
 	PrincipalARN    string    `json:"-"`
 	Expires         time.Time `json:"Expiration"`
+	// Scope is requested on the login which issued the credentials, only kept in the secret store
+	Scope string `json:",omitempty"`
+	// GrantedScope is granted by the OIDC provider on the login, only kept in the secret store
+	GrantedScope string `json:",omitempty"`
+}
+
+// Scopes returns the granted scopes, or the requested ones if the granted ones aren't known.
+func (c *AWSCredentials) Scopes() []string {
+	if c.GrantedScope != "" {
+		return strings.Fields(c.GrantedScope)
+	}
+	return strings.Fields(c.Scope)
+}
+
+// scopedCredentials is the JSON output with the scopes for auditing
+type scopedCredentials struct {
+	*AWSCredentials
+	Scopes []string `json:",omitempty"`
+}
+
+// SSORoleCredentials is the response shape of GetRoleCredentials of AWS SSO.
+// Unlike credential_process, the expiration is the epoch milliseconds.
+type SSORoleCredentials struct {
+	RoleCredentials struct {
+		AccessKeyID     string `json:"accessKeyId"`
+		SecretAccessKey string `json:"secretAccessKey"`
+		SessionToken    string `json:"sessionToken"`
+		Expiration      int64  `json:"expiration"`
+	} `json:"roleCredentials"`
+}
+
+func NewSSORoleCredentials(cred *AWSCredentials) *SSORoleCredentials {
+	out := &SSORoleCredentials{}
+	out.RoleCredentials.AccessKeyID = cred.AWSAccessKey
+	out.RoleCredentials.SecretAccessKey = cred.AWSSecretKey
+	out.RoleCredentials.SessionToken = cred.AWSSessionToken
+	out.RoleCredentials.Expiration = cred.Expires.UnixNano() / int64(time.Millisecond)
+	return out
 }
 
 type SessionCredentials struct {
@@ -27,6 +68,8 @@ type TokenResponse struct {
 	RefreshToken     string `json:"refresh_token"`
 	ExpiresIn        int64  `json:"expires_in"`
 	RefreshExpiresIn int64  `json:"refresh_expires_in"`
+	// Scope is granted by the OIDC provider, it's omitted when it's identical to the requested one (RFC 6749 5.1)
+	Scope string `json:"scope"`
 }
 
 type LoginParams struct {
@@ -0,0 +1,80 @@
+package lib
+
+import (
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const VAULT_REFERENCE_PREFIX = "vault://"
+
+// resolveVaultReferences replaces the config values like vault://secret/path#key with the secret in Vault.
+// The resolved values are kept only in memory.
+func resolveVaultReferences(config *viper.Viper) error {
+	for _, key := range config.AllKeys() {
+		ref, ok := config.Get(key).(string)
+		if !ok || !strings.HasPrefix(ref, VAULT_REFERENCE_PREFIX) {
+			continue
+		}
+		value, err := readVaultSecret(ref)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to resolve %s from Vault", key)
+		}
+		config.Set(key, value)
+	}
+	return nil
+}
+
+// readVaultSecret reads the key of the secret by Vault HTTP API. The path is the API path,
+// so KV version 2 needs the data segment, e.g. vault://secret/data/aws-cli-oidc#client_secret.
+func readVaultSecret(ref string) (string, error) {
+	path := strings.TrimPrefix(ref, VAULT_REFERENCE_PREFIX)
+	i := strings.LastIndex(path, "#")
+	if i < 0 || i == len(path)-1 {
+		return "", errors.Errorf("The reference %s has no #key", ref)
+	}
+	path, key := path[:i], path[i+1:]
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return "", errors.New("VAULT_TOKEN is not set")
+	}
+
+	restClient, err := NewRestClient(&RestClientConfig{})
+	if err != nil {
+		return "", err
+	}
+	res, err := restClient.Target(addr).Path("/v1/"+path).Request().
+		Header("X-Vault-Token", token).
+		Get()
+	if err != nil {
+		return "", errors.Wrapf(err, "Vault is unreachable at %s", addr)
+	}
+	if res.Status() != 200 {
+		return "", errors.Errorf("Failed to read %s from Vault, statusCode: %d", path, res.Status())
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := res.ReadJson(&secret); err != nil {
+		return "", errors.Wrap(err, "Failed to parse the Vault response")
+	}
+
+	data := secret.Data
+	// KV version 2 nests the secret in data.data
+	if nested, ok := data["data"].(map[string]interface{}); ok && data["metadata"] != nil {
+		data = nested
+	}
+	value, ok := data[key].(string)
+	if !ok {
+		return "", errors.Errorf("The key %s is not found in %s", key, path)
+	}
+	return value, nil
+}
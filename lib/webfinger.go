@@ -0,0 +1,104 @@
+package lib
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// WEBFINGER_ISSUER_REL is the rel of the OIDC issuer link in the WebFinger response.
+const WEBFINGER_ISSUER_REL = "http://openid.net/specs/connect/1.0/issuer"
+
+type webFingerResponse struct {
+	Subject string `json:"subject"`
+	Links   []struct {
+		Rel  string `json:"rel"`
+		Href string `json:"href"`
+	} `json:"links"`
+}
+
+// IsWebFingerIdentifier tells whether the input is an email-like identifier rather than a URL.
+func IsWebFingerIdentifier(s string) bool {
+	return strings.Contains(s, "@") && !strings.Contains(s, "://")
+}
+
+// DiscoverMetadataURL finds the OIDC issuer of the user by WebFinger (RFC 7033) on the host of the identifier,
+// as OpenID Connect Discovery 1.0 describes, and returns the URL of its discovery document.
+// The identifier is an email-like one, e.g. joe@example.com, or a URL.
+func DiscoverMetadataURL(identifier string) (string, error) {
+	resource, host, err := webFingerResource(identifier)
+	if err != nil {
+		return "", err
+	}
+
+	restClient, err := NewRestClient(&RestClientConfig{})
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to initialize HTTP client for WebFinger")
+	}
+	res, err := restClient.Target("https://"+host+"/.well-known/webfinger").
+		QueryParam("resource", resource).
+		QueryParam("rel", WEBFINGER_ISSUER_REL).
+		Request().Get()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to query WebFinger of %s", host)
+	}
+	if res.Status() != 200 {
+		return "", errors.Errorf("Failed to query WebFinger of %s, statusCode: %d", host, res.Status())
+	}
+	var wf webFingerResponse
+	if err := res.ReadJson(&wf); err != nil {
+		return "", errors.Wrap(err, "Failed to parse WebFinger response")
+	}
+
+	var issuer string
+	for _, link := range wf.Links {
+		if link.Rel == WEBFINGER_ISSUER_REL {
+			issuer = link.Href
+			break
+		}
+	}
+	if issuer == "" {
+		return "", errors.Errorf("WebFinger of %s doesn't advertise the OIDC issuer of %s", host, resource)
+	}
+	u, err := url.Parse(issuer)
+	if err != nil || u.Scheme != "https" || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", errors.Errorf("WebFinger of %s returned the invalid issuer: %s", host, issuer)
+	}
+
+	// The discovery document must be of the issuer which WebFinger advertised
+	metadataURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	res, err = restClient.Target(metadataURL).Request().Get()
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to get OIDC metadata")
+	}
+	if res.Status() != 200 {
+		return "", errors.Errorf("Failed to get OIDC metadata, statusCode: %d", res.Status())
+	}
+	var metadata OIDCMetadataResponse
+	if err := res.ReadJson(&metadata); err != nil {
+		return "", errors.Wrap(err, "Failed to parse OIDC metadata response")
+	}
+	if metadata.Issuer != issuer {
+		return "", errors.Errorf("The issuer of the discovery document %s differs from the one which WebFinger advertised %s", metadata.Issuer, issuer)
+	}
+	return metadataURL, nil
+}
+
+// webFingerResource returns the acct: URI or the URL of the identifier, and the host to query.
+func webFingerResource(identifier string) (string, string, error) {
+	identifier = strings.TrimSpace(identifier)
+	if IsWebFingerIdentifier(identifier) {
+		acct := strings.TrimPrefix(identifier, "acct:")
+		i := strings.LastIndex(acct, "@")
+		if i <= 0 || i == len(acct)-1 {
+			return "", "", errors.Errorf("%s is not an email-like identifier", identifier)
+		}
+		return "acct:" + acct, acct[i+1:], nil
+	}
+	u, err := url.Parse(identifier)
+	if err != nil || u.Host == "" {
+		return "", "", errors.Errorf("%s is neither an email-like identifier nor a URL", identifier)
+	}
+	return identifier, u.Host, nil
+}